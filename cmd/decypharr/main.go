@@ -9,13 +9,16 @@ import (
 	"github.com/sirrobot01/debrid-blackhole/pkg/qbit"
 	"github.com/sirrobot01/debrid-blackhole/pkg/server"
 	"github.com/sirrobot01/debrid-blackhole/pkg/service"
+	"github.com/sirrobot01/debrid-blackhole/pkg/stream"
 	"github.com/sirrobot01/debrid-blackhole/pkg/version"
 	"github.com/sirrobot01/debrid-blackhole/pkg/web"
 	"github.com/sirrobot01/debrid-blackhole/pkg/worker"
 	"os"
+	"os/signal"
 	"runtime/debug"
 	"strconv"
 	"sync"
+	"syscall"
 )
 
 func Start(ctx context.Context) error {
@@ -39,14 +42,23 @@ func Start(ctx context.Context) error {
 	_log.Info().Msgf("Default Log Level: %s", cfg.LogLevel)
 
 	svc := service.New()
+	// Results kept in memory are written before exiting
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	defer func() {
+		// The service is replaced when the config changes
+		service.GetDebrid().SaveCaches()
+	}()
 	_qbit := qbit.New()
 	srv := server.New()
 	webRoutes := web.New(_qbit).Routes()
 	qbitRoutes := _qbit.Routes()
+	streamRoutes := stream.New().Routes()
 
 	// Register routes
 	srv.Mount("/", webRoutes)
 	srv.Mount("/api/v2", qbitRoutes)
+	srv.Mount("/stream", streamRoutes)
 
 	safeGo := func(f func() error) {
 		wg.Add(1)
@@ -85,6 +97,10 @@ func Start(ctx context.Context) error {
 		return worker.Start(ctx)
 	})
 
+	safeGo(func() error {
+		return _qbit.Start(ctx)
+	})
+
 	if cfg.Repair.Enabled {
 		safeGo(func() error {
 			err := svc.Repair.Start(ctx)
@@ -105,6 +121,7 @@ func Start(ctx context.Context) error {
 	case err := <-errChan:
 		return err
 	case <-ctx.Done():
-		return ctx.Err()
+		_log.Info().Msg("Shutting down")
+		return nil
 	}
 }
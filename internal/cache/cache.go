@@ -1,86 +1,180 @@
 package cache
 
 import (
+	"encoding/json"
+	"github.com/sirrobot01/debrid-blackhole/internal/logger"
+	"github.com/sirrobot01/debrid-blackhole/internal/store"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	DefaultPositiveTTL = 24 * time.Hour
+	DefaultNegativeTTL = time.Hour
+
+	// saveDelay batches the results added in a row into a single write
+	saveDelay = 10 * time.Second
+)
+
+// Entry is the availability of an infohash on a debrid at the time it was checked
+type Entry struct {
+	Cached    bool      `json:"cached"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Stats are the hit/miss counters of a Cache
+type Stats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Expired   int64 `json:"expired"`
+	Positives int   `json:"positives"`
+	Negatives int   `json:"negatives"`
+}
+
+// Cache stores the availability of infohashes on a debrid.
+// Cached and uncached results expire after separate TTLs.
+// If bucket is set, the cache is persisted in that bucket of the store and reloaded on start
 type Cache struct {
-	data     map[string]struct{}
-	order    []string
-	maxItems int
-	mu       sync.RWMutex
+	data        map[string]Entry
+	order       []string
+	maxItems    int
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+	bucket      string
+	store       store.Store
+	dirty       map[string]struct{} // Values added or evicted since the last save
+	saveTimer   *time.Timer
+	mu          sync.RWMutex
+	saveMu      sync.Mutex
+
+	hits    atomic.Int64
+	misses  atomic.Int64
+	expired atomic.Int64
 }
 
-func New(maxItems int) *Cache {
+func New(bucket string, maxItems int, positiveTTL, negativeTTL time.Duration) *Cache {
 	if maxItems <= 0 {
 		maxItems = 1000
 	}
-	return &Cache{
-		data:     make(map[string]struct{}, maxItems),
-		order:    make([]string, 0, maxItems),
-		maxItems: maxItems,
+	if positiveTTL <= 0 {
+		positiveTTL = DefaultPositiveTTL
+	}
+	if negativeTTL <= 0 {
+		negativeTTL = DefaultNegativeTTL
 	}
+	c := &Cache{
+		data:        make(map[string]Entry, maxItems),
+		order:       make([]string, 0, maxItems),
+		maxItems:    maxItems,
+		positiveTTL: positiveTTL,
+		negativeTTL: negativeTTL,
+		bucket:      bucket,
+		dirty:       make(map[string]struct{}),
+	}
+	if bucket != "" {
+		c.store = store.GetStore()
+	}
+	c.load()
+	return c
 }
 
-func (c *Cache) Add(value string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+func (c *Cache) isFresh(e Entry, now time.Time) bool {
+	ttl := c.negativeTTL
+	if e.Cached {
+		ttl = c.positiveTTL
+	}
+	return now.Sub(e.CheckedAt) < ttl
+}
 
+// set adds or replaces an entry, the oldest entry is evicted once the cache is full. Caller must hold the lock
+func (c *Cache) set(value string, e Entry) {
 	if _, exists := c.data[value]; !exists {
 		if len(c.order) >= c.maxItems {
 			delete(c.data, c.order[0])
+			c.dirty[c.order[0]] = struct{}{}
 			c.order = c.order[1:]
 		}
-		c.data[value] = struct{}{}
 		c.order = append(c.order, value)
 	}
+	c.data[value] = e
+	c.dirty[value] = struct{}{}
 }
 
-func (c *Cache) AddMultiple(values map[string]bool) {
+// scheduleSave saves the cache after saveDelay, unless a save is already scheduled. Caller must hold the lock
+func (c *Cache) scheduleSave() {
+	if c.store == nil || c.saveTimer != nil {
+		return
+	}
+	c.saveTimer = time.AfterFunc(saveDelay, c.Save)
+}
+
+func (c *Cache) Add(value string, cached bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.set(value, Entry{Cached: cached, CheckedAt: time.Now()})
+	c.scheduleSave()
+}
 
-	for value, exists := range values {
-		if !exists {
-			if _, exists := c.data[value]; !exists {
-				if len(c.order) >= c.maxItems {
-					delete(c.data, c.order[0])
-					c.order = c.order[1:]
-				}
-				c.data[value] = struct{}{}
-				c.order = append(c.order, value)
-			}
-		}
+// AddMultiple stores the result of an availability check, both cached(true) and uncached(false)
+func (c *Cache) AddMultiple(values map[string]bool) {
+	if len(values) == 0 {
+		return
 	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for value, cached := range values {
+		c.set(value, Entry{Cached: cached, CheckedAt: now})
+	}
+	c.scheduleSave()
 }
 
-func (c *Cache) Get(index int) (string, bool) {
+// Get returns the availability of value. ok is false if it is unknown or expired
+func (c *Cache) Get(value string) (cached bool, ok bool) {
 	c.mu.RLock()
-	defer c.mu.RUnlock()
-	if index < 0 || index >= len(c.order) {
-		return "", false
+	e, exists := c.data[value]
+	c.mu.RUnlock()
+	if !exists {
+		c.misses.Add(1)
+		return false, false
 	}
-	return c.order[index], true
+	if !c.isFresh(e, time.Now()) {
+		c.expired.Add(1)
+		c.misses.Add(1)
+		return false, false
+	}
+	c.hits.Add(1)
+	return e.Cached, true
 }
 
-func (c *Cache) GetMultiple(values []string) map[string]bool {
+// Has reports whether value has a fresh entry, without counting towards the stats
+func (c *Cache) Has(value string) bool {
 	c.mu.RLock()
-	defer c.mu.RUnlock()
+	e, exists := c.data[value]
+	c.mu.RUnlock()
+	return exists && c.isFresh(e, time.Now())
+}
 
+// GetMultiple returns the known availability of values and the values that need to be checked
+func (c *Cache) GetMultiple(values []string) (map[string]bool, []string) {
 	result := make(map[string]bool, len(values))
+	missing := make([]string, 0)
 	for _, value := range values {
-		if _, exists := c.data[value]; exists {
-			result[value] = true
+		cached, ok := c.Get(value)
+		if !ok {
+			missing = append(missing, value)
+			continue
 		}
+		result[value] = cached
 	}
-	return result
+	return result, missing
 }
 
 func (c *Cache) Exists(value string) bool {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	_, exists := c.data[value]
-	return exists
+	cached, ok := c.Get(value)
+	return ok && cached
 }
 
 func (c *Cache) Len() int {
@@ -88,3 +182,116 @@ func (c *Cache) Len() int {
 	defer c.mu.RUnlock()
 	return len(c.order)
 }
+
+func (c *Cache) Stats() Stats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	s := Stats{
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Expired: c.expired.Load(),
+	}
+	for _, e := range c.data {
+		if e.Cached {
+			s.Positives++
+		} else {
+			s.Negatives++
+		}
+	}
+	return s
+}
+
+func (c *Cache) load() {
+	if c.store == nil {
+		return
+	}
+	_logger := logger.GetDefaultLogger()
+	type loaded struct {
+		value string
+		entry Entry
+	}
+	entries := make([]loaded, 0)
+	expired := make([]string, 0)
+	now := time.Now()
+	err := c.store.ForEach(c.bucket, func(value string, data []byte) error {
+		var e Entry
+		if err := json.Unmarshal(data, &e); err != nil || !c.isFresh(e, now) {
+			expired = append(expired, value)
+			return nil
+		}
+		entries = append(entries, loaded{value: value, entry: e})
+		return nil
+	})
+	if err != nil {
+		_logger.Error().Err(err).Msgf("Error loading %s", c.bucket)
+		return
+	}
+	if len(expired) > 0 {
+		if err := c.store.Delete(c.bucket, expired...); err != nil {
+			_logger.Error().Err(err).Msgf("Error removing the expired entries of %s", c.bucket)
+		}
+	}
+	// Oldest first, so they are the ones evicted if the cache is full
+	slices.SortFunc(entries, func(a, b loaded) int {
+		return a.entry.CheckedAt.Compare(b.entry.CheckedAt)
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, l := range entries {
+		c.set(l.value, l.entry)
+	}
+	// Loaded entries are saved already, only the evicted ones need removing
+	for value := range c.dirty {
+		if _, ok := c.data[value]; ok {
+			delete(c.dirty, value)
+		}
+	}
+}
+
+// Save writes the entries added and removes the ones evicted since the last save.
+// Changes are saved in batches, Save is called on shutdown to write the pending ones
+func (c *Cache) Save() {
+	if c.store == nil {
+		return
+	}
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+
+	c.mu.Lock()
+	if c.saveTimer != nil {
+		c.saveTimer.Stop()
+		c.saveTimer = nil
+	}
+	dirty := c.dirty
+	c.dirty = make(map[string]struct{})
+	entries := make(map[string]Entry, len(dirty))
+	for value := range dirty {
+		if e, ok := c.data[value]; ok {
+			entries[value] = e
+		}
+	}
+	c.mu.Unlock()
+	if len(dirty) == 0 {
+		return
+	}
+
+	err := c.store.Update(func(tx store.Tx) error {
+		for value := range dirty {
+			e, ok := entries[value]
+			if !ok {
+				if err := tx.Delete(c.bucket, value); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := tx.Put(c.bucket, value, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_logger := logger.GetDefaultLogger()
+		_logger.Error().Err(err).Msgf("Error saving %s", c.bucket)
+	}
+}
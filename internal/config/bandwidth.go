@@ -0,0 +1,95 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// SpeedSchedule limits the local downloads during a time of the day, e.g to throttle them in the evening
+type SpeedSchedule struct {
+	Days          []string `json:"days"`           // mon, tue... Every day if empty
+	From          string   `json:"from"`           // HH:MM
+	To            string   `json:"to"`             // HH:MM, a schedule ending before it starts runs past midnight
+	DownloadLimit string   `json:"download_limit"` // Per second, e.g 5MB. 0 is unlimited
+}
+
+// Active reports whether the schedule applies at t. The hours past midnight belong to the day the schedule started
+func (s SpeedSchedule) Active(t time.Time) bool {
+	from, _ := parseClock(s.From)
+	to, _ := parseClock(s.To)
+	now := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	switch {
+	case from < to:
+		if now < from || now >= to {
+			return false
+		}
+	case from > to:
+		if now >= to && now < from {
+			return false
+		}
+		if now < to {
+			day = (day + 6) % 7
+		}
+	}
+	return len(s.Days) == 0 || slices.ContainsFunc(s.Days, func(d string) bool {
+		return strings.ToLower(d) == weekdays[day]
+	})
+}
+
+func (s SpeedSchedule) GetDownloadLimit() int64 {
+	limit, _ := ParseSpeedLimit(s.DownloadLimit)
+	return limit
+}
+
+// ParseSpeedLimit returns a speed limit like 10MB in bytes/s. Empty is 0, unlimited
+func ParseSpeedLimit(limit string) (int64, error) {
+	if limit == "" {
+		return 0, nil
+	}
+	size, err := parseSize(limit)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid speed limit: %s", limit)
+	}
+	return size, nil
+}
+
+// parseClock returns the minutes since midnight of a HH:MM time
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func validateSpeedLimit(name, limit string) error {
+	if _, err := ParseSpeedLimit(limit); err != nil {
+		return fmt.Errorf("invalid %s: %s", name, limit)
+	}
+	return nil
+}
+
+func validateSpeedSchedules(schedules []SpeedSchedule) error {
+	for i, s := range schedules {
+		if _, err := parseClock(s.From); err != nil {
+			return fmt.Errorf("invalid start of speed schedule %d: %q", i+1, s.From)
+		}
+		if _, err := parseClock(s.To); err != nil {
+			return fmt.Errorf("invalid end of speed schedule %d: %q", i+1, s.To)
+		}
+		for _, d := range s.Days {
+			if !slices.Contains(weekdays, strings.ToLower(d)) {
+				return fmt.Errorf("invalid day in speed schedule %d: %s", i+1, d)
+			}
+		}
+		if err := validateSpeedLimit(fmt.Sprintf("download limit of speed schedule %d", i+1), s.DownloadLimit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
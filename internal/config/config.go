@@ -1,28 +1,68 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 )
 
 var (
 	instance   *Config
 	once       sync.Once
 	configPath string
+
+	streamKey   []byte
+	streamKeyMu sync.Mutex
 )
 
 type Debrid struct {
-	Name             string `json:"name"`
-	Host             string `json:"host"`
-	APIKey           string `json:"api_key"`
-	Folder           string `json:"folder"`
-	DownloadUncached bool   `json:"download_uncached"`
-	CheckCached      bool   `json:"check_cached"`
-	RateLimit        string `json:"rate_limit"` // 200/minute or 10/second
+	Name             string   `json:"name"`
+	Host             string   `json:"host"`
+	APIKey           string   `json:"api_key"`
+	APIKeys          []string `json:"api_keys"` // Extra keys, rotated when one hits a rate limit or bandwidth cap
+	Folder           string   `json:"folder"`
+	DownloadUncached bool     `json:"download_uncached"`
+	CheckCached      bool     `json:"check_cached"`
+	RateLimit        string   `json:"rate_limit"` // 200/minute or 10/second
+	Retry            Retry    `json:"retry"`
+}
+
+type Retry struct {
+	MaxAttempts        int    `json:"max_attempts"`         // Attempts including the first one, 1 disables retries
+	BaseDelay          string `json:"base_delay"`           // Backoff before the first retry, doubled on every attempt, e.g 500ms
+	MaxDelay           string `json:"max_delay"`            // Cap on the backoff and on Retry-After, e.g 30s
+	RetryNonIdempotent bool   `json:"retry_non_idempotent"` // Also retry POSTs and PUTs on 5xx, this may add a torrent twice
+}
+
+// GetAPIKeys returns api_key followed by api_keys, without blanks and duplicates
+func (d Debrid) GetAPIKeys() []string {
+	keys := make([]string, 0, len(d.APIKeys)+1)
+	for _, k := range append([]string{d.APIKey}, d.APIKeys...) {
+		if k != "" && !slices.Contains(keys, k) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+type DebridPolicy struct {
+	Policy           string   `json:"policy"`            // priority, round-robin, least-active, latency
+	FailureThreshold int      `json:"failure_threshold"` // Consecutive failures before a debrid is skipped
+	Cooldown         string   `json:"cooldown"`          // How long a failing debrid is skipped, e.g 5m
+	CachedPreference []string `json:"cached_preference"` // Preferred debrids when a torrent is cached on several
+}
+
+type AvailabilityCache struct {
+	PositiveTTL string `json:"positive_ttl"` // How long a cached result is trusted, e.g 24h
+	NegativeTTL string `json:"negative_ttl"` // How long an uncached result is trusted, e.g 1h
 }
 
 type Proxy struct {
@@ -35,13 +75,146 @@ type Proxy struct {
 }
 
 type QBitTorrent struct {
-	Username        string   `json:"username"`
-	Password        string   `json:"password"`
-	Port            string   `json:"port"`
-	DownloadFolder  string   `json:"download_folder"`
-	Categories      []string `json:"categories"`
-	RefreshInterval int      `json:"refresh_interval"`
-	SkipPreCache    bool     `json:"skip_pre_cache"`
+	Username        string     `json:"username"`
+	Password        string     `json:"password"`
+	Port            string     `json:"port"`
+	DownloadFolder  string     `json:"download_folder"`
+	Categories      []Category `json:"categories"`
+	RefreshInterval int        `json:"refresh_interval"`
+	SkipPreCache    bool       `json:"skip_pre_cache"`
+	SessionTimeout  string     `json:"session_timeout"` // How long a login session lasts without being used
+	// ArrCredentials also accepts an arr host and token as the username and password, for arrs in the config
+	ArrCredentials *bool `json:"arr_credentials"`
+	// MaxJobs is how many torrents are submitted to the debrids or linked at the same time
+	MaxJobs int `json:"max_jobs"`
+	// Local downloads
+	MaxDownloads        int `json:"max_downloads"`        // Files downloaded at the same time per torrent
+	DownloadConnections int `json:"download_connections"` // Connections per file, for files large enough to split
+	DownloadRetries     int `json:"download_retries"`     // Attempts per file
+	// Speed limits of the local downloads per second, e.g 10MB. Empty is unlimited
+	DownloadLimit    string          `json:"download_limit"`
+	AltDownloadLimit string          `json:"alt_download_limit"` // Used while the alternative speed limits are on
+	SpeedSchedules   []SpeedSchedule `json:"speed_schedules"`    // Replace download_limit while they are active
+	// StrmURL is the URL media servers reach decypharr at, written in the .strm files. Defaults to http://localhost:port
+	StrmURL string `json:"strm_url"`
+}
+
+const (
+	CategoryActionSymlink  = "symlink"
+	CategoryActionDownload = "download"
+	CategoryActionStrm     = "strm"     // .strm files pointing at the stream URL of decypharr
+	CategoryActionHardlink = "hardlink" // Hardlinks into the mount, copies if the mount doesn't support them
+	CategoryActionReflink  = "reflink"  // Reflinks into the mount, copies if the mount doesn't support them
+	CategoryActionCopy     = "copy"     // Copies from the mount
+)
+
+var CategoryActions = []string{
+	CategoryActionSymlink,
+	CategoryActionDownload,
+	CategoryActionStrm,
+	CategoryActionHardlink,
+	CategoryActionReflink,
+	CategoryActionCopy,
+}
+
+// Category is a qBittorrent category. In the config it can also be just its name
+type Category struct {
+	Name     string `json:"name"`
+	SavePath string `json:"save_path"` // Defaults to the category folder in the download folder
+	Action   string `json:"action"`    // One of CategoryActions, symlink by default. Arrs can still ask for a download with sequential download
+	Debrid   string `json:"debrid"`    // Debrid tried first for the category's torrents
+	// DownloadUncached overrides the arr and debrid download_uncached setting
+	DownloadUncached *bool `json:"download_uncached"`
+	// DownloadLimit is the speed limit of the category's local downloads, on top of the global one
+	DownloadLimit string `json:"download_limit"`
+}
+
+func (c *Category) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*c = Category{Name: name}
+		return nil
+	}
+	type category Category
+	return json.Unmarshal(data, (*category)(c))
+}
+
+func validateCategories(categories []Category, debrids []Debrid) error {
+	for _, c := range categories {
+		if c.Name == "" {
+			return errors.New("category name is required")
+		}
+		if c.Action != "" && !slices.Contains(CategoryActions, c.Action) {
+			return fmt.Errorf("invalid action for category %s: %s", c.Name, c.Action)
+		}
+		if c.Debrid != "" && !slices.ContainsFunc(debrids, func(d Debrid) bool { return d.Name == c.Debrid }) {
+			return fmt.Errorf("unknown debrid for category %s: %s", c.Name, c.Debrid)
+		}
+		if err := validateSpeedLimit("download limit for category "+c.Name, c.DownloadLimit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AuthEnabled reports whether the qBittorrent API requires a login
+func (q QBitTorrent) AuthEnabled() bool {
+	return q.Username != "" && q.Password != ""
+}
+
+func (q QBitTorrent) GetArrCredentials() bool {
+	return q.ArrCredentials == nil || *q.ArrCredentials
+}
+
+func (q QBitTorrent) GetMaxJobs() int {
+	if q.MaxJobs <= 0 {
+		return 5
+	}
+	return q.MaxJobs
+}
+
+func (q QBitTorrent) GetMaxDownloads() int {
+	if q.MaxDownloads <= 0 {
+		return 5
+	}
+	return q.MaxDownloads
+}
+
+func (q QBitTorrent) GetDownloadConnections() int {
+	if q.DownloadConnections <= 0 {
+		return 4
+	}
+	return q.DownloadConnections
+}
+
+func (q QBitTorrent) GetDownloadRetries() int {
+	if q.DownloadRetries <= 0 {
+		return 3
+	}
+	return q.DownloadRetries
+}
+
+func (q QBitTorrent) GetDownloadLimit() int64 {
+	limit, _ := ParseSpeedLimit(q.DownloadLimit)
+	return limit
+}
+
+func (q QBitTorrent) GetAltDownloadLimit() int64 {
+	limit, _ := ParseSpeedLimit(q.AltDownloadLimit)
+	return limit
+}
+
+func (c Category) GetDownloadLimit() int64 {
+	limit, _ := ParseSpeedLimit(c.DownloadLimit)
+	return limit
+}
+
+func (q QBitTorrent) GetSessionTimeout() time.Duration {
+	timeout, err := time.ParseDuration(q.SessionTimeout)
+	if err != nil || timeout <= 0 {
+		return time.Hour
+	}
+	return timeout
 }
 
 type Arr struct {
@@ -51,6 +224,7 @@ type Arr struct {
 	Cleanup          bool   `json:"cleanup"`
 	SkipRepair       bool   `json:"skip_repair"`
 	DownloadUncached *bool  `json:"download_uncached"`
+	SelectionProfile string `json:"selection_profile"` // Name of the file selection profile for this arr
 }
 
 type Repair struct {
@@ -67,21 +241,25 @@ type Auth struct {
 }
 
 type Config struct {
-	LogLevel       string      `json:"log_level"`
-	Debrid         Debrid      `json:"debrid"`
-	Debrids        []Debrid    `json:"debrids"`
-	Proxy          Proxy       `json:"proxy"`
-	MaxCacheSize   int         `json:"max_cache_size"`
-	QBitTorrent    QBitTorrent `json:"qbittorrent"`
-	Arrs           []Arr       `json:"arrs"`
-	Repair         Repair      `json:"repair"`
-	AllowedExt     []string    `json:"allowed_file_types"`
-	MinFileSize    string      `json:"min_file_size"` // Minimum file size to download, 10MB, 1GB, etc
-	MaxFileSize    string      `json:"max_file_size"` // Maximum file size to download (0 means no limit)
-	Path           string      `json:"-"`             // Path to save the config file
-	UseAuth        bool        `json:"use_auth"`
-	Auth           *Auth       `json:"-"`
-	DiscordWebhook string      `json:"discord_webhook_url"`
+	LogLevel          string                      `json:"log_level"`
+	Debrid            Debrid                      `json:"debrid"`
+	Debrids           []Debrid                    `json:"debrids"`
+	DebridPolicy      DebridPolicy                `json:"debrid_policy"`
+	Proxy             Proxy                       `json:"proxy"`
+	MaxCacheSize      int                         `json:"max_cache_size"`
+	CacheTTL          AvailabilityCache           `json:"availability_cache"`
+	QBitTorrent       QBitTorrent                 `json:"qbittorrent"`
+	Arrs              []Arr                       `json:"arrs"`
+	Repair            Repair                      `json:"repair"`
+	AllowedExt        []string                    `json:"allowed_file_types"`
+	MinFileSize       string                      `json:"min_file_size"` // Minimum file size to download, 10MB, 1GB, etc
+	MaxFileSize       string                      `json:"max_file_size"` // Maximum file size to download (0 means no limit)
+	SelectionProfiles map[string]SelectionProfile `json:"selection_profiles"`
+	Path              string                      `json:"-"` // Path to save the config file
+	UseAuth           bool                        `json:"use_auth"`
+	Auth              *Auth                       `json:"-"`
+	PremiumAlert      int                         `json:"premium_alert_days"` // Days before premium expiry to send a discord alert
+	DiscordWebhook    string                      `json:"discord_webhook_url"`
 }
 
 func (c *Config) JsonFile() string {
@@ -91,6 +269,16 @@ func (c *Config) AuthFile() string {
 	return filepath.Join(c.Path, "auth.json")
 }
 
+// StreamKeyFile holds the key the stream URLs are signed with
+func (c *Config) StreamKeyFile() string {
+	return filepath.Join(c.Path, "stream.key")
+}
+
+// DBFile is the database of the torrents, jobs and categories
+func (c *Config) DBFile() string {
+	return filepath.Join(c.Path, "decypharr.db")
+}
+
 func (c *Config) loadConfig() error {
 	// Load the config file
 	if configPath == "" {
@@ -135,15 +323,26 @@ func validateDebrids(debrids []Debrid) error {
 
 	for _, debrid := range debrids {
 		// Basic field validation
+		if !IsDebridProvider(debrid.Name) {
+			return fmt.Errorf("unknown debrid provider: %q. Available providers: %v", debrid.Name, DebridProviders())
+		}
 		if debrid.Host == "" {
 			return errors.New("debrid host is required")
 		}
-		if debrid.APIKey == "" {
+		if len(debrid.GetAPIKeys()) == 0 {
 			return errors.New("debrid api key is required")
 		}
 		if debrid.Folder == "" {
 			return errors.New("debrid folder is required")
 		}
+		for _, d := range []string{debrid.Retry.BaseDelay, debrid.Retry.MaxDelay} {
+			if d == "" {
+				continue
+			}
+			if _, err := time.ParseDuration(d); err != nil {
+				return fmt.Errorf("invalid retry delay for %s: %q", debrid.Name, d)
+			}
+		}
 
 		// Check folder existence concurrently
 		//wg.Add(1)
@@ -176,12 +375,23 @@ func validateQbitTorrent(config *QBitTorrent) error {
 	if _, err := os.Stat(config.DownloadFolder); os.IsNotExist(err) {
 		return errors.New("qbittorent download folder does not exist")
 	}
-	return nil
+	if config.SessionTimeout != "" {
+		if _, err := time.ParseDuration(config.SessionTimeout); err != nil {
+			return fmt.Errorf("invalid qbittorrent session timeout: %s", config.SessionTimeout)
+		}
+	}
+	if err := validateSpeedLimit("qbittorrent download limit", config.DownloadLimit); err != nil {
+		return err
+	}
+	if err := validateSpeedLimit("qbittorrent alt download limit", config.AltDownloadLimit); err != nil {
+		return err
+	}
+	return validateSpeedSchedules(config.SpeedSchedules)
 }
 
 func validateConfig(config *Config) error {
 	// Run validations concurrently
-	errChan := make(chan error, 2)
+	errChan := make(chan error, 4)
 
 	go func() {
 		errChan <- validateDebrids(config.Debrids)
@@ -191,8 +401,16 @@ func validateConfig(config *Config) error {
 		errChan <- validateQbitTorrent(&config.QBitTorrent)
 	}()
 
+	go func() {
+		errChan <- validateSelectionProfiles(config.SelectionProfiles, config.Arrs)
+	}()
+
+	go func() {
+		errChan <- validateCategories(config.QBitTorrent.Categories, config.Debrids)
+	}()
+
 	// Check for errors
-	for i := 0; i < 2; i++ {
+	for i := 0; i < 4; i++ {
 		if err := <-errChan; err != nil {
 			return err
 		}
@@ -241,6 +459,13 @@ func (c *Config) GetMaxFileSize() int64 {
 	return s
 }
 
+// GetCacheTTLs returns the positive and negative availability cache TTLs. 0 means the default
+func (c *Config) GetCacheTTLs() (time.Duration, time.Duration) {
+	positive, _ := time.ParseDuration(c.CacheTTL.PositiveTTL)
+	negative, _ := time.ParseDuration(c.CacheTTL.NegativeTTL)
+	return positive, negative
+}
+
 func (c *Config) IsSizeAllowed(size int64) bool {
 	if size == 0 {
 		return true // Maybe the debrid hasn't reported the size yet
@@ -279,6 +504,37 @@ func (c *Config) SaveAuth(auth *Auth) error {
 	return os.WriteFile(c.AuthFile(), data, 0644)
 }
 
+// GetStreamKey returns the key the stream URLs are signed with. It is created on first use and kept,
+// so the URLs written to .strm files stay valid across restarts
+func (c *Config) GetStreamKey() ([]byte, error) {
+	streamKeyMu.Lock()
+	defer streamKeyMu.Unlock()
+	if streamKey != nil {
+		return streamKey, nil
+	}
+	data, err := os.ReadFile(c.StreamKeyFile())
+	if err == nil {
+		key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) == 0 {
+			return nil, fmt.Errorf("invalid stream key in %s", c.StreamKeyFile())
+		}
+		streamKey = key
+		return streamKey, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(c.StreamKeyFile(), []byte(hex.EncodeToString(key)), 0600); err != nil {
+		return nil, err
+	}
+	streamKey = key
+	return streamKey, nil
+}
+
 func (c *Config) NeedsSetup() bool {
 	if c.UseAuth {
 		return c.GetAuth().Username == ""
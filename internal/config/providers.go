@@ -0,0 +1,38 @@
+package config
+
+import (
+	"sort"
+	"sync"
+)
+
+var (
+	providersMu sync.RWMutex
+	providers   = make(map[string]struct{})
+)
+
+// RegisterDebridProvider marks a debrid name as valid for the debrids config.
+// It is called by the debrid engine registry
+func RegisterDebridProvider(name string) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[name] = struct{}{}
+}
+
+func IsDebridProvider(name string) bool {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	_, ok := providers[name]
+	return ok
+}
+
+// DebridProviders returns the sorted names of all known debrid providers
+func DebridProviders() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const DefaultSelectionProfile = "default"
+
+// SelectionProfile decides which files of a torrent are downloaded
+type SelectionProfile struct {
+	Include        []string `json:"include"`         // Regexes matched against the file path, a file must match one of them
+	Exclude        []string `json:"exclude"`         // Regexes matched against the file path, matching files are skipped
+	ExcludeSamples *bool    `json:"exclude_samples"` // Skip samples, trailers and thumbs. Enabled by default
+	ExcludeExtras  bool     `json:"exclude_extras"`  // Skip featurettes, deleted scenes, interviews etc.
+	Languages      []string `json:"languages"`       // Keep files tagged with one of these languages, files without a language tag are kept
+	LargestOnly    bool     `json:"largest_only"`    // Keep only the largest file, e.g for movie packs
+	// WantedEpisodesOnly keeps only the episodes of a season pack the arr is missing. Sonarr only
+	WantedEpisodesOnly bool     `json:"wanted_episodes_only"`
+	AllowedExt         []string `json:"allowed_file_types"`
+	MinFileSize        string   `json:"min_file_size"`
+	MaxFileSize        string   `json:"max_file_size"`
+}
+
+// GetSelectionProfile returns the profile for an arr or category.
+// The arr's selection_profile is used first, then a profile named after the category, then the default profile.
+// Fields the profile doesn't set fall back to the global file settings
+func (c *Config) GetSelectionProfile(name string) SelectionProfile {
+	profileName := name
+	for _, a := range c.Arrs {
+		if a.Name == name && a.SelectionProfile != "" {
+			profileName = a.SelectionProfile
+			break
+		}
+	}
+	profile, ok := c.SelectionProfiles[profileName]
+	if !ok {
+		profile = c.SelectionProfiles[DefaultSelectionProfile]
+	}
+	if len(profile.AllowedExt) == 0 {
+		profile.AllowedExt = c.AllowedExt
+	}
+	if profile.MinFileSize == "" {
+		profile.MinFileSize = c.MinFileSize
+	}
+	if profile.MaxFileSize == "" {
+		profile.MaxFileSize = c.MaxFileSize
+	}
+	return profile
+}
+
+func (p SelectionProfile) GetExcludeSamples() bool {
+	return p.ExcludeSamples == nil || *p.ExcludeSamples
+}
+
+func (p SelectionProfile) GetMinFileSize() int64 {
+	s, _ := parseSize(p.MinFileSize)
+	return s
+}
+
+func (p SelectionProfile) GetMaxFileSize() int64 {
+	s, _ := parseSize(p.MaxFileSize)
+	return s
+}
+
+func validateSelectionProfiles(profiles map[string]SelectionProfile, arrs []Arr) error {
+	for name, p := range profiles {
+		for _, expr := range append(p.Include, p.Exclude...) {
+			if _, err := regexp.Compile(expr); err != nil {
+				return fmt.Errorf("invalid regex in selection profile %s: %v", name, err)
+			}
+		}
+		for _, size := range []string{p.MinFileSize, p.MaxFileSize} {
+			if size == "" {
+				continue
+			}
+			if _, err := parseSize(size); err != nil {
+				return fmt.Errorf("invalid file size in selection profile %s: %q", name, size)
+			}
+		}
+	}
+	for _, a := range arrs {
+		if a.SelectionProfile == "" {
+			continue
+		}
+		if _, ok := profiles[a.SelectionProfile]; !ok {
+			return fmt.Errorf("unknown selection profile %q for %s", a.SelectionProfile, a.Name)
+		}
+	}
+	return nil
+}
@@ -45,6 +45,10 @@ func getDiscordHeader(event string) string {
 		return "[Decypharr] Repair Completed, Awaiting action"
 	case "repair_complete":
 		return "[Decypharr] Repair Complete"
+	case "premium_expiring":
+		return "[Decypharr] Premium Expiring"
+	case "premium_expired":
+		return "[Decypharr] Premium Expired"
 	default:
 		// split the event string and capitalize the first letter of each word
 		evs := strings.Split(event, "_")
@@ -3,7 +3,6 @@ package request
 import (
 	"crypto/tls"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"golang.org/x/time/rate"
 	"io"
@@ -35,10 +34,22 @@ func JoinURL(base string, paths ...string) (string, error) {
 	return joined, nil
 }
 
+// HTTPError is returned by MakeRequest for non 2xx responses
+type HTTPError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	// Add status code error to the body
+	return fmt.Sprintf("%s\nstatus code: %d", e.Body, e.StatusCode)
+}
+
 type RLHTTPClient struct {
 	client      *http.Client
 	Ratelimiter *rate.Limiter
 	Headers     map[string]string
+	Retry       *RetryPolicy
 }
 
 func (c *RLHTTPClient) Doer(req *http.Request) (*http.Response, error) {
@@ -55,32 +66,38 @@ func (c *RLHTTPClient) Doer(req *http.Request) (*http.Response, error) {
 	return resp, nil
 }
 
+// Do sends the request, retrying transient failures according to the retry policy
 func (c *RLHTTPClient) Do(req *http.Request) (*http.Response, error) {
-	var resp *http.Response
-	var err error
-	backoff := time.Millisecond * 500
+	policy := c.Retry
+	if policy == nil {
+		policy = DefaultRetryPolicy()
+	}
 
-	for i := 0; i < 3; i++ {
-		resp, err = c.Doer(req)
-		if err != nil {
-			return nil, err
+	for attempt := 1; ; attempt++ {
+		resp, err := c.Doer(req)
+		retry := attempt < policy.MaxAttempts && policy.shouldRetry(req, resp, err)
+		var wait time.Duration
+		if retry {
+			wait, retry = policy.delay(attempt, resp)
 		}
-
-		if resp.StatusCode != http.StatusTooManyRequests {
-			return resp, nil
+		if !retry || !rewind(req) {
+			if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+				resp.Body.Close()
+				return nil, &HTTPError{StatusCode: http.StatusTooManyRequests, Body: "max retries exceeded"}
+			}
+			return resp, err
+		}
+		if resp != nil {
+			// Close the response body to prevent resource leakage
+			resp.Body.Close()
 		}
 
-		// Close the response body to prevent resource leakage
-		resp.Body.Close()
-
-		// Wait for the backoff duration before retrying
-		time.Sleep(backoff)
-
-		// Exponential backoff
-		backoff *= 2
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
 	}
-
-	return resp, fmt.Errorf("max retries exceeded")
 }
 
 func (c *RLHTTPClient) MakeRequest(req *http.Request) ([]byte, error) {
@@ -108,9 +125,7 @@ func (c *RLHTTPClient) MakeRequest(req *http.Request) ([]byte, error) {
 	}
 	statusOk := res.StatusCode >= 200 && res.StatusCode < 300
 	if !statusOk {
-		// Add status code error to the body
-		b = append(b, []byte(fmt.Sprintf("\nstatus code: %d", res.StatusCode))...)
-		return nil, errors.New(string(b))
+		return nil, &HTTPError{StatusCode: res.StatusCode, Body: string(b)}
 	}
 
 	return b, nil
@@ -124,6 +139,7 @@ func NewRLHTTPClient(rl *rate.Limiter, headers map[string]string) *RLHTTPClient
 		client: &http.Client{
 			Transport: tr,
 		},
+		Retry: DefaultRetryPolicy(),
 	}
 	if rl != nil {
 		c.Ratelimiter = rl
@@ -0,0 +1,166 @@
+package request
+
+import (
+	"context"
+	"errors"
+	"github.com/sirrobot01/debrid-blackhole/internal/config"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultMaxAttempts = 3
+	defaultBaseDelay   = 500 * time.Millisecond
+	defaultMaxDelay    = 30 * time.Second
+	defaultJitter      = 0.2
+)
+
+// RetryPolicy decides if and when a failed request is sent again
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt, 1 disables retries
+	MaxAttempts int
+	// BaseDelay is the backoff before the first retry, doubled on every attempt up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Jitter randomises the backoff by up to this fraction
+	Jitter float64
+	// RetryStatuses are the response codes worth retrying
+	RetryStatuses []int
+	// RetryNonIdempotent allows retrying requests like POST after the debrid may have processed them.
+	// They are always retried on 429 since the request was rejected
+	RetryNonIdempotent bool
+}
+
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: defaultMaxAttempts,
+		BaseDelay:   defaultBaseDelay,
+		MaxDelay:    defaultMaxDelay,
+		Jitter:      defaultJitter,
+		RetryStatuses: []int{
+			http.StatusTooManyRequests,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout,
+		},
+	}
+}
+
+// ParseRetryPolicy builds a policy from a debrid retry config, unset or invalid fields use the defaults
+func ParseRetryPolicy(rc config.Retry) *RetryPolicy {
+	p := DefaultRetryPolicy()
+	if rc.MaxAttempts > 0 {
+		p.MaxAttempts = rc.MaxAttempts
+	}
+	if d, err := time.ParseDuration(rc.BaseDelay); err == nil && d > 0 {
+		p.BaseDelay = d
+	}
+	if d, err := time.ParseDuration(rc.MaxDelay); err == nil && d > 0 {
+		p.MaxDelay = d
+	}
+	p.RetryNonIdempotent = rc.RetryNonIdempotent
+	return p
+}
+
+type retryContextKey struct{}
+
+type retryMode int
+
+const (
+	retryIdempotent retryMode = iota + 1
+	retryDisabled
+)
+
+// WithIdempotent marks the requests made with ctx as safe to send again after the debrid may have processed them
+func WithIdempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retryContextKey{}, retryIdempotent)
+}
+
+// WithoutRetry sends the requests made with ctx only once, e.g requests that add a torrent to the debrid
+func WithoutRetry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retryContextKey{}, retryDisabled)
+}
+
+func contextRetryMode(req *http.Request) retryMode {
+	mode, _ := req.Context().Value(retryContextKey{}).(retryMode)
+	return mode
+}
+
+// isIdempotent reports whether a request can be sent again safely. PUT and POST can create a torrent
+// every time they are sent, so callers opt in with an Idempotency-Key header or WithIdempotent
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != "" || contextRetryMode(req) == retryIdempotent
+}
+
+// shouldRetry reports whether the outcome of an attempt is worth retrying
+func (p *RetryPolicy) shouldRetry(req *http.Request, resp *http.Response, err error) bool {
+	if contextRetryMode(req) == retryDisabled {
+		return false
+	}
+	if err != nil {
+		if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+			return false
+		}
+		// The request may have reached the debrid
+		return isIdempotent(req) || p.RetryNonIdempotent
+	}
+	if !slices.Contains(p.RetryStatuses, resp.StatusCode) {
+		return false
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || isIdempotent(req) || p.RetryNonIdempotent
+}
+
+// delay returns the wait before the next attempt. attempt starts at 1.
+// Retry-After takes precedence, ok is false if it asks for longer than MaxDelay
+func (p *RetryPolicy) delay(attempt int, resp *http.Response) (time.Duration, bool) {
+	if resp != nil {
+		if d, found := parseRetryAfter(resp.Header.Get("Retry-After")); found {
+			return d, d <= p.MaxDelay
+		}
+	}
+	d := p.BaseDelay << (attempt - 1)
+	if d <= 0 || d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(d))
+	}
+	return d, true
+}
+
+// parseRetryAfter reads a Retry-After header in seconds or as an HTTP date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0), true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
+// rewind resets the request body for another attempt
+func rewind(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+	if req.GetBody == nil {
+		return false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return false
+	}
+	req.Body = body
+	return true
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"time"
+)
+
+// BoltStore is a Store backed by a bbolt file
+type BoltStore struct {
+	db *bbolt.DB
+}
+
+// Open opens the database file and brings its schema up to date.
+// legacyDir is the folder of the JSON files saved by older versions, they are imported once
+func Open(path, legacyDir string) (*BoltStore, error) {
+	db, err := bbolt.Open(path, 0644, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", path, err)
+	}
+	s := &BoltStore{db: db}
+	if err := s.migrate(legacyDir); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *BoltStore) Get(bucket, key string, v any) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return ErrNotFound
+		}
+		data := b.Get([]byte(key))
+		if data == nil {
+			return ErrNotFound
+		}
+		return json.Unmarshal(data, v)
+	})
+}
+
+func (s *BoltStore) Put(bucket, key string, v any) error {
+	return s.Update(func(tx Tx) error {
+		return tx.Put(bucket, key, v)
+	})
+}
+
+func (s *BoltStore) Delete(bucket string, keys ...string) error {
+	return s.Update(func(tx Tx) error {
+		return tx.Delete(bucket, keys...)
+	})
+}
+
+func (s *BoltStore) ForEach(bucket string, fn func(key string, data []byte) error) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
+
+func (s *BoltStore) Update(fn func(tx Tx) error) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+type boltTx struct {
+	tx *bbolt.Tx
+}
+
+func (t boltTx) Put(bucket, key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return t.putRaw(bucket, key, data)
+}
+
+func (t boltTx) putRaw(bucket, key string, data []byte) error {
+	b, err := t.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+func (t boltTx) Delete(bucket string, keys ...string) error {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	for _, key := range keys {
+		if err := b.Delete([]byte(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirrobot01/debrid-blackhole/internal/logger"
+	"go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	metaBucket = "meta"
+	versionKey = "schema_version"
+)
+
+// migration upgrades the schema to its version, it runs in the same transaction as the version bump.
+// committed runs once the transaction is committed
+type migration struct {
+	version   int
+	name      string
+	run       func(tx boltTx, legacyDir string) error
+	committed func(legacyDir string)
+}
+
+var migrations = []migration{
+	{version: 1, name: "import JSON files", run: importJSONFiles, committed: backupJSONFiles},
+	{version: 2, name: "import debrid caches", run: importDebridCaches, committed: backupDebridCaches},
+}
+
+// legacyFiles maps the JSON files of older versions to their bucket. They are all maps keyed like the bucket
+var legacyFiles = map[string]string{
+	"torrents.json":   TorrentsBucket,
+	"categories.json": CategoriesBucket,
+	"jobs.json":       JobsBucket,
+	"repair.json":     RepairBucket,
+}
+
+// SchemaVersion returns the version of the database schema
+func (s *BoltStore) SchemaVersion() (int, error) {
+	version := 0
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		version = schemaVersion(tx)
+		return nil
+	})
+	return version, err
+}
+
+func schemaVersion(tx *bbolt.Tx) int {
+	b := tx.Bucket([]byte(metaBucket))
+	if b == nil {
+		return 0
+	}
+	version, _ := strconv.Atoi(string(b.Get([]byte(versionKey))))
+	return version
+}
+
+// migrate runs the migrations newer than the schema version, each in its own transaction
+func (s *BoltStore) migrate(legacyDir string) error {
+	_log := logger.GetDefaultLogger()
+	for _, m := range migrations {
+		ran := false
+		err := s.db.Update(func(tx *bbolt.Tx) error {
+			current := schemaVersion(tx)
+			if current >= m.version {
+				return nil
+			}
+			ran = true
+			_log.Info().Msgf("Migrating database to version %d: %s", m.version, m.name)
+			if err := m.run(boltTx{tx}, legacyDir); err != nil {
+				return err
+			}
+			return boltTx{tx}.putRaw(metaBucket, versionKey, []byte(strconv.Itoa(m.version)))
+		})
+		if err != nil {
+			return fmt.Errorf("error migrating database to version %d: %w", m.version, err)
+		}
+		if ran && m.committed != nil {
+			m.committed(legacyDir)
+		}
+	}
+	return nil
+}
+
+// importJSONFiles copies the JSON files of older versions into their buckets
+func importJSONFiles(tx boltTx, legacyDir string) error {
+	_log := logger.GetDefaultLogger()
+	for name, bucket := range legacyFiles {
+		path := filepath.Join(legacyDir, name)
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		documents := make(map[string]json.RawMessage)
+		if err := json.Unmarshal(data, &documents); err != nil {
+			// A file corrupted by an interrupted write can't be recovered
+			_log.Warn().Err(err).Msgf("Skipping %s", path)
+			continue
+		}
+		for key, doc := range documents {
+			if err := tx.putRaw(bucket, key, doc); err != nil {
+				return err
+			}
+		}
+		_log.Info().Msgf("Imported %d entries from %s", len(documents), name)
+	}
+	return nil
+}
+
+// backupJSONFiles renames the imported JSON files to .bak so they aren't mistaken for the current data
+func backupJSONFiles(legacyDir string) {
+	_log := logger.GetDefaultLogger()
+	for name := range legacyFiles {
+		path := filepath.Join(legacyDir, name)
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		if err := os.Rename(path, path+".bak"); err != nil {
+			_log.Warn().Err(err).Msgf("Error renaming %s", path)
+		}
+	}
+}
+
+// debridCacheDirs returns the cache folders of older versions, one per debrid
+func debridCacheDirs(legacyDir string) map[string]string {
+	dirs := make(map[string]string)
+	entries, err := os.ReadDir(filepath.Join(legacyDir, "cache"))
+	if err != nil {
+		return dirs
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs[entry.Name()] = filepath.Join(legacyDir, "cache", entry.Name())
+		}
+	}
+	return dirs
+}
+
+// importDebridCaches copies the availability.json and the torrents/<id>.json files of each debrid into their buckets
+func importDebridCaches(tx boltTx, legacyDir string) error {
+	_log := logger.GetDefaultLogger()
+	for debrid, dir := range debridCacheDirs(legacyDir) {
+		path := filepath.Join(dir, "availability.json")
+		if data, err := os.ReadFile(path); err == nil {
+			entries := make(map[string]json.RawMessage)
+			if err := json.Unmarshal(data, &entries); err != nil {
+				_log.Warn().Err(err).Msgf("Skipping %s", path)
+			}
+			for key, entry := range entries {
+				if err := tx.putRaw(AvailabilityBucket(debrid), key, entry); err != nil {
+					return err
+				}
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		files, err := os.ReadDir(filepath.Join(dir, "torrents"))
+		if err != nil {
+			continue
+		}
+		imported := 0
+		for _, file := range files {
+			if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(dir, "torrents", file.Name()))
+			if err != nil {
+				return err
+			}
+			if !json.Valid(data) {
+				_log.Warn().Msgf("Skipping %s", file.Name())
+				continue
+			}
+			if err := tx.putRaw(DebridTorrentsBucket(debrid), strings.TrimSuffix(file.Name(), ".json"), data); err != nil {
+				return err
+			}
+			imported++
+		}
+		_log.Info().Msgf("Imported %d cached torrents of %s", imported, debrid)
+	}
+	return nil
+}
+
+// backupDebridCaches renames the imported cache files to .bak
+func backupDebridCaches(legacyDir string) {
+	_log := logger.GetDefaultLogger()
+	for _, dir := range debridCacheDirs(legacyDir) {
+		for _, name := range []string{"availability.json", "torrents"} {
+			path := filepath.Join(dir, name)
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+			if err := os.Rename(path, path+".bak"); err != nil {
+				_log.Warn().Err(err).Msgf("Error renaming %s", path)
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"github.com/sirrobot01/debrid-blackhole/internal/config"
+	"os"
+	"sync"
+)
+
+// Buckets of the documents saved by decypharr
+const (
+	TorrentsBucket   = "torrents"
+	CategoriesBucket = "categories"
+	JobsBucket       = "jobs"
+	RepairBucket     = "repair_jobs"
+)
+
+// AvailabilityBucket is the bucket of the availability checks of a debrid, by infohash
+func AvailabilityBucket(debrid string) string {
+	return "availability_" + debrid
+}
+
+// DebridTorrentsBucket is the bucket of the torrents cached for a debrid, by torrent id
+func DebridTorrentsBucket(debrid string) string {
+	return "debrid_torrents_" + debrid
+}
+
+var ErrNotFound = errors.New("not found")
+
+// Store persists JSON documents by key, grouped in buckets.
+// Every write is a transaction, so a crash never leaves a half written document
+type Store interface {
+	// Get decodes the document into v, ErrNotFound is returned if there is none
+	Get(bucket, key string, v any) error
+	Put(bucket, key string, v any) error
+	Delete(bucket string, keys ...string) error
+	// ForEach calls fn with every document of a bucket, in key order
+	ForEach(bucket string, fn func(key string, data []byte) error) error
+	// Update runs fn in a single transaction, nothing is written if it returns an error
+	Update(fn func(tx Tx) error) error
+	Close() error
+}
+
+// Tx is a write transaction
+type Tx interface {
+	Put(bucket, key string, v any) error
+	Delete(bucket string, keys ...string) error
+}
+
+var (
+	instance Store
+	once     sync.Once
+)
+
+// GetStore returns the store in the config folder, it is opened on first use
+func GetStore() Store {
+	once.Do(func() {
+		cfg := config.GetConfig()
+		s, err := Open(cfg.DBFile(), cfg.Path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "database Error: %v\n", err)
+			os.Exit(1)
+		}
+		instance = s
+	})
+	return instance
+}
@@ -4,26 +4,46 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base32"
 	"encoding/hex"
 	"fmt"
+	"github.com/anacrolix/torrent/bencode"
 	"github.com/anacrolix/torrent/metainfo"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type Magnet struct {
 	Name     string
-	InfoHash string
+	InfoHash string // v1 info hash, or the truncated v2 hash for v2 only torrents
 	Size     int64
 	Link     string
+
+	InfoHashV2 string // Full sha256 info hash of v2 and hybrid torrents
+	Trackers   []string
+	Files      []MagnetFile // Files listed in the metainfo, empty for magnet links
+	File       []byte       `json:"-"` // The raw .torrent, if the torrent was added from a file
+}
+
+type MagnetFile struct {
+	Path string
+	Size int64
+}
+
+// IsTorrentFile reports whether the raw .torrent is available to upload
+func (m *Magnet) IsTorrentFile() bool {
+	return len(m.File) > 0
 }
 
 func GetMagnetFromFile(file io.Reader, filePath string) (*Magnet, error) {
@@ -49,28 +69,117 @@ func GetMagnetFromUrl(url string) (*Magnet, error) {
 	return nil, fmt.Errorf("invalid url")
 }
 
+// GetMagnetFromBytes reads a .torrent, keeping the raw file, trackers and file list.
+// BitTorrent v2 and hybrid torrents get their v2 info hash
 func GetMagnetFromBytes(torrentData []byte) (*Magnet, error) {
-	// Create a scanner to read the file line by line
 	mi, err := metainfo.Load(bytes.NewReader(torrentData))
 	if err != nil {
 		return nil, err
 	}
-	hash := mi.HashInfoBytes()
-	infoHash := hash.HexString()
 	info, err := mi.UnmarshalInfo()
 	if err != nil {
 		return nil, err
 	}
-	log.Println("InfoHash: ", infoHash)
 	magnet := &Magnet{
-		InfoHash: infoHash,
-		Name:     info.Name,
-		Size:     info.Length,
-		Link:     mi.Magnet(&hash, &info).String(),
+		Name: info.BestName(),
+		File: torrentData,
 	}
+	for _, tier := range mi.UpvertedAnnounceList() {
+		for _, tr := range tier {
+			if !slices.Contains(magnet.Trackers, tr) {
+				magnet.Trackers = append(magnet.Trackers, tr)
+			}
+		}
+	}
+
+	isV2 := info.MetaVersion == 2
+	if isV2 {
+		sum := sha256.Sum256(mi.InfoBytes)
+		magnet.InfoHashV2 = hex.EncodeToString(sum[:])
+		magnet.Files, err = v2Files(mi.InfoBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(info.Pieces) > 0 {
+		// v1 or hybrid
+		magnet.InfoHash = mi.HashInfoBytes().HexString()
+		if !isV2 {
+			for _, f := range info.UpvertedFiles() {
+				magnet.Files = append(magnet.Files, MagnetFile{
+					Path: f.DisplayPath(&info),
+					Size: f.Length,
+				})
+			}
+		}
+	} else if isV2 {
+		magnet.InfoHash = magnet.InfoHashV2[:40]
+	} else {
+		return nil, fmt.Errorf("torrent has no pieces")
+	}
+	for _, f := range magnet.Files {
+		magnet.Size += f.Size
+	}
+	magnet.Link = magnet.buildLink(len(info.Pieces) > 0)
 	return magnet, nil
 }
 
+// buildLink creates the magnet link, with both hashes for hybrid torrents
+func (m *Magnet) buildLink(hasV1 bool) string {
+	xt := make([]string, 0, 2)
+	if hasV1 {
+		xt = append(xt, "xt=urn:btih:"+m.InfoHash)
+	}
+	if m.InfoHashV2 != "" {
+		// Multihash of a sha256: 0x12, 32 bytes
+		xt = append(xt, "xt=urn:btmh:1220"+m.InfoHashV2)
+	}
+	link := "magnet:?" + strings.Join(xt, "&")
+	if m.Name != "" {
+		link += "&dn=" + url.QueryEscape(m.Name)
+	}
+	if m.Size > 0 {
+		link += "&xl=" + strconv.FormatInt(m.Size, 10)
+	}
+	for _, tr := range m.Trackers {
+		link += "&tr=" + url.QueryEscape(tr)
+	}
+	return link
+}
+
+// v2Files walks the BEP 52 file tree of the info dictionary
+func v2Files(infoBytes []byte) ([]MagnetFile, error) {
+	var info struct {
+		FileTree map[string]interface{} `bencode:"file tree"`
+	}
+	if err := bencode.Unmarshal(infoBytes, &info); err != nil {
+		return nil, fmt.Errorf("error reading file tree: %v", err)
+	}
+	files := make([]MagnetFile, 0)
+	var walk func(tree map[string]interface{}, parent string)
+	walk = func(tree map[string]interface{}, parent string) {
+		for key, value := range tree {
+			node, ok := value.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if key == "" {
+				// A file, its path is the parent
+				length, _ := node["length"].(int64)
+				files = append(files, MagnetFile{Path: parent, Size: length})
+				continue
+			}
+			walk(node, path.Join(parent, key))
+		}
+	}
+	walk(info.FileTree, "")
+	// Paths are relative to the torrent folder, like the v1 ones. A single file torrent's file is named after it
+	slices.SortFunc(files, func(a, b MagnetFile) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return files, nil
+}
+
 func OpenMagnetFile(filePath string) string {
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -131,20 +240,28 @@ func GetMagnetInfo(magnetLink string) (*Magnet, error) {
 	}
 
 	query := magnetURI.Query()
-	xt := query.Get("xt")
-	dn := query.Get("dn")
-
-	// Extract BTIH
-	parts := strings.Split(xt, ":")
-	btih := ""
-	if len(parts) > 2 {
-		btih = parts[2]
-	}
 	magnet := &Magnet{
-		InfoHash: btih,
-		Name:     dn,
-		Size:     0,
+		Name:     query.Get("dn"),
 		Link:     magnetLink,
+		Trackers: query["tr"],
+	}
+	magnet.Size, _ = strconv.ParseInt(query.Get("xl"), 10, 64)
+
+	// Extract BTIH and the v2 multihash
+	for _, xt := range query["xt"] {
+		switch {
+		case strings.HasPrefix(xt, "urn:btih:"):
+			btih := strings.TrimPrefix(xt, "urn:btih:")
+			if hash, err := processInfoHash(btih); err == nil {
+				btih = hash
+			}
+			magnet.InfoHash = btih
+		case strings.HasPrefix(xt, "urn:btmh:1220"):
+			magnet.InfoHashV2 = strings.ToLower(strings.TrimPrefix(xt, "urn:btmh:1220"))
+		}
+	}
+	if magnet.InfoHash == "" && len(magnet.InfoHashV2) == 64 {
+		magnet.InfoHash = magnet.InfoHashV2[:40]
 	}
 	return magnet, nil
 }
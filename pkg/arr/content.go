@@ -9,8 +9,12 @@ import (
 )
 
 type episode struct {
-	Id            int `json:"id"`
-	EpisodeFileID int `json:"episodeFileId"`
+	Id            int  `json:"id"`
+	EpisodeFileID int  `json:"episodeFileId"`
+	SeasonNumber  int  `json:"seasonNumber"`
+	EpisodeNumber int  `json:"episodeNumber"`
+	HasFile       bool `json:"hasFile"`
+	Monitored     bool `json:"monitored"`
 }
 
 type sonarrSearch struct {
@@ -68,15 +72,10 @@ func (a *Arr) GetMedia(mediaId string) ([]Content, error) {
 			Title: d.Title,
 			Id:    d.Id,
 		}
-		resp, err = a.Request(http.MethodGet, fmt.Sprintf("api/v3/episode?seriesId=%d", d.Id), nil)
+		episodes, err := a.getEpisodes(d.Id)
 		if err != nil {
 			continue
 		}
-		defer resp.Body.Close()
-		var episodes []episode
-		if err = json.NewDecoder(resp.Body).Decode(&episodes); err != nil {
-			continue
-		}
 		episodeFileIDMap := make(map[int]int)
 		for _, e := range episodes {
 			episodeFileIDMap[e.EpisodeFileID] = e.Id
@@ -109,6 +108,22 @@ func (a *Arr) GetMedia(mediaId string) ([]Content, error) {
 	return contents, nil
 }
 
+func (a *Arr) getEpisodes(seriesId int) ([]episode, error) {
+	resp, err := a.Request(http.MethodGet, fmt.Sprintf("api/v3/episode?seriesId=%d", seriesId), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get episodes: %s", resp.Status)
+	}
+	var episodes []episode
+	if err = json.NewDecoder(resp.Body).Decode(&episodes); err != nil {
+		return nil, fmt.Errorf("failed to decode episodes: %v", err)
+	}
+	return episodes, nil
+}
+
 func GetMovies(a *Arr, tvId string) ([]Content, error) {
 	resp, err := a.Request(http.MethodGet, fmt.Sprintf("api/v3/movie?tmdbId=%s", tvId), nil)
 	if err != nil {
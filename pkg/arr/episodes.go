@@ -0,0 +1,76 @@
+package arr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	gourl "net/url"
+	"slices"
+)
+
+// Episode is a season and episode number
+type Episode struct {
+	SeasonNumber  int `json:"season"`
+	EpisodeNumber int `json:"episode"`
+}
+
+type parseResponse struct {
+	Series *struct {
+		Id int `json:"id"`
+	} `json:"series"`
+	ParsedEpisodeInfo *struct {
+		SeasonNumber   int   `json:"seasonNumber"`
+		EpisodeNumbers []int `json:"episodeNumbers"`
+		FullSeason     bool  `json:"fullSeason"`
+		IsMultiSeason  bool  `json:"isMultiSeason"`
+	} `json:"parsedEpisodeInfo"`
+}
+
+// GetWantedEpisodes returns the monitored episodes without a file covered by a season pack release.
+// It returns nil if the release isn't a season pack of a known series
+func (a *Arr) GetWantedEpisodes(title string) ([]Episode, error) {
+	if a.Type != Sonarr && a.Type != "" {
+		return nil, nil
+	}
+	resp, err := a.Request(http.MethodGet, "api/v3/parse?title="+gourl.QueryEscape(title), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to parse release: %s", resp.Status)
+	}
+	var data parseResponse
+	if err = json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("failed to decode release: %v", err)
+	}
+	if data.Series == nil || data.ParsedEpisodeInfo == nil {
+		return nil, nil
+	}
+	info := data.ParsedEpisodeInfo
+	if !info.FullSeason && !info.IsMultiSeason {
+		return nil, nil
+	}
+	episodes, err := a.getEpisodes(data.Series.Id)
+	if err != nil {
+		return nil, err
+	}
+	wanted := make([]Episode, 0)
+	for _, e := range episodes {
+		if !e.Monitored || e.HasFile || e.EpisodeNumber == 0 {
+			continue
+		}
+		if !info.IsMultiSeason && e.SeasonNumber != info.SeasonNumber {
+			continue
+		}
+		wanted = append(wanted, Episode{SeasonNumber: e.SeasonNumber, EpisodeNumber: e.EpisodeNumber})
+	}
+	return wanted, nil
+}
+
+// Wants reports whether any of the episodes is wanted
+func Wants(wanted []Episode, episodes []Episode) bool {
+	return slices.ContainsFunc(episodes, func(e Episode) bool {
+		return slices.Contains(wanted, e)
+	})
+}
@@ -1,6 +1,8 @@
 package alldebrid
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/rs/zerolog"
@@ -8,15 +10,17 @@ import (
 	"github.com/sirrobot01/debrid-blackhole/internal/config"
 	"github.com/sirrobot01/debrid-blackhole/internal/logger"
 	"github.com/sirrobot01/debrid-blackhole/internal/request"
-	"github.com/sirrobot01/debrid-blackhole/internal/utils"
+	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/engine"
 	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/torrent"
 	"slices"
 
+	"mime/multipart"
 	"net/http"
 	gourl "net/url"
 	"os"
 	"path/filepath"
 	"strconv"
+	"time"
 )
 
 type AllDebrid struct {
@@ -24,7 +28,7 @@ type AllDebrid struct {
 	Host             string `json:"host"`
 	APIKey           string
 	DownloadUncached bool
-	client           *request.RLHTTPClient
+	keys             *engine.KeyRing
 	cache            *cache.Cache
 	MountPath        string
 	logger           zerolog.Logger
@@ -39,33 +43,37 @@ func (ad *AllDebrid) GetLogger() zerolog.Logger {
 	return ad.logger
 }
 
-func (ad *AllDebrid) IsAvailable(infohashes []string) map[string]bool {
+func (ad *AllDebrid) IsAvailable(ctx context.Context, infohashes []string) (map[string]bool, error) {
 	// Check if the infohashes are available in the local cache
 	hashes, result := torrent.GetLocalCache(infohashes, ad.cache)
 
 	if len(hashes) == 0 {
-		// Either all the infohashes are locally cached or none are
-		ad.cache.AddMultiple(result)
-		return result
+		// All the infohashes are in the local cache
+		return result, nil
 	}
 
 	// Divide hashes into groups of 100
 	// AllDebrid does not support checking cached infohashes
-	return result
+	return result, nil
 }
 
-func (ad *AllDebrid) SubmitMagnet(torrent *torrent.Torrent) (*torrent.Torrent, error) {
+func (ad *AllDebrid) SubmitMagnet(ctx context.Context, torrent *torrent.Torrent) (*torrent.Torrent, error) {
+	if torrent.Magnet.IsTorrentFile() {
+		return ad.submitTorrentFile(ctx, torrent)
+	}
 	url := fmt.Sprintf("%s/magnet/upload", ad.Host)
 	query := gourl.Values{}
 	query.Add("magnets[]", torrent.Magnet.Link)
 	url += "?" + query.Encode()
-	req, _ := http.NewRequest(http.MethodGet, url, nil)
-	resp, err := ad.client.MakeRequest(req)
-	if err != nil {
-		return nil, err
-	}
 	var data UploadMagnetResponse
-	err = json.Unmarshal(resp, &data)
+	key, err := ad.keys.Submit(func(key *engine.Key) error {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		resp, err := key.MakeRequest(req)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(resp, &data)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -76,10 +84,48 @@ func (ad *AllDebrid) SubmitMagnet(torrent *torrent.Torrent) (*torrent.Torrent, e
 	magnet := magnets[0]
 	torrentId := strconv.Itoa(magnet.ID)
 	torrent.Id = torrentId
+	torrent.KeyId = key.Id
 
 	return torrent, nil
 }
 
+// submitTorrentFile uploads the .torrent instead of the magnet link
+func (ad *AllDebrid) submitTorrentFile(ctx context.Context, torrent *torrent.Torrent) (*torrent.Torrent, error) {
+	url := fmt.Sprintf("%s/magnet/upload/file", ad.Host)
+	payload := &bytes.Buffer{}
+	writer := multipart.NewWriter(payload)
+	part, err := writer.CreateFormFile("files[]", torrent.Name+".torrent")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = part.Write(torrent.Magnet.File); err != nil {
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	var data UploadMagnetResponse
+	key, err := ad.keys.Submit(func(key *engine.Key) error {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload.Bytes()))
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		resp, err := key.MakeRequest(req)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(resp, &data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	files := data.Data.Files
+	if len(files) == 0 {
+		return nil, fmt.Errorf("error adding torrent")
+	}
+	torrent.Id = strconv.Itoa(files[0].ID)
+	torrent.KeyId = key.Id
+	return torrent, nil
+}
+
 func getAlldebridStatus(statusCode int) string {
 	switch {
 	case statusCode == 4:
@@ -94,8 +140,6 @@ func getAlldebridStatus(statusCode int) string {
 func flattenFiles(files []MagnetFile, parentPath string, index *int) []torrent.File {
 	result := make([]torrent.File, 0)
 
-	cfg := config.GetConfig()
-
 	for _, f := range files {
 		currentPath := f.Name
 		if parentPath != "" {
@@ -108,19 +152,6 @@ func flattenFiles(files []MagnetFile, parentPath string, index *int) []torrent.F
 		} else {
 			// This is a file
 			fileName := filepath.Base(f.Name)
-
-			// Skip sample files
-			if utils.IsSampleFile(fileName) {
-				continue
-			}
-			if !cfg.IsAllowedFile(fileName) {
-				continue
-			}
-
-			if !cfg.IsSizeAllowed(f.Size) {
-				continue
-			}
-
 			*index++
 			file := torrent.File{
 				Id:   strconv.Itoa(*index),
@@ -135,10 +166,10 @@ func flattenFiles(files []MagnetFile, parentPath string, index *int) []torrent.F
 	return result
 }
 
-func (ad *AllDebrid) GetTorrent(t *torrent.Torrent) (*torrent.Torrent, error) {
+func (ad *AllDebrid) GetTorrent(ctx context.Context, t *torrent.Torrent) (*torrent.Torrent, error) {
 	url := fmt.Sprintf("%s/magnet/status?id=%s", ad.Host, t.Id)
-	req, _ := http.NewRequest(http.MethodGet, url, nil)
-	resp, err := ad.client.MakeRequest(req)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := ad.keys.Get(t.KeyId).MakeRequest(req)
 	if err != nil {
 		return t, err
 	}
@@ -166,15 +197,14 @@ func (ad *AllDebrid) GetTorrent(t *torrent.Torrent) (*torrent.Torrent, error) {
 		t.Speed = data.DownloadSpeed
 		t.Seeders = data.Seeders
 		index := -1
-		files := flattenFiles(data.Files, "", &index)
-		t.Files = files
+		t.SelectFiles(flattenFiles(data.Files, "", &index))
 	}
 	return t, nil
 }
 
-func (ad *AllDebrid) CheckStatus(torrent *torrent.Torrent, isSymlink bool) (*torrent.Torrent, error) {
+func (ad *AllDebrid) CheckStatus(ctx context.Context, torrent *torrent.Torrent, isSymlink bool) (*torrent.Torrent, error) {
 	for {
-		tb, err := ad.GetTorrent(torrent)
+		tb, err := ad.GetTorrent(ctx, torrent)
 
 		torrent = tb
 
@@ -185,7 +215,7 @@ func (ad *AllDebrid) CheckStatus(torrent *torrent.Torrent, isSymlink bool) (*tor
 		if status == "downloaded" {
 			ad.logger.Info().Msgf("Torrent: %s downloaded", torrent.Name)
 			if !isSymlink {
-				err = ad.GetDownloadLinks(torrent)
+				err = ad.GetDownloadLinks(ctx, torrent)
 				if err != nil {
 					return torrent, err
 				}
@@ -206,10 +236,10 @@ func (ad *AllDebrid) CheckStatus(torrent *torrent.Torrent, isSymlink bool) (*tor
 	return torrent, nil
 }
 
-func (ad *AllDebrid) DeleteTorrent(torrent *torrent.Torrent) {
+func (ad *AllDebrid) DeleteTorrent(ctx context.Context, torrent *torrent.Torrent) {
 	url := fmt.Sprintf("%s/magnet/delete?id=%s", ad.Host, torrent.Id)
-	req, _ := http.NewRequest(http.MethodGet, url, nil)
-	_, err := ad.client.MakeRequest(req)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	_, err := ad.keys.Get(torrent.KeyId).MakeRequest(req)
 	if err == nil {
 		ad.logger.Info().Msgf("Torrent: %s deleted", torrent.Name)
 	} else {
@@ -217,15 +247,16 @@ func (ad *AllDebrid) DeleteTorrent(torrent *torrent.Torrent) {
 	}
 }
 
-func (ad *AllDebrid) GetDownloadLinks(t *torrent.Torrent) error {
+func (ad *AllDebrid) GetDownloadLinks(ctx context.Context, t *torrent.Torrent) error {
 	downloadLinks := make(map[string]torrent.DownloadLinks)
+	key := ad.keys.Get(t.KeyId)
 	for _, file := range t.Files {
 		url := fmt.Sprintf("%s/link/unlock", ad.Host)
 		query := gourl.Values{}
 		query.Add("link", file.Link)
 		url += "?" + query.Encode()
-		req, _ := http.NewRequest(http.MethodGet, url, nil)
-		resp, err := ad.client.MakeRequest(req)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		resp, err := key.MakeRequest(req)
 		if err != nil {
 			return err
 		}
@@ -246,13 +277,13 @@ func (ad *AllDebrid) GetDownloadLinks(t *torrent.Torrent) error {
 	return nil
 }
 
-func (ad *AllDebrid) GetDownloadLink(t *torrent.Torrent, file *torrent.File) *torrent.DownloadLinks {
+func (ad *AllDebrid) GetDownloadLink(ctx context.Context, t *torrent.Torrent, file *torrent.File) *torrent.DownloadLinks {
 	url := fmt.Sprintf("%s/link/unlock", ad.Host)
 	query := gourl.Values{}
 	query.Add("link", file.Link)
 	url += "?" + query.Encode()
-	req, _ := http.NewRequest(http.MethodGet, url, nil)
-	resp, err := ad.client.MakeRequest(req)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := ad.keys.Get(t.KeyId).MakeRequest(req)
 	if err != nil {
 		return nil
 	}
@@ -272,30 +303,116 @@ func (ad *AllDebrid) GetCheckCached() bool {
 	return ad.CheckCached
 }
 
-func (ad *AllDebrid) GetTorrents() ([]*torrent.Torrent, error) {
-	return nil, fmt.Errorf("not implemented")
+func (ad *AllDebrid) GetTorrents(ctx context.Context) ([]*torrent.Torrent, error) {
+	torrents := make([]*torrent.Torrent, 0)
+	for _, key := range ad.keys.Keys() {
+		ts, err := ad.getTorrents(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		torrents = append(torrents, ts...)
+	}
+	return torrents, nil
+}
+
+func (ad *AllDebrid) getTorrents(ctx context.Context, key *engine.Key) ([]*torrent.Torrent, error) {
+	url := fmt.Sprintf("%s/magnet/status", ad.Host)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := key.MakeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var res TorrentsListResponse
+	if err = json.Unmarshal(resp, &res); err != nil {
+		return nil, err
+	}
+	if res.Error != nil {
+		return nil, fmt.Errorf("error listing torrents: %s", res.Error.Message)
+	}
+	torrents := make([]*torrent.Torrent, 0, len(res.Data.Magnets))
+	for _, data := range res.Data.Magnets {
+		var progress float64
+		if data.Size > 0 {
+			progress = float64(data.Downloaded) / float64(data.Size) * 100
+		}
+		torrents = append(torrents, &torrent.Torrent{
+			Id:               strconv.Itoa(data.Id),
+			InfoHash:         data.Hash,
+			Name:             data.Filename,
+			Folder:           data.Filename,
+			Filename:         data.Filename,
+			OriginalFilename: data.Filename,
+			Bytes:            data.Size,
+			Progress:         progress,
+			Status:           getAlldebridStatus(data.StatusCode),
+			Speed:            data.DownloadSpeed,
+			Seeders:          data.Seeders,
+			MountPath:        ad.MountPath,
+			Debrid:           ad.Name,
+			KeyId:            key.Id,
+		})
+	}
+	return torrents, nil
 }
 
 func (ad *AllDebrid) GetDownloadingStatus() []string {
 	return []string{"downloading"}
 }
 
+// AccountInfo combines the accounts of all the API keys
+func (ad *AllDebrid) AccountInfo(ctx context.Context) (*engine.Account, error) {
+	return ad.keys.Account(ctx, ad.accountInfo)
+}
+
+func (ad *AllDebrid) KeyUsage() []engine.KeyUsage {
+	return ad.keys.Usage()
+}
+
+func (ad *AllDebrid) accountInfo(ctx context.Context, key *engine.Key) (*engine.Account, error) {
+	url := fmt.Sprintf("%s/user", ad.Host)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := key.MakeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var data UserResponse
+	if err = json.Unmarshal(resp, &data); err != nil {
+		return nil, err
+	}
+	if data.Error != nil {
+		return nil, fmt.Errorf("error getting account info: %s", data.Error.Message)
+	}
+	user := data.Data.User
+	account := &engine.Account{
+		Username: user.Username,
+		Premium:  user.IsPremium,
+	}
+	if user.PremiumUntil > 0 {
+		account.Expiration = engine.ExpiresAt(time.Unix(user.PremiumUntil, 0))
+	}
+	return account, nil
+}
+
 func (ad *AllDebrid) GetDownloadUncached() bool {
 	return ad.DownloadUncached
 }
 
 func New(dc config.Debrid, cache *cache.Cache) *AllDebrid {
 	rl := request.ParseRateLimit(dc.RateLimit)
-	headers := map[string]string{
-		"Authorization": fmt.Sprintf("Bearer %s", dc.APIKey),
-	}
-	client := request.NewRLHTTPClient(rl, headers)
+	keys := engine.NewKeyRing(dc.GetAPIKeys(), func(token string) *request.RLHTTPClient {
+		headers := map[string]string{
+			"Authorization": fmt.Sprintf("Bearer %s", token),
+		}
+		client := request.NewRLHTTPClient(rl, headers)
+		client.Retry = request.ParseRetryPolicy(dc.Retry)
+		return client
+	})
 	return &AllDebrid{
 		Name:             "alldebrid",
 		Host:             dc.Host,
 		APIKey:           dc.APIKey,
 		DownloadUncached: dc.DownloadUncached,
-		client:           client,
+		keys:             keys,
 		cache:            cache,
 		MountPath:        dc.Folder,
 		logger:           logger.NewLogger(dc.Name, config.GetConfig().LogLevel, os.Stdout),
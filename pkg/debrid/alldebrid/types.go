@@ -40,18 +40,30 @@ type TorrentInfoResponse struct {
 	Error *errorResponse `json:"error"`
 }
 
+type TorrentsListResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		Magnets []magnetInfo `json:"magnets"`
+	} `json:"data"`
+	Error *errorResponse `json:"error"`
+}
+
+type UploadedMagnet struct {
+	Magnet           string `json:"magnet"`
+	File             string `json:"file"`
+	Hash             string `json:"hash"`
+	Name             string `json:"name"`
+	FilenameOriginal string `json:"filename_original"`
+	Size             int64  `json:"size"`
+	Ready            bool   `json:"ready"`
+	ID               int    `json:"id"`
+}
+
 type UploadMagnetResponse struct {
 	Status string `json:"status"`
 	Data   struct {
-		Magnets []struct {
-			Magnet           string `json:"magnet"`
-			Hash             string `json:"hash"`
-			Name             string `json:"name"`
-			FilenameOriginal string `json:"filename_original"`
-			Size             int64  `json:"size"`
-			Ready            bool   `json:"ready"`
-			ID               int    `json:"id"`
-		} `json:"magnets"`
+		Magnets []UploadedMagnet `json:"magnets"`
+		Files   []UploadedMagnet `json:"files"` // Set when uploading .torrent files
 	}
 	Error *errorResponse `json:"error"`
 }
@@ -73,3 +85,16 @@ type DownloadLink struct {
 	} `json:"data"`
 	Error *errorResponse `json:"error"`
 }
+
+type UserResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		User struct {
+			Username     string `json:"username"`
+			IsPremium    bool   `json:"isPremium"`
+			IsSubscribed bool   `json:"isSubscribed"`
+			PremiumUntil int64  `json:"premiumUntil"`
+		} `json:"user"`
+	} `json:"data"`
+	Error *errorResponse `json:"error"`
+}
@@ -1,18 +1,17 @@
 package cache
 
 import (
-	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/rs/zerolog"
 	"github.com/sirrobot01/debrid-blackhole/internal/logger"
 	"os"
-	"path/filepath"
 	"runtime"
 	"sync"
 	"time"
 
-	"github.com/sirrobot01/debrid-blackhole/internal/config"
+	"github.com/sirrobot01/debrid-blackhole/internal/store"
 	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/engine"
 	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/torrent"
 )
@@ -26,6 +25,7 @@ type CachedTorrent struct {
 	LastRead      time.Time                    `json:"last_read"`
 	IsComplete    bool                         `json:"is_complete"`
 	DownloadLinks map[string]DownloadLinkCache `json:"download_links"`
+	linksMu       sync.RWMutex
 }
 
 var (
@@ -41,7 +41,8 @@ func getLogger() zerolog.Logger {
 }
 
 type Cache struct {
-	dir           string
+	bucket        string
+	store         store.Store
 	client        engine.Service
 	torrents      *sync.Map // key: torrent.Id, value: *CachedTorrent
 	torrentsNames *sync.Map // key: torrent.Name, value: torrent.Id
@@ -53,12 +54,15 @@ type Manager struct {
 }
 
 func NewManager(debridService *engine.Engine) *Manager {
-	cfg := config.GetConfig()
+	_logger := getLogger()
 	cm := &Manager{
 		caches: make(map[string]*Cache),
 	}
 	for _, debrid := range debridService.GetDebrids() {
-		c := New(debrid, cfg.Path)
+		c := New(debrid, store.GetStore())
+		if err := c.Load(); err != nil {
+			_logger.Error().Err(err).Msgf("Failed to load cache for %s", debrid.GetName())
+		}
 		cm.caches[debrid.GetName()] = c
 	}
 	return cm
@@ -72,22 +76,23 @@ func (m *Manager) GetCache(debridName string) *Cache {
 	return m.caches[debridName]
 }
 
-func New(debridService engine.Service, basePath string) *Cache {
+func New(debridService engine.Service, s store.Store) *Cache {
 	return &Cache{
-		dir:           filepath.Join(basePath, "cache", debridService.GetName(), "torrents"),
+		bucket:        store.DebridTorrentsBucket(debridService.GetName()),
+		store:         s,
 		torrents:      &sync.Map{},
 		torrentsNames: &sync.Map{},
 		client:        debridService,
 	}
 }
 
-func (c *Cache) Start() error {
+func (c *Cache) Start(ctx context.Context) error {
 	_logger := getLogger()
 	_logger.Info().Msg("Starting cache for: " + c.client.GetName())
 	if err := c.Load(); err != nil {
 		return fmt.Errorf("failed to load cache: %v", err)
 	}
-	if err := c.Sync(); err != nil {
+	if err := c.Sync(ctx); err != nil {
 		return fmt.Errorf("failed to sync cache: %v", err)
 	}
 	return nil
@@ -96,38 +101,21 @@ func (c *Cache) Start() error {
 func (c *Cache) Load() error {
 	_logger := getLogger()
 
-	if err := os.MkdirAll(c.dir, 0755); err != nil {
-		return fmt.Errorf("failed to create cache directory: %w", err)
-	}
-
-	files, err := os.ReadDir(c.dir)
-	if err != nil {
-		return fmt.Errorf("failed to read cache directory: %w", err)
-	}
-
-	for _, file := range files {
-		if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
-			continue
-		}
-
-		filePath := filepath.Join(c.dir, file.Name())
-		data, err := os.ReadFile(filePath)
-		if err != nil {
-			_logger.Debug().Err(err).Msgf("Failed to read file: %s", filePath)
-			continue
-		}
-
+	err := c.store.ForEach(c.bucket, func(key string, data []byte) error {
 		var ct CachedTorrent
 		if err := json.Unmarshal(data, &ct); err != nil {
-			_logger.Debug().Err(err).Msgf("Failed to unmarshal file: %s", filePath)
-			continue
+			_logger.Debug().Err(err).Msgf("Failed to unmarshal torrent %s", key)
+			return nil
 		}
 		if len(ct.Files) > 0 {
 			c.torrents.Store(ct.Torrent.Id, &ct)
 			c.torrentsNames.Store(ct.Torrent.Name, ct.Torrent.Id)
 		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read the cached torrents: %w", err)
 	}
-
 	return nil
 }
 
@@ -146,66 +134,34 @@ func (c *Cache) GetTorrentByName(name string) *CachedTorrent {
 }
 
 func (c *Cache) SaveTorrent(ct *CachedTorrent) error {
-	data, err := json.MarshalIndent(ct, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal torrent: %w", err)
-	}
-
-	fileName := ct.Torrent.Id + ".json"
-	filePath := filepath.Join(c.dir, fileName)
-	tmpFile := filePath + ".tmp"
-
-	f, err := os.Create(tmpFile)
-	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
-	}
-	defer f.Close()
-
-	w := bufio.NewWriter(f)
-	if _, err := w.Write(data); err != nil {
-		return fmt.Errorf("failed to write data: %w", err)
-	}
-
-	if err := w.Flush(); err != nil {
-		return fmt.Errorf("failed to flush data: %w", err)
-	}
-
-	return os.Rename(tmpFile, filePath)
+	ct.linksMu.RLock()
+	defer ct.linksMu.RUnlock()
+	return c.store.Put(c.bucket, ct.Torrent.Id, ct)
 }
 
+// SaveAll saves every cached torrent in a single transaction
 func (c *Cache) SaveAll() error {
-	const batchSize = 100
-	var wg sync.WaitGroup
-	_logger := getLogger()
-
-	tasks := make(chan *CachedTorrent, batchSize)
-
-	for i := 0; i < runtime.NumCPU(); i++ {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			for ct := range tasks {
-				if err := c.SaveTorrent(ct); err != nil {
-					_logger.Error().Err(err).Msg("failed to save torrent")
-				}
-			}
-		}()
-	}
-
-	c.torrents.Range(func(_, value interface{}) bool {
-		tasks <- value.(*CachedTorrent)
-		return true
+	err := c.store.Update(func(tx store.Tx) error {
+		var err error
+		c.torrents.Range(func(_, value interface{}) bool {
+			ct := value.(*CachedTorrent)
+			ct.linksMu.RLock()
+			err = tx.Put(c.bucket, ct.Torrent.Id, ct)
+			ct.linksMu.RUnlock()
+			return err == nil
+		})
+		return err
 	})
-
-	close(tasks)
-	wg.Wait()
+	if err != nil {
+		return fmt.Errorf("failed to save the cached torrents: %w", err)
+	}
 	c.LastUpdated = time.Now()
 	return nil
 }
 
-func (c *Cache) Sync() error {
+func (c *Cache) Sync(ctx context.Context) error {
 	_logger := getLogger()
-	torrents, err := c.client.GetTorrents()
+	torrents, err := c.client.GetTorrents(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to sync torrents: %v", err)
 	}
@@ -221,7 +177,7 @@ func (c *Cache) Sync() error {
 		go func() {
 			defer wg.Done()
 			for t := range workChan {
-				if err := c.processTorrent(t); err != nil {
+				if err := c.processTorrent(ctx, t); err != nil {
 					errChan <- err
 				}
 			}
@@ -240,26 +196,29 @@ func (c *Cache) Sync() error {
 		_logger.Error().Err(err).Msg("sync error")
 	}
 
+	if err := c.SaveAll(); err != nil {
+		_logger.Error().Err(err).Msg("sync error")
+	}
 	_logger.Info().Msgf("Synced %d torrents", len(torrents))
 	return nil
 }
 
-func (c *Cache) processTorrent(t *torrent.Torrent) error {
+func (c *Cache) processTorrent(ctx context.Context, t *torrent.Torrent) error {
 	if existing, ok := c.torrents.Load(t.Id); ok {
 		ct := existing.(*CachedTorrent)
 		if ct.IsComplete {
 			return nil
 		}
 	}
-	c.AddTorrent(t)
+	c.AddTorrent(ctx, t)
 	return nil
 }
 
-func (c *Cache) AddTorrent(t *torrent.Torrent) {
+func (c *Cache) AddTorrent(ctx context.Context, t *torrent.Torrent) {
 	_logger := getLogger()
 
 	if len(t.Files) == 0 {
-		tNew, err := c.client.GetTorrent(t.Id)
+		tNew, err := c.client.GetTorrent(ctx, t)
 		_logger.Debug().Msgf("Getting torrent files for %s", t.Id)
 		if err != nil {
 			_logger.Debug().Msgf("Failed to get torrent files for %s: %v", t.Id, err)
@@ -280,20 +239,19 @@ func (c *Cache) AddTorrent(t *torrent.Torrent) {
 		DownloadLinks: make(map[string]DownloadLinkCache),
 	}
 
+	// Saved with the others once the sync is done
 	c.torrents.Store(t.Id, ct)
 	c.torrentsNames.Store(t.Name, t.Id)
-
-	go func() {
-		if err := c.SaveTorrent(ct); err != nil {
-			_logger.Debug().Err(err).Msgf("Failed to save torrent %s", t.Id)
-		}
-	}()
 }
 
-func (c *Cache) RefreshTorrent(torrentId string) *CachedTorrent {
+// RefreshTorrent fetches a torrent from the debrid with the API key owning it, keyId being the cached one if empty
+func (c *Cache) RefreshTorrent(ctx context.Context, torrentId, keyId string) *CachedTorrent {
 	_logger := getLogger()
 
-	t, err := c.client.GetTorrent(torrentId)
+	if existing, ok := c.torrents.Load(torrentId); ok && keyId == "" {
+		keyId = existing.(*CachedTorrent).KeyId
+	}
+	t, err := c.client.GetTorrent(ctx, &torrent.Torrent{Id: torrentId, KeyId: keyId})
 	if err != nil {
 		_logger.Debug().Msgf("Failed to get torrent files for %s: %v", torrentId, err)
 		return nil
@@ -311,25 +269,25 @@ func (c *Cache) RefreshTorrent(torrentId string) *CachedTorrent {
 
 	c.torrents.Store(t.Id, ct)
 	c.torrentsNames.Store(t.Name, t.Id)
-
-	go func() {
-		if err := c.SaveTorrent(ct); err != nil {
-			_logger.Debug().Err(err).Msgf("Failed to save torrent %s", t.Id)
-		}
-	}()
+	if err := c.SaveTorrent(ct); err != nil {
+		_logger.Error().Err(err).Msgf("Failed to save torrent %s", t.Id)
+	}
 
 	return ct
 }
 
-func (c *Cache) GetFileDownloadLink(t *CachedTorrent, file *torrent.File) (string, error) {
+func (c *Cache) GetFileDownloadLink(ctx context.Context, t *CachedTorrent, file *torrent.File) (string, error) {
 	_logger := getLogger()
 
-	if linkCache, ok := t.DownloadLinks[file.Id]; ok {
+	t.linksMu.RLock()
+	linkCache, ok := t.DownloadLinks[file.Id]
+	t.linksMu.RUnlock()
+	if ok {
 		return linkCache.Link, nil
 	}
 
 	if file.Link == "" {
-		t = c.RefreshTorrent(t.Id)
+		t = c.RefreshTorrent(ctx, t.Id, t.KeyId)
 		if t == nil {
 			return "", fmt.Errorf("torrent not found")
 		}
@@ -337,24 +295,32 @@ func (c *Cache) GetFileDownloadLink(t *CachedTorrent, file *torrent.File) (strin
 	}
 
 	_logger.Debug().Msgf("Getting download link for %s", t.Name)
-	link := c.client.GetDownloadLink(t.Torrent, file)
+	link := c.client.GetDownloadLink(ctx, t.Torrent, file)
 	if link == nil {
 		return "", fmt.Errorf("download link not found")
 	}
 
+	t.linksMu.Lock()
 	t.DownloadLinks[file.Id] = DownloadLinkCache{
 		Link: link.DownloadLink,
 	}
+	t.linksMu.Unlock()
 
-	go func() {
-		if err := c.SaveTorrent(t); err != nil {
-			_logger.Debug().Err(err).Msgf("Failed to save torrent %s", t.Id)
-		}
-	}()
+	if err := c.SaveTorrent(t); err != nil {
+		_logger.Error().Err(err).Msgf("Failed to save torrent %s", t.Id)
+	}
 
 	return link.DownloadLink, nil
 }
 
+// RefreshFileDownloadLink drops the saved download link of a file, e.g once it expired, and gets a new one
+func (c *Cache) RefreshFileDownloadLink(ctx context.Context, t *CachedTorrent, file *torrent.File) (string, error) {
+	t.linksMu.Lock()
+	delete(t.DownloadLinks, file.Id)
+	t.linksMu.Unlock()
+	return c.GetFileDownloadLink(ctx, t, file)
+}
+
 func (c *Cache) GetTorrents() *sync.Map {
 	return c.torrents
 }
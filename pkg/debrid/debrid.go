@@ -2,17 +2,24 @@ package debrid
 
 import (
 	"cmp"
+	"context"
 	"fmt"
 	"github.com/sirrobot01/debrid-blackhole/internal/cache"
 	"github.com/sirrobot01/debrid-blackhole/internal/config"
+	"github.com/sirrobot01/debrid-blackhole/internal/logger"
+	"github.com/sirrobot01/debrid-blackhole/internal/store"
 	"github.com/sirrobot01/debrid-blackhole/internal/utils"
 	"github.com/sirrobot01/debrid-blackhole/pkg/arr"
 	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/alldebrid"
 	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/debrid_link"
 	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/engine"
+	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/premiumize"
 	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/realdebrid"
 	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/torbox"
 	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/torrent"
+	"slices"
+	"sync"
+	"time"
 )
 
 func New() *engine.Engine {
@@ -21,33 +28,115 @@ func New() *engine.Engine {
 	debrids := make([]engine.Service, 0)
 	// Divide the cache size by the number of debrids
 	maxCacheSize := maxCachedSize / len(cfg.Debrids)
+	positiveTTL, negativeTTL := cfg.GetCacheTTLs()
+	caches := make(map[string]*cache.Cache)
 
 	for _, dc := range cfg.Debrids {
-		d := createDebrid(dc, cache.New(maxCacheSize))
+		c := cache.New(store.AvailabilityBucket(dc.Name), maxCacheSize, positiveTTL, negativeTTL)
+		d, err := engine.Create(dc, c)
+		if err != nil {
+			// Unknown providers are rejected when the config is validated
+			panic(err)
+		}
 		logger := d.GetLogger()
 		logger.Info().Msg("Debrid Service started")
 		debrids = append(debrids, d)
+		caches[d.GetName()] = c
+	}
+	_logger := logger.GetDefaultLogger()
+	policy, err := engine.NewPolicy(cfg.DebridPolicy.Policy)
+	if err != nil {
+		_logger.Error().Err(err).Msgf("Falling back to priority policy. Available policies: %v", engine.Policies())
+		policy, _ = engine.NewPolicy("priority")
+	}
+	var cooldown time.Duration
+	if cfg.DebridPolicy.Cooldown != "" {
+		cooldown, err = time.ParseDuration(cfg.DebridPolicy.Cooldown)
+		if err != nil {
+			_logger.Error().Err(err).Msgf("Invalid debrid cooldown: %s", cfg.DebridPolicy.Cooldown)
+		}
 	}
-	d := &engine.Engine{Debrids: debrids, LastUsed: 0}
+	d := engine.New(debrids, policy, cfg.DebridPolicy.FailureThreshold, cooldown)
+	d.AvailabilityCaches = caches
+	d.TrackInterval = time.Duration(cmp.Or(cfg.QBitTorrent.RefreshInterval, 10)) * time.Second
+	_logger.Info().Msgf("Debrid policy: %s", policy.Name())
 	return d
 }
 
-func createDebrid(dc config.Debrid, cache *cache.Cache) engine.Service {
-	switch dc.Name {
-	case "realdebrid":
+func init() {
+	engine.Register("realdebrid", func(dc config.Debrid, cache *cache.Cache) engine.Service {
 		return realdebrid.New(dc, cache)
-	case "torbox":
+	})
+	engine.Register("torbox", func(dc config.Debrid, cache *cache.Cache) engine.Service {
 		return torbox.New(dc, cache)
-	case "debridlink":
+	})
+	engine.Register("debridlink", func(dc config.Debrid, cache *cache.Cache) engine.Service {
 		return debrid_link.New(dc, cache)
-	case "alldebrid":
+	})
+	engine.Register("alldebrid", func(dc config.Debrid, cache *cache.Cache) engine.Service {
 		return alldebrid.New(dc, cache)
-	default:
-		return realdebrid.New(dc, cache)
+	})
+	engine.Register("premiumize", func(dc config.Debrid, cache *cache.Cache) engine.Service {
+		return premiumize.New(dc, cache)
+	})
+}
+
+// checkAvailability queries every debrid with check_cached enabled concurrently.
+// The result maps a debrid name to whether the infohash is cached there, debrids whose check failed are left out
+func checkAvailability(ctx context.Context, d *engine.Engine, debrids []engine.Service, infohash string) map[string]bool {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		result = make(map[string]bool)
+	)
+	for _, db := range debrids {
+		if !db.GetCheckCached() {
+			continue
+		}
+		wg.Add(1)
+		go func(db engine.Service) {
+			defer wg.Done()
+			available, err := d.CheckAvailability(ctx, db, []string{infohash})
+			if err != nil {
+				// Tried as a debrid that doesn't check the cache
+				logger := db.GetLogger()
+				logger.Info().Msgf("Availability check failed: %v", err)
+				return
+			}
+			mu.Lock()
+			result[db.GetName()] = available[infohash]
+			mu.Unlock()
+		}(db)
 	}
+	wg.Wait()
+	return result
 }
 
-func ProcessTorrent(d *engine.Engine, magnet *utils.Magnet, a *arr.Arr, isSymlink, overrideDownloadUncached bool) (*torrent.Torrent, error) {
+// orderCached sorts the cached debrids by the configured preference.
+// Debrids missing from the preference keep their policy order after the preferred ones
+func orderCached(cached []engine.Service, preference []string) []engine.Service {
+	rank := func(name string) int {
+		if i := slices.Index(preference, name); i >= 0 {
+			return i
+		}
+		return len(preference)
+	}
+	slices.SortStableFunc(cached, func(a, b engine.Service) int {
+		return cmp.Compare(rank(a.GetName()), rank(b.GetName()))
+	})
+	return cached
+}
+
+func boolRank(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// ProcessTorrent submits the torrent to the first debrid that takes it.
+// downloadUncached overrides the arr and debrid setting if set, the preferred debrid is tried first
+func ProcessTorrent(ctx context.Context, d *engine.Engine, magnet *utils.Magnet, a *arr.Arr, isSymlink bool, overrideDownloadUncached *bool, preferred string) (*torrent.Torrent, error) {
 
 	debridTorrent := &torrent.Torrent{
 		InfoHash: magnet.InfoHash,
@@ -56,36 +145,83 @@ func ProcessTorrent(d *engine.Engine, magnet *utils.Magnet, a *arr.Arr, isSymlin
 		Arr:      a,
 		Size:     magnet.Size,
 	}
+	if config.GetConfig().GetSelectionProfile(a.Name).WantedEpisodesOnly {
+		wanted, err := a.GetWantedEpisodes(magnet.Name)
+		if err != nil {
+			_log := logger.GetDefaultLogger()
+			_log.Warn().Err(err).Msgf("Error getting wanted episodes for %s", magnet.Name)
+		}
+		debridTorrent.WantedEpisodes = wanted
+	}
 
-	errs := make([]error, 0)
-
-	for index, db := range d.Debrids {
-		logger := db.GetLogger()
-		logger.Info().Msgf("Processing debrid: %s", db.GetName())
-
-		// Override first, arr second, debrid third
-
-		if overrideDownloadUncached {
-			debridTorrent.DownloadUncached = true
+	// Override first, arr second, debrid third
+	downloadUncached := func(db engine.Service) bool {
+		if overrideDownloadUncached != nil {
+			return *overrideDownloadUncached
 		} else if a.DownloadUncached != nil {
 			// Arr cached is set
-			debridTorrent.DownloadUncached = *a.DownloadUncached
-		} else {
-			debridTorrent.DownloadUncached = db.GetDownloadUncached()
+			return *a.DownloadUncached
 		}
+		return db.GetDownloadUncached()
+	}
 
-		logger.Info().Msgf("Torrent Hash: %s", debridTorrent.InfoHash)
-		if db.GetCheckCached() {
-			hash, exists := db.IsAvailable([]string{debridTorrent.InfoHash})[debridTorrent.InfoHash]
-			if !exists || !hash {
-				logger.Info().Msgf("Torrent: %s is not cached", debridTorrent.Name)
-				continue
-			} else {
-				logger.Info().Msgf("Torrent: %s is cached(or downloading)", debridTorrent.Name)
+	debrids := d.Order()
+	availability := checkAvailability(ctx, d, debrids, debridTorrent.InfoHash)
+
+	// Cached debrids first, then debrids that don't check the cache, then uncached debrids that can download uncached
+	cached := make([]engine.Service, 0)
+	unchecked := make([]engine.Service, 0)
+	uncached := make([]engine.Service, 0)
+	for _, db := range debrids {
+		logger := db.GetLogger()
+		isCached, checked := availability[db.GetName()]
+		switch {
+		case !checked:
+			unchecked = append(unchecked, db)
+		case isCached:
+			logger.Info().Msgf("Torrent: %s is cached(or downloading)", debridTorrent.Name)
+			cached = append(cached, db)
+		case downloadUncached(db):
+			logger.Info().Msgf("Torrent: %s is not cached, will download uncached", debridTorrent.Name)
+			uncached = append(uncached, db)
+		default:
+			logger.Info().Msgf("Torrent: %s is not cached", debridTorrent.Name)
+		}
+	}
+	candidates := orderCached(cached, config.GetConfig().DebridPolicy.CachedPreference)
+	candidates = append(candidates, unchecked...)
+	candidates = append(candidates, uncached...)
+	if preferred != "" {
+		// The preferred debrid goes first in its group, a cached debrid still beats an uncached preferred one
+		group := func(db engine.Service) int {
+			switch {
+			case slices.Contains(cached, db):
+				return 0
+			case slices.Contains(unchecked, db):
+				return 1
+			default:
+				return 2
 			}
 		}
+		slices.SortStableFunc(candidates, func(a, b engine.Service) int {
+			if c := cmp.Compare(group(a), group(b)); c != 0 {
+				return c
+			}
+			return cmp.Compare(boolRank(b.GetName() == preferred), boolRank(a.GetName() == preferred))
+		})
+	}
+
+	errs := make([]error, 0)
+
+	for _, db := range candidates {
+		logger := db.GetLogger()
+		logger.Info().Msgf("Processing debrid: %s", db.GetName())
+		debridTorrent.DownloadUncached = downloadUncached(db)
+		logger.Info().Msgf("Torrent Hash: %s", debridTorrent.InfoHash)
 
-		dbt, err := db.SubmitMagnet(debridTorrent)
+		start := time.Now()
+		dbt, err := db.SubmitMagnet(ctx, debridTorrent)
+		d.Observe(db.GetName(), time.Since(start), err)
 		if dbt != nil {
 			dbt.Arr = a
 		}
@@ -94,8 +230,17 @@ func ProcessTorrent(d *engine.Engine, magnet *utils.Magnet, a *arr.Arr, isSymlin
 			continue
 		}
 		logger.Info().Msgf("Torrent: %s(id=%s) submitted to %s", dbt.Name, dbt.Id, db.GetName())
-		d.LastUsed = index
-		return db.CheckStatus(dbt, isSymlink)
+		d.SetLastUsed(db.GetName())
+		start = time.Now()
+		dbt, err = db.CheckStatus(ctx, dbt, isSymlink)
+		if ctx.Err() == nil {
+			d.Observe(db.GetName(), time.Since(start), err)
+		}
+		if err == nil {
+			// Released once the torrent has been processed
+			d.Acquire(db.GetName())
+		}
+		return dbt, err
 	}
 	err := fmt.Errorf("failed to process torrent")
 	for _, e := range errs {
@@ -2,6 +2,7 @@ package debrid_link
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/rs/zerolog"
@@ -10,12 +11,14 @@ import (
 	"github.com/sirrobot01/debrid-blackhole/internal/logger"
 	"github.com/sirrobot01/debrid-blackhole/internal/request"
 	"github.com/sirrobot01/debrid-blackhole/internal/utils"
+	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/engine"
 	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/torrent"
 	"slices"
 
 	"net/http"
 	"os"
 	"strings"
+	"time"
 )
 
 type DebridLink struct {
@@ -23,7 +26,7 @@ type DebridLink struct {
 	Host             string `json:"host"`
 	APIKey           string
 	DownloadUncached bool
-	client           *request.RLHTTPClient
+	keys             *engine.KeyRing
 	cache            *cache.Cache
 	MountPath        string
 	logger           zerolog.Logger
@@ -38,16 +41,16 @@ func (dl *DebridLink) GetLogger() zerolog.Logger {
 	return dl.logger
 }
 
-func (dl *DebridLink) IsAvailable(infohashes []string) map[string]bool {
+func (dl *DebridLink) IsAvailable(ctx context.Context, infohashes []string) (map[string]bool, error) {
 	// Check if the infohashes are available in the local cache
 	hashes, result := torrent.GetLocalCache(infohashes, dl.cache)
 
 	if len(hashes) == 0 {
-		// Either all the infohashes are locally cached or none are
-		dl.cache.AddMultiple(result)
-		return result
+		// All the infohashes are in the local cache
+		return result, nil
 	}
 
+	checked := make(map[string]bool, len(hashes))
 	// Divide hashes into groups of 100
 	for i := 0; i < len(hashes); i += 100 {
 		end := i + 100
@@ -70,37 +73,34 @@ func (dl *DebridLink) IsAvailable(infohashes []string) map[string]bool {
 
 		hashStr := strings.Join(validHashes, ",")
 		url := fmt.Sprintf("%s/seedbox/cached/%s", dl.Host, hashStr)
-		req, _ := http.NewRequest(http.MethodGet, url, nil)
-		resp, err := dl.client.MakeRequest(req)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		resp, err := dl.keys.Current().MakeRequest(req)
 		if err != nil {
-			dl.logger.Info().Msgf("Error checking availability: %v", err)
-			return result
+			return result, fmt.Errorf("error checking availability: %w", err)
 		}
 		var data AvailableResponse
 		err = json.Unmarshal(resp, &data)
 		if err != nil {
-			dl.logger.Info().Msgf("Error marshalling availability: %v", err)
-			return result
+			return result, fmt.Errorf("error reading availability: %w", err)
 		}
 		if data.Value == nil {
-			return result
+			return result, nil
 		}
 		value := *data.Value
-		for _, h := range hashes[i:end] {
+		for _, h := range validHashes {
 			_, exists := value[h]
-			if exists {
-				result[h] = true
-			}
+			result[h] = exists
+			checked[h] = exists
 		}
 	}
-	dl.cache.AddMultiple(result) // Add the results to the cache
-	return result
+	dl.cache.AddMultiple(checked) // Add the results, cached or not, to the cache
+	return result, nil
 }
 
-func (dl *DebridLink) GetTorrent(t *torrent.Torrent) (*torrent.Torrent, error) {
+func (dl *DebridLink) GetTorrent(ctx context.Context, t *torrent.Torrent) (*torrent.Torrent, error) {
 	url := fmt.Sprintf("%s/seedbox/list?ids=%s", dl.Host, t.Id)
-	req, _ := http.NewRequest(http.MethodGet, url, nil)
-	resp, err := dl.client.MakeRequest(req)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := dl.keys.Get(t.KeyId).MakeRequest(req)
 	if err != nil {
 		return t, err
 	}
@@ -137,33 +137,32 @@ func (dl *DebridLink) GetTorrent(t *torrent.Torrent) (*torrent.Torrent, error) {
 	t.Filename = name
 	t.OriginalFilename = name
 	files := make([]torrent.File, len(data.Files))
-	cfg := config.GetConfig()
 	for i, f := range data.Files {
-		if !cfg.IsSizeAllowed(f.Size) {
-			continue
-		}
 		files[i] = torrent.File{
 			Id:   f.ID,
 			Name: f.Name,
 			Size: f.Size,
 			Path: f.Name,
+			Link: f.DownloadURL,
 		}
 	}
-	t.Files = files
+	t.SelectFiles(files)
 	return t, nil
 }
 
-func (dl *DebridLink) SubmitMagnet(t *torrent.Torrent) (*torrent.Torrent, error) {
+func (dl *DebridLink) SubmitMagnet(ctx context.Context, t *torrent.Torrent) (*torrent.Torrent, error) {
 	url := fmt.Sprintf("%s/seedbox/add", dl.Host)
 	payload := map[string]string{"url": t.Magnet.Link}
 	jsonPayload, _ := json.Marshal(payload)
-	req, _ := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(jsonPayload))
-	resp, err := dl.client.MakeRequest(req)
-	if err != nil {
-		return nil, err
-	}
 	var res SubmitTorrentInfo
-	err = json.Unmarshal(resp, &res)
+	key, err := dl.keys.Submit(func(key *engine.Key) error {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(jsonPayload))
+		resp, err := key.MakeRequest(req)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(resp, &res)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -174,6 +173,7 @@ func (dl *DebridLink) SubmitMagnet(t *torrent.Torrent) (*torrent.Torrent, error)
 	status := "downloading"
 	name := utils.RemoveInvalidChars(data.Name)
 	t.Id = data.ID
+	t.KeyId = key.Id
 	t.Name = name
 	t.Bytes = data.TotalSize
 	t.Folder = name
@@ -196,14 +196,14 @@ func (dl *DebridLink) SubmitMagnet(t *torrent.Torrent) (*torrent.Torrent, error)
 			Link: f.DownloadURL,
 		}
 	}
-	t.Files = files
+	t.SelectFiles(files)
 
 	return t, nil
 }
 
-func (dl *DebridLink) CheckStatus(torrent *torrent.Torrent, isSymlink bool) (*torrent.Torrent, error) {
+func (dl *DebridLink) CheckStatus(ctx context.Context, torrent *torrent.Torrent, isSymlink bool) (*torrent.Torrent, error) {
 	for {
-		t, err := dl.GetTorrent(torrent)
+		t, err := dl.GetTorrent(ctx, torrent)
 		torrent = t
 		if err != nil || torrent == nil {
 			return torrent, err
@@ -211,7 +211,7 @@ func (dl *DebridLink) CheckStatus(torrent *torrent.Torrent, isSymlink bool) (*to
 		status := torrent.Status
 		if status == "downloaded" {
 			dl.logger.Info().Msgf("Torrent: %s downloaded", torrent.Name)
-			err = dl.GetDownloadLinks(torrent)
+			err = dl.GetDownloadLinks(ctx, torrent)
 			if err != nil {
 				return torrent, err
 			}
@@ -231,10 +231,10 @@ func (dl *DebridLink) CheckStatus(torrent *torrent.Torrent, isSymlink bool) (*to
 	return torrent, nil
 }
 
-func (dl *DebridLink) DeleteTorrent(torrent *torrent.Torrent) {
+func (dl *DebridLink) DeleteTorrent(ctx context.Context, torrent *torrent.Torrent) {
 	url := fmt.Sprintf("%s/seedbox/%s/remove", dl.Host, torrent.Id)
-	req, _ := http.NewRequest(http.MethodDelete, url, nil)
-	_, err := dl.client.MakeRequest(req)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
+	_, err := dl.keys.Get(torrent.KeyId).MakeRequest(req)
 	if err == nil {
 		dl.logger.Info().Msgf("Torrent: %s deleted", torrent.Name)
 	} else {
@@ -242,7 +242,7 @@ func (dl *DebridLink) DeleteTorrent(torrent *torrent.Torrent) {
 	}
 }
 
-func (dl *DebridLink) GetDownloadLinks(t *torrent.Torrent) error {
+func (dl *DebridLink) GetDownloadLinks(ctx context.Context, t *torrent.Torrent) error {
 	downloadLinks := make(map[string]torrent.DownloadLinks)
 	for _, f := range t.Files {
 		dl := torrent.DownloadLinks{
@@ -255,7 +255,7 @@ func (dl *DebridLink) GetDownloadLinks(t *torrent.Torrent) error {
 	return nil
 }
 
-func (dl *DebridLink) GetDownloadLink(t *torrent.Torrent, file *torrent.File) *torrent.DownloadLinks {
+func (dl *DebridLink) GetDownloadLink(ctx context.Context, t *torrent.Torrent, file *torrent.File) *torrent.DownloadLinks {
 	dlLink, ok := t.DownloadLinks[file.Id]
 	if !ok {
 		return nil
@@ -271,23 +271,61 @@ func (dl *DebridLink) GetCheckCached() bool {
 	return dl.CheckCached
 }
 
+// AccountInfo combines the accounts of all the API keys
+func (dl *DebridLink) AccountInfo(ctx context.Context) (*engine.Account, error) {
+	return dl.keys.Account(ctx, dl.accountInfo)
+}
+
+func (dl *DebridLink) KeyUsage() []engine.KeyUsage {
+	return dl.keys.Usage()
+}
+
+func (dl *DebridLink) accountInfo(ctx context.Context, key *engine.Key) (*engine.Account, error) {
+	url := fmt.Sprintf("%s/account/infos", dl.Host)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := key.MakeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var data AccountInfoResponse
+	if err = json.Unmarshal(resp, &data); err != nil {
+		return nil, err
+	}
+	if !data.Success || data.Value == nil {
+		return nil, fmt.Errorf("error getting account info")
+	}
+	info := *data.Value
+	account := &engine.Account{
+		Username: info.Username,
+		Premium:  info.AccountType > 0 && info.PremiumLeft > 0,
+	}
+	if info.PremiumLeft > 0 {
+		account.Expiration = engine.ExpiresAt(time.Now().Add(time.Duration(info.PremiumLeft) * time.Second))
+	}
+	return account, nil
+}
+
 func (dl *DebridLink) GetDownloadUncached() bool {
 	return dl.DownloadUncached
 }
 
 func New(dc config.Debrid, cache *cache.Cache) *DebridLink {
 	rl := request.ParseRateLimit(dc.RateLimit)
-	headers := map[string]string{
-		"Authorization": fmt.Sprintf("Bearer %s", dc.APIKey),
-		"Content-Type":  "application/json",
-	}
-	client := request.NewRLHTTPClient(rl, headers)
+	keys := engine.NewKeyRing(dc.GetAPIKeys(), func(token string) *request.RLHTTPClient {
+		headers := map[string]string{
+			"Authorization": fmt.Sprintf("Bearer %s", token),
+			"Content-Type":  "application/json",
+		}
+		client := request.NewRLHTTPClient(rl, headers)
+		client.Retry = request.ParseRetryPolicy(dc.Retry)
+		return client
+	})
 	return &DebridLink{
 		Name:             "debridlink",
 		Host:             dc.Host,
 		APIKey:           dc.APIKey,
 		DownloadUncached: dc.DownloadUncached,
-		client:           client,
+		keys:             keys,
 		cache:            cache,
 		MountPath:        dc.Folder,
 		logger:           logger.NewLogger(dc.Name, config.GetConfig().LogLevel, os.Stdout),
@@ -295,6 +333,62 @@ func New(dc config.Debrid, cache *cache.Cache) *DebridLink {
 	}
 }
 
-func (dl *DebridLink) GetTorrents() ([]*torrent.Torrent, error) {
-	return nil, fmt.Errorf("not implemented")
+func (dl *DebridLink) GetTorrents(ctx context.Context) ([]*torrent.Torrent, error) {
+	torrents := make([]*torrent.Torrent, 0)
+	for _, key := range dl.keys.Keys() {
+		ts, err := dl.getTorrents(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		torrents = append(torrents, ts...)
+	}
+	return torrents, nil
+}
+
+func (dl *DebridLink) getTorrents(ctx context.Context, key *engine.Key) ([]*torrent.Torrent, error) {
+	torrents := make([]*torrent.Torrent, 0)
+	page := 0
+	for {
+		url := fmt.Sprintf("%s/seedbox/list?page=%d&perPage=50", dl.Host, page)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		resp, err := key.MakeRequest(req)
+		if err != nil {
+			return nil, err
+		}
+		var res TorrentListResponse
+		if err = json.Unmarshal(resp, &res); err != nil {
+			return nil, err
+		}
+		if !res.Success {
+			return nil, fmt.Errorf("error listing torrents")
+		}
+		for _, data := range res.Value {
+			status := "downloading"
+			if data.Status == 100 {
+				status = "downloaded"
+			}
+			name := utils.RemoveInvalidChars(data.Name)
+			torrents = append(torrents, &torrent.Torrent{
+				Id:               data.ID,
+				InfoHash:         data.HashString,
+				Name:             name,
+				Folder:           name,
+				Filename:         name,
+				OriginalFilename: name,
+				Bytes:            data.TotalSize,
+				Progress:         data.DownloadPercent,
+				Status:           status,
+				Speed:            data.DownloadSpeed,
+				Seeders:          data.PeersConnected,
+				MountPath:        dl.MountPath,
+				Debrid:           dl.Name,
+				KeyId:            key.Id,
+			})
+		}
+		if res.Pagination.Next <= page { // -1 on the last page
+			break
+		}
+		page = res.Pagination.Next
+	}
+	return torrents, nil
 }
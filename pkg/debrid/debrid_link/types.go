@@ -42,4 +42,21 @@ type debridLinkTorrentInfo struct {
 
 type TorrentInfo APIResponse[[]debridLinkTorrentInfo]
 
+type TorrentListResponse struct {
+	Success    bool                    `json:"success"`
+	Value      []debridLinkTorrentInfo `json:"value"`
+	Pagination struct {
+		Page  int `json:"page"`
+		Pages int `json:"pages"`
+		Next  int `json:"next"`
+	} `json:"pagination"`
+}
+
 type SubmitTorrentInfo APIResponse[debridLinkTorrentInfo]
+
+type AccountInfoResponse APIResponse[struct {
+	Username    string `json:"username"`
+	Email       string `json:"email"`
+	AccountType int    `json:"accountType"`
+	PremiumLeft int64  `json:"premiumLeft"` // Seconds left
+}]
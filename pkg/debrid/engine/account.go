@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"context"
+	"time"
+)
+
+// Account describes the state of a debrid account.
+// Zero values mean the debrid doesn't report the field, a nil Expiration that the account doesn't expire
+type Account struct {
+	Debrid     string     `json:"debrid"`
+	Username   string     `json:"username,omitempty"`
+	Premium    bool       `json:"premium"`
+	Expiration *time.Time `json:"expiration,omitempty"`
+	// TrafficLeft is only meaningful if TrafficLimited is set
+	TrafficLimited bool      `json:"traffic_limited"`
+	TrafficLeft    int64     `json:"traffic_left"` // Bytes
+	QuotaUsed      float64   `json:"quota_used"`   // Fraction of the fair-use quota used, 0 to 1
+	ActiveSlots    int       `json:"active_slots"`
+	MaxSlots       int       `json:"max_slots"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// AccountInfo is implemented by debrids that can report their account state
+type AccountInfo interface {
+	AccountInfo(ctx context.Context) (*Account, error)
+}
+
+// MergeAccounts combines the accounts of the API keys of a debrid.
+// Slots and traffic add up, the debrid is premium as long as one key is
+func MergeAccounts(accounts []*Account) *Account {
+	if len(accounts) == 1 {
+		return accounts[0]
+	}
+	merged := &Account{TrafficLimited: true, QuotaUsed: 1}
+	for _, a := range accounts {
+		if merged.Username == "" {
+			merged.Username = a.Username
+		}
+		if a.IsExpired() {
+			continue
+		}
+		merged.Premium = true
+		if a.Expiration != nil && (merged.Expiration == nil || a.Expiration.After(*merged.Expiration)) {
+			merged.Expiration = a.Expiration
+		}
+		merged.TrafficLimited = merged.TrafficLimited && a.TrafficLimited
+		merged.TrafficLeft += a.TrafficLeft
+		merged.QuotaUsed = min(merged.QuotaUsed, a.QuotaUsed)
+		merged.ActiveSlots += a.ActiveSlots
+		merged.MaxSlots += a.MaxSlots
+	}
+	if !merged.Premium {
+		merged.TrafficLimited = false
+		merged.QuotaUsed = 0
+	}
+	return merged
+}
+
+func (a *Account) IsExpired() bool {
+	if !a.Premium {
+		return true
+	}
+	return a.Expiration != nil && time.Now().After(*a.Expiration)
+}
+
+func (a *Account) ExpiresIn() time.Duration {
+	if a.Expiration == nil {
+		return 0
+	}
+	return time.Until(*a.Expiration)
+}
+
+// ExpiresAt returns the expiration of an account, nil if the debrid reported none
+func ExpiresAt(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func (a *Account) IsFull() bool {
+	return a.MaxSlots > 0 && a.ActiveSlots >= a.MaxSlots
+}
+
+func (a *Account) IsOutOfQuota() bool {
+	return (a.TrafficLimited && a.TrafficLeft <= 0) || a.QuotaUsed >= 1
+}
+
+// IsUsable reports whether new torrents can be submitted to the account
+func (a *Account) IsUsable() bool {
+	return !a.IsExpired() && !a.IsFull() && !a.IsOutOfQuota()
+}
@@ -1,11 +1,64 @@
 package engine
 
+import (
+	"context"
+	"github.com/sirrobot01/debrid-blackhole/internal/cache"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFailureThreshold = 3
+	defaultCooldown         = 5 * time.Minute
+)
+
 type Engine struct {
-	Debrids  []Service
-	LastUsed int
+	Debrids            []Service
+	LastUsed           int
+	AvailabilityCaches map[string]*cache.Cache
+	// TrackInterval is how often the status trackers list the torrents of a debrid
+	TrackInterval time.Duration
+
+	policy           Policy
+	failureThreshold int
+	cooldown         time.Duration
+	health           map[string]*health
+	accounts         map[string]*Account
+	trackers         map[string]*Tracker
+	mu               sync.RWMutex
+}
+
+// New creates an engine that selects debrids with the given policy.
+// A provider is skipped for cooldown after failureThreshold consecutive failures
+func New(debrids []Service, policy Policy, failureThreshold int, cooldown time.Duration) *Engine {
+	if policy == nil {
+		policy = &priorityPolicy{}
+	}
+	if failureThreshold <= 0 {
+		failureThreshold = defaultFailureThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = defaultCooldown
+	}
+	h := make(map[string]*health, len(debrids))
+	for _, d := range debrids {
+		h[d.GetName()] = &health{}
+	}
+	return &Engine{
+		Debrids:          debrids,
+		policy:           policy,
+		failureThreshold: failureThreshold,
+		cooldown:         cooldown,
+		health:           h,
+		accounts:         make(map[string]*Account),
+		trackers:         make(map[string]*Tracker),
+	}
 }
 
 func (d *Engine) Get() Service {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
 	if d.LastUsed == 0 {
 		return d.Debrids[0]
 	}
@@ -24,3 +77,251 @@ func (d *Engine) GetByName(name string) Service {
 func (d *Engine) GetDebrids() []Service {
 	return d.Debrids
 }
+
+func (d *Engine) GetPolicy() Policy {
+	return d.policy
+}
+
+// IsAvailable checks the infohashes on every debrid concurrently.
+// An infohash is available if any debrid has it cached
+func (d *Engine) IsAvailable(ctx context.Context, infohashes []string) map[string]bool {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		result = make(map[string]bool, len(infohashes))
+	)
+	for _, db := range d.Debrids {
+		wg.Add(1)
+		go func(db Service) {
+			defer wg.Done()
+			available, err := d.CheckAvailability(ctx, db, infohashes)
+			if err != nil {
+				logger := db.GetLogger()
+				logger.Info().Msgf("Availability check failed: %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for h, cached := range available {
+				result[h] = result[h] || cached
+			}
+		}(db)
+	}
+	wg.Wait()
+	return result
+}
+
+// CheckAvailability checks the infohashes on a debrid. Checks that reach the debrid count towards its health,
+// the ones answered from the availability cache don't
+func (d *Engine) CheckAvailability(ctx context.Context, db Service, infohashes []string) (map[string]bool, error) {
+	requested := true
+	if c := d.AvailabilityCaches[db.GetName()]; c != nil {
+		requested = slices.ContainsFunc(infohashes, func(h string) bool { return !c.Has(h) })
+	}
+	start := time.Now()
+	available, err := db.IsAvailable(ctx, infohashes)
+	if requested && ctx.Err() == nil {
+		d.Observe(db.GetName(), time.Since(start), err)
+	}
+	return available, err
+}
+
+// AvailabilityStats returns the availability cache statistics keyed by debrid name
+func (d *Engine) AvailabilityStats() map[string]cache.Stats {
+	stats := make(map[string]cache.Stats, len(d.AvailabilityCaches))
+	for name, c := range d.AvailabilityCaches {
+		stats[name] = c.Stats()
+	}
+	return stats
+}
+
+// Tracker returns the status tracker of a debrid, creating it on first use
+func (d *Engine) Tracker(name string) *Tracker {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if t, ok := d.trackers[name]; ok {
+		return t
+	}
+	svc := d.GetByName(name)
+	if svc == nil {
+		return nil
+	}
+	t := newTracker(svc, d.TrackInterval, d.Observe)
+	d.trackers[name] = t
+	return t
+}
+
+// Tracked returns the number of torrents tracked, keyed by debrid name
+func (d *Engine) Tracked() map[string]int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	tracked := make(map[string]int, len(d.trackers))
+	for name, t := range d.trackers {
+		tracked[name] = t.Tracked()
+	}
+	return tracked
+}
+
+// KeyUsage returns the API key usage of the debrids that support multiple keys
+func (d *Engine) KeyUsage() map[string][]KeyUsage {
+	usage := make(map[string][]KeyUsage)
+	for _, db := range d.Debrids {
+		if ku, ok := db.(KeyUser); ok {
+			usage[db.GetName()] = ku.KeyUsage()
+		}
+	}
+	return usage
+}
+
+// SetLastUsed records the debrid that accepted the last torrent
+func (d *Engine) SetLastUsed(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, deb := range d.Debrids {
+		if deb.GetName() == name {
+			d.LastUsed = i
+			return
+		}
+	}
+}
+
+// Order returns the healthy debrids in the order the policy wants them tried.
+// Debrids whose account is expired, full or out of quota are never returned.
+// If every other debrid is cooling down, all of them are returned so a torrent is never dropped without trying
+func (d *Engine) Order() []Service {
+	stats := d.Health()
+	usable := make([]Service, 0, len(d.Debrids))
+	healthy := make([]Service, 0, len(d.Debrids))
+	for _, deb := range d.Debrids {
+		if !d.isAccountUsable(deb.GetName()) {
+			continue
+		}
+		usable = append(usable, deb)
+		if stats[deb.GetName()].Healthy {
+			healthy = append(healthy, deb)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = usable
+	}
+	return d.policy.Order(healthy, stats)
+}
+
+// Health returns a snapshot of every debrid's health keyed by name
+func (d *Engine) Health() map[string]Health {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	now := time.Now()
+	stats := make(map[string]Health, len(d.health))
+	for name, h := range d.health {
+		stats[name] = h.snapshot(name, now)
+	}
+	return stats
+}
+
+func (d *Engine) getHealth(name string) *health {
+	h, ok := d.health[name]
+	if !ok {
+		h = &health{}
+		d.health[name] = h
+	}
+	return h
+}
+
+// Observe records the outcome of a request to a debrid.
+// Provider failures count towards the failure threshold, anything else resets it
+func (d *Engine) Observe(name string, latency time.Duration, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h := d.getHealth(name)
+	h.totalRequests++
+	if IsProviderFailure(err) {
+		now := time.Now()
+		h.totalFailures++
+		h.consecutiveFailures++
+		h.lastError = err.Error()
+		h.lastFailure = now
+		if h.consecutiveFailures >= d.failureThreshold {
+			h.disabledUntil = now.Add(d.cooldown)
+		}
+		return
+	}
+	h.consecutiveFailures = 0
+	h.disabledUntil = time.Time{}
+	if h.latency == 0 {
+		h.latency = latency
+	} else {
+		h.latency = (h.latency*4 + latency) / 5
+	}
+}
+
+// SaveCaches writes the pending availability results of every debrid, on shutdown
+func (d *Engine) SaveCaches() {
+	for _, c := range d.AvailabilityCaches {
+		c.Save()
+	}
+}
+
+// Acquire marks a torrent as in progress on a debrid
+func (d *Engine) Acquire(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.getHealth(name).active++
+	if account, ok := d.accounts[name]; ok {
+		// Keep the slot count current until the next refresh
+		account.ActiveSlots++
+	}
+}
+
+// Release marks a torrent on a debrid as no longer in progress
+func (d *Engine) Release(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h := d.getHealth(name)
+	if h.active > 0 {
+		h.active--
+	}
+	if account, ok := d.accounts[name]; ok && account.ActiveSlots > 0 {
+		account.ActiveSlots--
+	}
+}
+
+// RefreshAccounts fetches the account state of every debrid that implements AccountInfo
+func (d *Engine) RefreshAccounts(ctx context.Context) map[string]error {
+	errs := make(map[string]error)
+	for _, deb := range d.Debrids {
+		ai, ok := deb.(AccountInfo)
+		if !ok {
+			continue
+		}
+		account, err := ai.AccountInfo(ctx)
+		if err != nil {
+			errs[deb.GetName()] = err
+			continue
+		}
+		account.Debrid = deb.GetName()
+		account.UpdatedAt = time.Now()
+		d.mu.Lock()
+		d.accounts[deb.GetName()] = account
+		d.mu.Unlock()
+	}
+	return errs
+}
+
+// Accounts returns a copy of the last known account state keyed by debrid name
+func (d *Engine) Accounts() map[string]Account {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	accounts := make(map[string]Account, len(d.accounts))
+	for name, a := range d.accounts {
+		accounts[name] = *a
+	}
+	return accounts
+}
+
+// isAccountUsable is true for debrids without account info
+func (d *Engine) isAccountUsable(name string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	account, ok := d.accounts[name]
+	return !ok || account.IsUsable()
+}
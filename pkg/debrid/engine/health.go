@@ -0,0 +1,105 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"github.com/sirrobot01/debrid-blackhole/internal/request"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Health is a snapshot of a debrid provider's recent behaviour
+type Health struct {
+	Name                string    `json:"name"`
+	Healthy             bool      `json:"healthy"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	TotalFailures       int       `json:"total_failures"`
+	TotalRequests       int       `json:"total_requests"`
+	LastError           string    `json:"last_error,omitempty"`
+	LastFailure         time.Time `json:"last_failure,omitempty"`
+	DisabledUntil       time.Time `json:"disabled_until,omitempty"`
+	LatencyMs           int64     `json:"latency_ms"`
+	Active              int       `json:"active"`
+}
+
+type health struct {
+	consecutiveFailures int
+	totalFailures       int
+	totalRequests       int
+	lastError           string
+	lastFailure         time.Time
+	disabledUntil       time.Time
+	latency             time.Duration // exponentially weighted moving average
+	active              int
+}
+
+func (h *health) isHealthy(now time.Time) bool {
+	return h.disabledUntil.IsZero() || now.After(h.disabledUntil)
+}
+
+func (h *health) snapshot(name string, now time.Time) Health {
+	return Health{
+		Name:                name,
+		Healthy:             h.isHealthy(now),
+		ConsecutiveFailures: h.consecutiveFailures,
+		TotalFailures:       h.totalFailures,
+		TotalRequests:       h.totalRequests,
+		LastError:           h.lastError,
+		LastFailure:         h.lastFailure,
+		DisabledUntil:       h.disabledUntil,
+		LatencyMs:           h.latency.Milliseconds(),
+		Active:              h.active,
+	}
+}
+
+// quotaKeywords are fragments of provider error messages that indicate an exhausted account
+var quotaKeywords = []string{
+	"quota",
+	"limit reached",
+	"limit_reached",
+	"active_limit",
+	"too many",
+	"too_many",
+	"traffic exceeded",
+	"traffic_exhausted",
+	"bandwidth",
+}
+
+func isQuotaMessage(msg string) bool {
+	msg = strings.ToLower(msg)
+	for _, k := range quotaKeywords {
+		if strings.Contains(msg, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsProviderFailure reports whether err means the provider itself is unhealthy,
+// i.e. a 5xx, a timeout or a quota error. Errors about a single torrent(not cached, bad magnet etc.) are not failures
+func IsProviderFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var httpErr *request.HTTPError
+	if errors.As(err, &httpErr) {
+		switch {
+		case httpErr.StatusCode >= http.StatusInternalServerError:
+			return true
+		case httpErr.StatusCode == http.StatusTooManyRequests:
+			return true
+		default:
+			return isQuotaMessage(httpErr.Body)
+		}
+	}
+	return isQuotaMessage(err.Error())
+}
@@ -0,0 +1,223 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/sirrobot01/debrid-blackhole/internal/request"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a key is skipped after a rate limit, and after a bandwidth or quota cap
+	keyRateLimitCooldown = time.Minute
+	keyQuotaCooldown     = time.Hour
+)
+
+// Key is an API key of a debrid with its own rate limited client
+type Key struct {
+	Id     string
+	Client *request.RLHTTPClient
+
+	token        string
+	ring         *KeyRing
+	requests     int64
+	failures     int64
+	torrents     int64
+	limitedUntil time.Time
+}
+
+// KeyUsage is a snapshot of the usage of a key
+type KeyUsage struct {
+	Id           string    `json:"id"`
+	Current      bool      `json:"current"`
+	Requests     int64     `json:"requests"`
+	Failures     int64     `json:"failures"`
+	Torrents     int64     `json:"torrents"` // Torrents submitted with the key
+	LimitedUntil time.Time `json:"limited_until,omitempty"`
+}
+
+// KeyRing holds the API keys of a debrid.
+// New torrents use the current key, which rotates when it hits a rate limit or bandwidth cap.
+// Submitted torrents stay bound to the key that owns them
+type KeyRing struct {
+	keys    []*Key
+	current int
+	mu      sync.Mutex
+}
+
+// KeyId returns a stable id for an API key that doesn't expose it
+func KeyId(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])[:8]
+}
+
+// NewKeyRing creates a ring from the API keys, newClient builds the client of each key
+func NewKeyRing(tokens []string, newClient func(token string) *request.RLHTTPClient) *KeyRing {
+	r := &KeyRing{}
+	for _, token := range tokens {
+		r.keys = append(r.keys, &Key{
+			Id:     KeyId(token),
+			Client: newClient(token),
+			token:  token,
+			ring:   r,
+		})
+	}
+	return r
+}
+
+// Token returns the API key, for debrids that expect it in the url
+func (k *Key) Token() string {
+	return k.token
+}
+
+// MakeRequest sends the request with the key, recording its usage.
+// The ring moves on to the next key if this one is limited
+func (k *Key) MakeRequest(req *http.Request) ([]byte, error) {
+	resp, err := k.Client.MakeRequest(req)
+	k.ring.observe(k, err)
+	return resp, err
+}
+
+func (r *KeyRing) observe(k *Key, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k.requests++
+	if err == nil {
+		return
+	}
+	k.failures++
+	cooldown, limited := keyCooldown(err)
+	if !limited {
+		return
+	}
+	k.limitedUntil = time.Now().Add(cooldown)
+	if r.keys[r.current] == k {
+		r.rotate()
+	}
+}
+
+// keyCooldown reports whether err means the key hit a limit, and for how long to skip it
+func keyCooldown(err error) (time.Duration, bool) {
+	var httpErr *request.HTTPError
+	if errors.As(err, &httpErr) {
+		if isQuotaMessage(httpErr.Body) {
+			return keyQuotaCooldown, true
+		}
+		if httpErr.StatusCode == http.StatusTooManyRequests {
+			return keyRateLimitCooldown, true
+		}
+		return 0, false
+	}
+	if isQuotaMessage(err.Error()) {
+		return keyQuotaCooldown, true
+	}
+	return 0, false
+}
+
+// rotate moves to the next key that isn't limited. It stays put if all keys are limited
+func (r *KeyRing) rotate() {
+	now := time.Now()
+	for i := 1; i < len(r.keys); i++ {
+		next := (r.current + i) % len(r.keys)
+		if now.After(r.keys[next].limitedUntil) {
+			r.current = next
+			return
+		}
+	}
+}
+
+// Current returns the key used for new torrents and account wide requests
+func (r *KeyRing) Current() *Key {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Now().Before(r.keys[r.current].limitedUntil) {
+		r.rotate()
+	}
+	return r.keys[r.current]
+}
+
+// Get returns the key with the id. Unknown ids, e.g torrents added before the key was removed, get the current key
+func (r *KeyRing) Get(id string) *Key {
+	for _, k := range r.keys {
+		if k.Id == id {
+			return k
+		}
+	}
+	return r.Current()
+}
+
+// Keys returns all the keys, for requests that have to cover every key like listing torrents
+func (r *KeyRing) Keys() []*Key {
+	return r.keys
+}
+
+// Submit runs submit with the current key, moving on to the next key while keys are limited.
+// The key that accepted the torrent is returned so the torrent can be bound to it
+func (r *KeyRing) Submit(submit func(k *Key) error) (*Key, error) {
+	var (
+		k   *Key
+		err error
+	)
+	for range r.keys {
+		k = r.Current()
+		if err = submit(k); err == nil {
+			r.mu.Lock()
+			k.torrents++
+			r.mu.Unlock()
+			return k, nil
+		}
+		if _, limited := keyCooldown(err); !limited {
+			return k, err
+		}
+	}
+	return k, err
+}
+
+// Account fetches the account of every key and merges them.
+// Keys that fail are left out, an error is only returned if they all fail
+func (r *KeyRing) Account(ctx context.Context, fetch func(ctx context.Context, k *Key) (*Account, error)) (*Account, error) {
+	accounts := make([]*Account, 0, len(r.keys))
+	var err error
+	for _, k := range r.keys {
+		account, e := fetch(ctx, k)
+		if e != nil {
+			err = e
+			continue
+		}
+		accounts = append(accounts, account)
+	}
+	if len(accounts) == 0 {
+		return nil, err
+	}
+	return MergeAccounts(accounts), nil
+}
+
+func (r *KeyRing) Usage() []KeyUsage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	usage := make([]KeyUsage, 0, len(r.keys))
+	now := time.Now()
+	for i, k := range r.keys {
+		u := KeyUsage{
+			Id:       k.Id,
+			Current:  i == r.current,
+			Requests: k.requests,
+			Failures: k.failures,
+			Torrents: k.torrents,
+		}
+		if now.Before(k.limitedUntil) {
+			u.LimitedUntil = k.limitedUntil
+		}
+		usage = append(usage, u)
+	}
+	return usage
+}
+
+// KeyUser is implemented by debrids that support multiple API keys
+type KeyUser interface {
+	KeyUsage() []KeyUsage
+}
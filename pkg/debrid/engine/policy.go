@@ -0,0 +1,120 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Policy decides the order in which debrids are tried for a new torrent.
+// candidates is in config order, stats holds the health of every candidate keyed by name
+type Policy interface {
+	Name() string
+	Order(candidates []Service, stats map[string]Health) []Service
+}
+
+var (
+	policiesMu sync.RWMutex
+	policies   = map[string]func() Policy{
+		"priority":     func() Policy { return &priorityPolicy{} },
+		"round-robin":  func() Policy { return &roundRobinPolicy{} },
+		"least-active": func() Policy { return &leastActivePolicy{} },
+		"latency":      func() Policy { return &latencyPolicy{} },
+	}
+)
+
+// RegisterPolicy makes a selection policy available under the given name
+func RegisterPolicy(name string, factory func() Policy) {
+	policiesMu.Lock()
+	defer policiesMu.Unlock()
+	policies[name] = factory
+}
+
+// NewPolicy returns the policy registered under name. An empty name is the priority policy
+func NewPolicy(name string) (Policy, error) {
+	if name == "" {
+		name = "priority"
+	}
+	policiesMu.RLock()
+	factory, ok := policies[name]
+	policiesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown debrid policy: %s", name)
+	}
+	return factory(), nil
+}
+
+// Policies returns the sorted names of all registered policies
+func Policies() []string {
+	policiesMu.RLock()
+	defer policiesMu.RUnlock()
+	names := make([]string, 0, len(policies))
+	for name := range policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// priorityPolicy always tries debrids in config order
+type priorityPolicy struct{}
+
+func (p *priorityPolicy) Name() string {
+	return "priority"
+}
+
+func (p *priorityPolicy) Order(candidates []Service, _ map[string]Health) []Service {
+	return candidates
+}
+
+// roundRobinPolicy starts at the next debrid on every call
+type roundRobinPolicy struct {
+	next atomic.Uint64
+}
+
+func (p *roundRobinPolicy) Name() string {
+	return "round-robin"
+}
+
+func (p *roundRobinPolicy) Order(candidates []Service, _ map[string]Health) []Service {
+	if len(candidates) == 0 {
+		return candidates
+	}
+	start := int((p.next.Add(1) - 1) % uint64(len(candidates)))
+	ordered := make([]Service, 0, len(candidates))
+	ordered = append(ordered, candidates[start:]...)
+	ordered = append(ordered, candidates[:start]...)
+	return ordered
+}
+
+// leastActivePolicy prefers the debrid with the fewest torrents in progress
+type leastActivePolicy struct{}
+
+func (p *leastActivePolicy) Name() string {
+	return "least-active"
+}
+
+func (p *leastActivePolicy) Order(candidates []Service, stats map[string]Health) []Service {
+	ordered := append([]Service(nil), candidates...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return stats[ordered[i].GetName()].Active < stats[ordered[j].GetName()].Active
+	})
+	return ordered
+}
+
+// latencyPolicy prefers the debrid with the lowest recent latency.
+// Debrids without a measurement yet are tried first so they get one
+type latencyPolicy struct{}
+
+func (p *latencyPolicy) Name() string {
+	return "latency"
+}
+
+func (p *latencyPolicy) Order(candidates []Service, stats map[string]Health) []Service {
+	ordered := append([]Service(nil), candidates...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return stats[ordered[i].GetName()].LatencyMs < stats[ordered[j].GetName()].LatencyMs
+	})
+	return ordered
+}
@@ -0,0 +1,55 @@
+package engine
+
+import (
+	"fmt"
+	"github.com/sirrobot01/debrid-blackhole/internal/cache"
+	"github.com/sirrobot01/debrid-blackhole/internal/config"
+	"sort"
+	"sync"
+)
+
+// Factory creates a debrid Service from its config entry
+type Factory func(dc config.Debrid, cache *cache.Cache) Service
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a debrid provider available under the given name.
+// Third-party providers should call this from an init function so the name is known before the config is validated
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if factory == nil {
+		panic("debrid: Register factory is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("debrid: Register called twice for provider " + name)
+	}
+	registry[name] = factory
+	config.RegisterDebridProvider(name)
+}
+
+// Create returns a new Service for the configured provider
+func Create(dc config.Debrid, cache *cache.Cache) (Service, error) {
+	registryMu.RLock()
+	factory, ok := registry[dc.Name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown debrid provider: %s", dc.Name)
+	}
+	return factory(dc, cache), nil
+}
+
+// Providers returns the sorted names of all registered providers
+func Providers() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -1,22 +1,31 @@
 package engine
 
 import (
+	"context"
 	"github.com/rs/zerolog"
 	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/torrent"
 )
 
+// Service is a debrid provider.
+// Methods that talk to the debrid take a context so in-flight requests stop when the torrent is deleted or on shutdown
 type Service interface {
-	SubmitMagnet(tr *torrent.Torrent) (*torrent.Torrent, error)
-	CheckStatus(tr *torrent.Torrent, isSymlink bool) (*torrent.Torrent, error)
-	GetDownloadLinks(tr *torrent.Torrent) error
-	GetDownloadLink(tr *torrent.Torrent, file *torrent.File) *torrent.DownloadLinks
-	DeleteTorrent(tr *torrent.Torrent)
-	IsAvailable(infohashes []string) map[string]bool
+	SubmitMagnet(ctx context.Context, tr *torrent.Torrent) (*torrent.Torrent, error)
+	CheckStatus(ctx context.Context, tr *torrent.Torrent, isSymlink bool) (*torrent.Torrent, error)
+	GetDownloadLinks(ctx context.Context, tr *torrent.Torrent) error
+	GetDownloadLink(ctx context.Context, tr *torrent.Torrent, file *torrent.File) *torrent.DownloadLinks
+	DeleteTorrent(ctx context.Context, tr *torrent.Torrent)
+	// IsAvailable reports which infohashes are cached on the debrid, the error is that of the first failed check
+	IsAvailable(ctx context.Context, infohashes []string) (map[string]bool, error)
 	GetCheckCached() bool
 	GetDownloadUncached() bool
-	GetTorrent(torrent *torrent.Torrent) (*torrent.Torrent, error)
-	GetTorrents() ([]*torrent.Torrent, error)
+	GetTorrent(ctx context.Context, torrent *torrent.Torrent) (*torrent.Torrent, error)
+	GetTorrents(ctx context.Context) ([]*torrent.Torrent, error)
 	GetName() string
 	GetLogger() zerolog.Logger
 	GetDownloadingStatus() []string
 }
+
+// FileSelector is implemented by debrids that can change the files of a torrent after it was added
+type FileSelector interface {
+	SelectTorrentFiles(ctx context.Context, tr *torrent.Torrent) (*torrent.Torrent, error)
+}
@@ -0,0 +1,199 @@
+package engine
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTrackInterval = 10 * time.Second
+	// A torrent missing from this many lists in a row is reported as removed
+	trackerMissingPolls = 3
+)
+
+// Update is the status of a tracked torrent
+type Update struct {
+	Id       string
+	Status   string
+	Progress float64
+	Speed    int64
+	Seeders  int
+	Bytes    int64
+	// Removed is set when the debrid no longer lists the torrent
+	Removed bool
+}
+
+// Subscription receives the updates of a single torrent.
+// Only the latest update is kept if the subscriber falls behind
+type Subscription struct {
+	C       <-chan Update
+	id      string
+	ch      chan Update
+	tracker *Tracker
+}
+
+// Close stops the updates. The tracker stops polling once it has no subscriptions left
+func (s *Subscription) Close() {
+	s.tracker.unsubscribe(s)
+}
+
+// Tracker polls the torrent list of a debrid on one schedule and fans out status changes to subscribers.
+// It replaces a polling loop per torrent with a single GetTorrents call per interval
+type Tracker struct {
+	service  Service
+	interval time.Duration
+	observe  func(name string, latency time.Duration, err error)
+	logger   zerolog.Logger
+
+	mu      sync.Mutex
+	subs    map[string]map[*Subscription]struct{}
+	last    map[string]Update
+	missing map[string]int
+	stop    context.CancelFunc
+}
+
+func newTracker(service Service, interval time.Duration, observe func(string, time.Duration, error)) *Tracker {
+	if interval <= 0 {
+		interval = defaultTrackInterval
+	}
+	return &Tracker{
+		service:  service,
+		interval: interval,
+		observe:  observe,
+		logger:   service.GetLogger(),
+		subs:     make(map[string]map[*Subscription]struct{}),
+		last:     make(map[string]Update),
+		missing:  make(map[string]int),
+	}
+}
+
+// Subscribe starts tracking a torrent by its debrid id
+func (t *Tracker) Subscribe(id string) *Subscription {
+	ch := make(chan Update, 1)
+	sub := &Subscription{C: ch, id: id, ch: ch, tracker: t}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.subs[id] == nil {
+		t.subs[id] = make(map[*Subscription]struct{})
+	}
+	t.subs[id][sub] = struct{}{}
+	if u, ok := t.last[id]; ok {
+		sub.send(u)
+	}
+	if t.stop == nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		t.stop = cancel
+		go t.run(ctx)
+	}
+	return sub
+}
+
+func (t *Tracker) unsubscribe(sub *Subscription) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	subs, ok := t.subs[sub.id]
+	if !ok {
+		return
+	}
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(t.subs, sub.id)
+		delete(t.last, sub.id)
+		delete(t.missing, sub.id)
+	}
+	if len(t.subs) == 0 && t.stop != nil {
+		t.stop()
+		t.stop = nil
+	}
+}
+
+// Tracked returns the number of torrents being tracked
+func (t *Tracker) Tracked() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.subs)
+}
+
+func (t *Tracker) run(ctx context.Context) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	t.poll(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.poll(ctx)
+		}
+	}
+}
+
+func (t *Tracker) poll(ctx context.Context) {
+	if t.Tracked() == 0 {
+		return
+	}
+	start := time.Now()
+	torrents, err := t.service.GetTorrents(ctx)
+	if ctx.Err() != nil {
+		return
+	}
+	if t.observe != nil {
+		t.observe(t.service.GetName(), time.Since(start), err)
+	}
+	if err != nil {
+		t.logger.Error().Err(err).Msg("Error listing torrents")
+		return
+	}
+
+	listed := make(map[string]Update, len(torrents))
+	for _, tr := range torrents {
+		listed[tr.Id] = Update{
+			Id:       tr.Id,
+			Status:   tr.Status,
+			Progress: tr.Progress,
+			Speed:    tr.Speed,
+			Seeders:  tr.Seeders,
+			Bytes:    tr.Bytes,
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, subs := range t.subs {
+		u, ok := listed[id]
+		if !ok {
+			t.missing[id]++
+			if t.missing[id] < trackerMissingPolls {
+				continue
+			}
+			u = Update{Id: id, Removed: true}
+		} else {
+			t.missing[id] = 0
+		}
+		if last, seen := t.last[id]; seen && last == u {
+			continue
+		}
+		t.last[id] = u
+		for sub := range subs {
+			sub.send(u)
+		}
+	}
+}
+
+// send delivers the update, replacing any update the subscriber hasn't read yet
+func (s *Subscription) send(u Update) {
+	for {
+		select {
+		case s.ch <- u:
+			return
+		default:
+		}
+		select {
+		case <-s.ch:
+		default:
+		}
+	}
+}
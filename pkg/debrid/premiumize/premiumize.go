@@ -0,0 +1,456 @@
+package premiumize
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/sirrobot01/debrid-blackhole/internal/cache"
+	"github.com/sirrobot01/debrid-blackhole/internal/config"
+	"github.com/sirrobot01/debrid-blackhole/internal/logger"
+	"github.com/sirrobot01/debrid-blackhole/internal/request"
+	"github.com/sirrobot01/debrid-blackhole/internal/utils"
+	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/engine"
+	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/torrent"
+	"net/http"
+	gourl "net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+type Premiumize struct {
+	Name             string
+	Host             string `json:"host"`
+	APIKey           string
+	DownloadUncached bool
+	keys             *engine.KeyRing
+	cache            *cache.Cache
+	MountPath        string
+	logger           zerolog.Logger
+	CheckCached      bool
+}
+
+func (pm *Premiumize) GetName() string {
+	return pm.Name
+}
+
+func (pm *Premiumize) GetLogger() zerolog.Logger {
+	return pm.logger
+}
+
+// getURL builds an API url for the given endpoint.
+// Premiumize authenticates with the api key as a query parameter
+func (pm *Premiumize) getURL(key *engine.Key, endpoint string, query gourl.Values) string {
+	if query == nil {
+		query = gourl.Values{}
+	}
+	query.Set("apikey", key.Token())
+	return fmt.Sprintf("%s/%s?%s", pm.Host, endpoint, query.Encode())
+}
+
+func (pm *Premiumize) IsAvailable(ctx context.Context, infohashes []string) (map[string]bool, error) {
+	// Check if the infohashes are available in the local cache
+	hashes, result := torrent.GetLocalCache(infohashes, pm.cache)
+
+	if len(hashes) == 0 {
+		// All the infohashes are in the local cache
+		return result, nil
+	}
+
+	checked := make(map[string]bool, len(hashes))
+	// Divide hashes into groups of 100
+	for i := 0; i < len(hashes); i += 100 {
+		end := i + 100
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+
+		// Filter out empty strings
+		validHashes := make([]string, 0, end-i)
+		for _, hash := range hashes[i:end] {
+			if hash != "" {
+				validHashes = append(validHashes, hash)
+			}
+		}
+
+		// If no valid hashes in this batch, continue to the next batch
+		if len(validHashes) == 0 {
+			continue
+		}
+
+		query := gourl.Values{}
+		for _, h := range validHashes {
+			query.Add("items[]", h)
+		}
+		key := pm.keys.Current()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, pm.getURL(key, "cache/check", query), nil)
+		resp, err := key.MakeRequest(req)
+		if err != nil {
+			return result, fmt.Errorf("error checking availability: %w", err)
+		}
+		var data CacheCheckResponse
+		err = json.Unmarshal(resp, &data)
+		if err != nil {
+			return result, fmt.Errorf("error reading availability: %w", err)
+		}
+		if data.Status != "success" {
+			return result, fmt.Errorf("error checking availability: %s", data.Message)
+		}
+		for idx, h := range validHashes {
+			result[h] = idx < len(data.Response) && data.Response[idx]
+			checked[h] = result[h]
+		}
+	}
+	pm.cache.AddMultiple(checked) // Add the results, cached or not, to the cache
+	return result, nil
+}
+
+func (pm *Premiumize) SubmitMagnet(ctx context.Context, t *torrent.Torrent) (*torrent.Torrent, error) {
+	payload := gourl.Values{
+		"src": {t.Magnet.Link},
+	}
+	var data TransferCreateResponse
+	key, err := pm.keys.Submit(func(key *engine.Key) error {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, pm.getURL(key, "transfer/create", nil), strings.NewReader(payload.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp, err := key.MakeRequest(req)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(resp, &data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data.Status != "success" || data.Id == "" {
+		return nil, fmt.Errorf("error adding torrent: %s", data.Message)
+	}
+	t.Id = data.Id
+	t.KeyId = key.Id
+	t.Debrid = pm.Name
+	t.MountPath = pm.MountPath
+	return t, nil
+}
+
+func getPremiumizeStatus(status string) string {
+	switch status {
+	case "finished", "seeding":
+		return "downloaded"
+	case "waiting", "queued", "running":
+		return "downloading"
+	default:
+		return "error"
+	}
+}
+
+func (pm *Premiumize) getTransfers(ctx context.Context, key *engine.Key) ([]Transfer, error) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, pm.getURL(key, "transfer/list", nil), nil)
+	resp, err := key.MakeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var data TransferListResponse
+	if err = json.Unmarshal(resp, &data); err != nil {
+		return nil, err
+	}
+	if data.Status != "success" {
+		return nil, fmt.Errorf("error listing transfers: %s", data.Message)
+	}
+	return data.Transfers, nil
+}
+
+func (pm *Premiumize) getTransfer(ctx context.Context, key *engine.Key, id string) (*Transfer, error) {
+	transfers, err := pm.getTransfers(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	for _, tr := range transfers {
+		if tr.Id == id {
+			return &tr, nil
+		}
+	}
+	return nil, fmt.Errorf("torrent not found")
+}
+
+// listFolder walks a cloud folder recursively and returns its files.
+// parentPath is the path of the folder relative to the torrent root
+func (pm *Premiumize) listFolder(ctx context.Context, key *engine.Key, folderId, parentPath string) ([]torrent.File, error) {
+	query := gourl.Values{}
+	query.Set("id", folderId)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, pm.getURL(key, "folder/list", query), nil)
+	resp, err := key.MakeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var data FolderListResponse
+	if err = json.Unmarshal(resp, &data); err != nil {
+		return nil, err
+	}
+	if data.Status != "success" {
+		return nil, fmt.Errorf("error listing folder: %s", data.Message)
+	}
+	files := make([]torrent.File, 0)
+	for _, item := range data.Content {
+		currentPath := item.Name
+		if parentPath != "" {
+			currentPath = filepath.Join(parentPath, item.Name)
+		}
+		if item.Type == "folder" {
+			children, err := pm.listFolder(ctx, key, item.Id, currentPath)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, children...)
+			continue
+		}
+		files = append(files, torrent.File{
+			Id:   item.Id,
+			Name: item.Name,
+			Size: item.Size,
+			Path: currentPath,
+			Link: item.Link,
+		})
+	}
+	return files, nil
+}
+
+func (pm *Premiumize) getItem(ctx context.Context, key *engine.Key, id string) (*torrent.File, error) {
+	query := gourl.Values{}
+	query.Set("id", id)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, pm.getURL(key, "item/details", query), nil)
+	resp, err := key.MakeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var data ItemDetailsResponse
+	if err = json.Unmarshal(resp, &data); err != nil {
+		return nil, err
+	}
+	if data.Id == "" {
+		return nil, fmt.Errorf("item not found")
+	}
+	return &torrent.File{
+		Id:   data.Id,
+		Name: data.Name,
+		Size: data.Size,
+		Path: data.Name,
+		Link: data.Link,
+	}, nil
+}
+
+func (pm *Premiumize) GetTorrent(ctx context.Context, t *torrent.Torrent) (*torrent.Torrent, error) {
+	key := pm.keys.Get(t.KeyId)
+	tr, err := pm.getTransfer(ctx, key, t.Id)
+	if err != nil {
+		return t, err
+	}
+	name := utils.RemoveInvalidChars(tr.Name)
+	status := getPremiumizeStatus(tr.Status)
+	t.Name = name
+	t.Folder = name
+	t.Filename = name
+	t.OriginalFilename = name
+	t.Status = status
+	t.Progress = tr.Progress * 100
+	t.MountPath = pm.MountPath
+	t.Debrid = pm.Name
+	t.DownloadLinks = make(map[string]torrent.DownloadLinks)
+	if status != "downloaded" {
+		return t, nil
+	}
+	t.Progress = 100
+	files := make([]torrent.File, 0)
+	if tr.FolderId != "" {
+		files, err = pm.listFolder(ctx, key, tr.FolderId, "")
+		if err != nil {
+			return t, err
+		}
+	} else if tr.FileId != "" {
+		// Single file transfers are stored in the root folder
+		file, err := pm.getItem(ctx, key, tr.FileId)
+		if err != nil {
+			return t, err
+		}
+		files = append(files, *file)
+	}
+	var size int64
+	for _, f := range files {
+		size += f.Size
+	}
+	t.Bytes = size
+	t.SelectFiles(files)
+	return t, nil
+}
+
+func (pm *Premiumize) CheckStatus(ctx context.Context, torrent *torrent.Torrent, isSymlink bool) (*torrent.Torrent, error) {
+	for {
+		t, err := pm.GetTorrent(ctx, torrent)
+		torrent = t
+		if err != nil || t == nil {
+			return t, err
+		}
+		status := torrent.Status
+		if status == "downloaded" {
+			pm.logger.Info().Msgf("Torrent: %s downloaded", torrent.Name)
+			if !isSymlink {
+				err = pm.GetDownloadLinks(ctx, torrent)
+				if err != nil {
+					return torrent, err
+				}
+			}
+			break
+		} else if slices.Contains(pm.GetDownloadingStatus(), status) {
+			if !torrent.DownloadUncached {
+				return torrent, fmt.Errorf("torrent: %s not cached", torrent.Name)
+			}
+			// Break out of the loop if the torrent is downloading.
+			// This is necessary to prevent infinite loop since we moved to sync downloading and async processing
+			break
+		} else {
+			return torrent, fmt.Errorf("torrent: %s has error", torrent.Name)
+		}
+	}
+	return torrent, nil
+}
+
+func (pm *Premiumize) DeleteTorrent(ctx context.Context, torrent *torrent.Torrent) {
+	payload := gourl.Values{
+		"id": {torrent.Id},
+	}
+	key := pm.keys.Get(torrent.KeyId)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, pm.getURL(key, "transfer/delete", nil), strings.NewReader(payload.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, err := key.MakeRequest(req)
+	if err == nil {
+		pm.logger.Info().Msgf("Torrent: %s deleted", torrent.Name)
+	} else {
+		pm.logger.Info().Msgf("Error deleting torrent: %s", err)
+	}
+}
+
+func (pm *Premiumize) GetDownloadLinks(ctx context.Context, t *torrent.Torrent) error {
+	// Premiumize cloud links are already direct download links
+	downloadLinks := make(map[string]torrent.DownloadLinks)
+	for _, f := range t.Files {
+		if f.Link == "" {
+			continue
+		}
+		downloadLinks[f.Id] = torrent.DownloadLinks{
+			Link:         f.Link,
+			Filename:     f.Name,
+			DownloadLink: f.Link,
+		}
+	}
+	t.DownloadLinks = downloadLinks
+	return nil
+}
+
+func (pm *Premiumize) GetDownloadLink(ctx context.Context, t *torrent.Torrent, file *torrent.File) *torrent.DownloadLinks {
+	link := file.Link
+	if link == "" {
+		f, err := pm.getItem(ctx, pm.keys.Get(t.KeyId), file.Id)
+		if err != nil {
+			return nil
+		}
+		link = f.Link
+	}
+	return &torrent.DownloadLinks{
+		Link:         link,
+		Filename:     file.Name,
+		DownloadLink: link,
+	}
+}
+
+func (pm *Premiumize) GetCheckCached() bool {
+	return pm.CheckCached
+}
+
+func (pm *Premiumize) GetTorrents(ctx context.Context) ([]*torrent.Torrent, error) {
+	torrents := make([]*torrent.Torrent, 0)
+	for _, key := range pm.keys.Keys() {
+		transfers, err := pm.getTransfers(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		for _, tr := range transfers {
+			name := utils.RemoveInvalidChars(tr.Name)
+			torrents = append(torrents, &torrent.Torrent{
+				Id:               tr.Id,
+				Name:             name,
+				Folder:           name,
+				Filename:         name,
+				OriginalFilename: name,
+				Progress:         tr.Progress * 100,
+				Status:           getPremiumizeStatus(tr.Status),
+				MountPath:        pm.MountPath,
+				Debrid:           pm.Name,
+				KeyId:            key.Id,
+			})
+		}
+	}
+	return torrents, nil
+}
+
+func (pm *Premiumize) GetDownloadingStatus() []string {
+	return []string{"downloading"}
+}
+
+// AccountInfo combines the accounts of all the API keys
+func (pm *Premiumize) AccountInfo(ctx context.Context) (*engine.Account, error) {
+	return pm.keys.Account(ctx, pm.accountInfo)
+}
+
+func (pm *Premiumize) KeyUsage() []engine.KeyUsage {
+	return pm.keys.Usage()
+}
+
+func (pm *Premiumize) accountInfo(ctx context.Context, key *engine.Key) (*engine.Account, error) {
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, pm.getURL(key, "account/info", nil), nil)
+	resp, err := key.MakeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var data AccountInfoResponse
+	if err = json.Unmarshal(resp, &data); err != nil {
+		return nil, err
+	}
+	if data.Status != "success" {
+		return nil, fmt.Errorf("error getting account info: %s", data.Message)
+	}
+	account := &engine.Account{
+		Username:  data.CustomerId,
+		Premium:   data.PremiumUntil > 0,
+		QuotaUsed: data.LimitUsed,
+	}
+	if data.PremiumUntil > 0 {
+		account.Expiration = engine.ExpiresAt(time.Unix(data.PremiumUntil, 0))
+	}
+	return account, nil
+}
+
+func (pm *Premiumize) GetDownloadUncached() bool {
+	return pm.DownloadUncached
+}
+
+func New(dc config.Debrid, cache *cache.Cache) *Premiumize {
+	rl := request.ParseRateLimit(dc.RateLimit)
+	keys := engine.NewKeyRing(dc.GetAPIKeys(), func(token string) *request.RLHTTPClient {
+		client := request.NewRLHTTPClient(rl, nil)
+		client.Retry = request.ParseRetryPolicy(dc.Retry)
+		return client
+	})
+	return &Premiumize{
+		Name:             "premiumize",
+		Host:             dc.Host,
+		APIKey:           dc.APIKey,
+		DownloadUncached: dc.DownloadUncached,
+		keys:             keys,
+		cache:            cache,
+		MountPath:        dc.Folder,
+		logger:           logger.NewLogger(dc.Name, config.GetConfig().LogLevel, os.Stdout),
+		CheckCached:      dc.CheckCached,
+	}
+}
@@ -0,0 +1,69 @@
+package premiumize
+
+type APIResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+type CacheCheckResponse struct {
+	APIResponse
+	Response   []bool   `json:"response"`
+	Transcoded []bool   `json:"transcoded"`
+	Filename   []string `json:"filename"`
+	Filesize   []any    `json:"filesize"`
+}
+
+type TransferCreateResponse struct {
+	APIResponse
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type Transfer struct {
+	Id       string  `json:"id"`
+	Name     string  `json:"name"`
+	Message  string  `json:"message"`
+	Status   string  `json:"status"`
+	Progress float64 `json:"progress"`
+	Src      string  `json:"src"`
+	FolderId string  `json:"folder_id"`
+	FileId   string  `json:"file_id"`
+}
+
+type TransferListResponse struct {
+	APIResponse
+	Transfers []Transfer `json:"transfers"`
+}
+
+type Item struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Size       int64  `json:"size"`
+	CreatedAt  int64  `json:"created_at"`
+	MimeType   string `json:"mime_type"`
+	Link       string `json:"link"`
+	StreamLink string `json:"stream_link"`
+}
+
+type FolderListResponse struct {
+	APIResponse
+	Content  []Item `json:"content"`
+	Name     string `json:"name"`
+	ParentId string `json:"parent_id"`
+	FolderId string `json:"folder_id"`
+}
+
+type ItemDetailsResponse struct {
+	Item
+	FolderId string `json:"folder_id"`
+}
+
+type AccountInfoResponse struct {
+	APIResponse
+	CustomerId   string  `json:"customer_id"`
+	PremiumUntil int64   `json:"premium_until"`
+	LimitUsed    float64 `json:"limit_used"` // Fraction of the fair use limit
+	SpaceUsed    float64 `json:"space_used"`
+}
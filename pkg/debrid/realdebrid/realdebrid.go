@@ -1,6 +1,8 @@
 package realdebrid
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/rs/zerolog"
@@ -9,6 +11,7 @@ import (
 	"github.com/sirrobot01/debrid-blackhole/internal/logger"
 	"github.com/sirrobot01/debrid-blackhole/internal/request"
 	"github.com/sirrobot01/debrid-blackhole/internal/utils"
+	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/engine"
 	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/torrent"
 	"net/http"
 	gourl "net/url"
@@ -17,6 +20,7 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type RealDebrid struct {
@@ -24,7 +28,7 @@ type RealDebrid struct {
 	Host             string `json:"host"`
 	APIKey           string
 	DownloadUncached bool
-	client           *request.RLHTTPClient
+	keys             *engine.KeyRing
 	cache            *cache.Cache
 	MountPath        string
 	logger           zerolog.Logger
@@ -39,62 +43,41 @@ func (r *RealDebrid) GetLogger() zerolog.Logger {
 	return r.logger
 }
 
-// GetTorrentFiles returns a list of torrent files from the torrent info
-// validate is used to determine if the files should be validated
-// if validate is false, selected files will be returned
-func GetTorrentFiles(data TorrentInfo, validate bool) []torrent.File {
-	files := make([]torrent.File, 0)
-	cfg := config.GetConfig()
+// GetTorrentFiles returns the torrent files from the torrent info,
+// split into the files selected on RealDebrid and the others. Links are only set on selected files
+func GetTorrentFiles(data TorrentInfo) (selected []torrent.File, unselected []torrent.File) {
 	idx := 0
 	for _, f := range data.Files {
-
 		name := filepath.Base(f.Path)
-
-		if validate {
-			if utils.RegexMatch(utils.SAMPLEMATCH, name) {
-				// Skip sample files
-				continue
-			}
-			if !cfg.IsAllowedFile(name) {
-				continue
-			}
-			if !cfg.IsSizeAllowed(f.Bytes) {
-				continue
-			}
-		} else {
-			if f.Selected == 0 {
-				continue
-			}
-		}
-
-		fileId := f.ID
-		_link := ""
-		if len(data.Links) > idx {
-			_link = data.Links[idx]
-		}
 		file := torrent.File{
 			Name: name,
 			Path: name,
 			Size: f.Bytes,
-			Id:   strconv.Itoa(fileId),
-			Link: _link,
+			Id:   strconv.Itoa(f.ID),
 		}
-		files = append(files, file)
+		if f.Selected == 0 {
+			unselected = append(unselected, file)
+			continue
+		}
+		if len(data.Links) > idx {
+			file.Link = data.Links[idx]
+		}
+		selected = append(selected, file)
 		idx++
 	}
-	return files
+	return selected, unselected
 }
 
-func (r *RealDebrid) IsAvailable(infohashes []string) map[string]bool {
+func (r *RealDebrid) IsAvailable(ctx context.Context, infohashes []string) (map[string]bool, error) {
 	// Check if the infohashes are available in the local cache
 	hashes, result := torrent.GetLocalCache(infohashes, r.cache)
 
 	if len(hashes) == 0 {
-		// Either all the infohashes are locally cached or none are
-		r.cache.AddMultiple(result)
-		return result
+		// All the infohashes are in the local cache
+		return result, nil
 	}
 
+	checked := make(map[string]bool, len(hashes))
 	// Divide hashes into groups of 100
 	for i := 0; i < len(hashes); i += 200 {
 		end := i + 200
@@ -117,53 +100,63 @@ func (r *RealDebrid) IsAvailable(infohashes []string) map[string]bool {
 
 		hashStr := strings.Join(validHashes, "/")
 		url := fmt.Sprintf("%s/torrents/instantAvailability/%s", r.Host, hashStr)
-		req, _ := http.NewRequest(http.MethodGet, url, nil)
-		resp, err := r.client.MakeRequest(req)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		resp, err := r.keys.Current().MakeRequest(req)
 		if err != nil {
-			r.logger.Info().Msgf("Error checking availability: %v", err)
-			return result
+			return result, fmt.Errorf("error checking availability: %w", err)
 		}
 		var data AvailabilityResponse
 		err = json.Unmarshal(resp, &data)
 		if err != nil {
-			r.logger.Info().Msgf("Error marshalling availability: %v", err)
-			return result
+			return result, fmt.Errorf("error reading availability: %w", err)
 		}
-		for _, h := range hashes[i:end] {
+		for _, h := range validHashes {
 			hosters, exists := data[strings.ToLower(h)]
-			if exists && len(hosters.Rd) > 0 {
-				result[h] = true
-			}
+			result[h] = exists && len(hosters.Rd) > 0
+			checked[h] = result[h]
 		}
 	}
-	r.cache.AddMultiple(result) // Add the results to the cache
-	return result
+	r.cache.AddMultiple(checked) // Add the results, cached or not, to the cache
+	return result, nil
 }
 
-func (r *RealDebrid) SubmitMagnet(t *torrent.Torrent) (*torrent.Torrent, error) {
-	url := fmt.Sprintf("%s/torrents/addMagnet", r.Host)
-	payload := gourl.Values{
-		"magnet": {t.Magnet.Link},
-	}
+func (r *RealDebrid) SubmitMagnet(ctx context.Context, t *torrent.Torrent) (*torrent.Torrent, error) {
 	var data AddMagnetSchema
-	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(payload.Encode()))
-	resp, err := r.client.MakeRequest(req)
+	key, err := r.keys.Submit(func(key *engine.Key) error {
+		var req *http.Request
+		if t.Magnet.IsTorrentFile() {
+			// Upload the .torrent so trackers and the file list are kept.
+			// Every upload adds a torrent, so a failed one isn't sent again
+			url := fmt.Sprintf("%s/torrents/addTorrent", r.Host)
+			req, _ = http.NewRequestWithContext(request.WithoutRetry(ctx), http.MethodPut, url, bytes.NewReader(t.Magnet.File))
+			req.Header.Set("Content-Type", "application/x-bittorrent")
+		} else {
+			url := fmt.Sprintf("%s/torrents/addMagnet", r.Host)
+			payload := gourl.Values{
+				"magnet": {t.Magnet.Link},
+			}
+			req, _ = http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(payload.Encode()))
+		}
+		resp, err := key.MakeRequest(req)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(resp, &data)
+	})
 	if err != nil {
 		return nil, err
 	}
-	if err = json.Unmarshal(resp, &data); err != nil {
-		return nil, err
-	}
 	t.Id = data.Id
+	t.KeyId = key.Id
 	t.Debrid = r.Name
 	t.MountPath = r.MountPath
 	return t, nil
 }
 
-func (r *RealDebrid) GetTorrent(t *torrent.Torrent) (*torrent.Torrent, error) {
+func (r *RealDebrid) GetTorrent(ctx context.Context, t *torrent.Torrent) (*torrent.Torrent, error) {
 	url := fmt.Sprintf("%s/torrents/info/%s", r.Host, t.Id)
-	req, _ := http.NewRequest(http.MethodGet, url, nil)
-	resp, err := r.client.MakeRequest(req)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := r.keys.Get(t.KeyId).MakeRequest(req)
 	if err != nil {
 		return t, err
 	}
@@ -186,16 +179,15 @@ func (r *RealDebrid) GetTorrent(t *torrent.Torrent) (*torrent.Torrent, error) {
 	t.MountPath = r.MountPath
 	t.Debrid = r.Name
 	t.DownloadLinks = make(map[string]torrent.DownloadLinks)
-	files := GetTorrentFiles(data, false) // Get selected files
-	t.Files = files
+	t.Files, t.SkippedFiles = GetTorrentFiles(data)
 	return t, nil
 }
 
-func (r *RealDebrid) CheckStatus(t *torrent.Torrent, isSymlink bool) (*torrent.Torrent, error) {
+func (r *RealDebrid) CheckStatus(ctx context.Context, t *torrent.Torrent, isSymlink bool) (*torrent.Torrent, error) {
 	url := fmt.Sprintf("%s/torrents/info/%s", r.Host, t.Id)
-	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	for {
-		resp, err := r.client.MakeRequest(req)
+		resp, err := r.keys.Get(t.KeyId).MakeRequest(req)
 		if err != nil {
 			r.logger.Info().Msgf("ERROR Checking file: %v", err)
 			return t, err
@@ -219,30 +211,19 @@ func (r *RealDebrid) CheckStatus(t *torrent.Torrent, isSymlink bool) (*torrent.T
 		t.Debrid = r.Name
 		t.MountPath = r.MountPath
 		if status == "waiting_files_selection" {
-			files := GetTorrentFiles(data, true) // Validate files to be selected
-			t.Files = files
-			if len(files) == 0 {
+			selected, unselected := GetTorrentFiles(data)
+			t.SelectFiles(append(selected, unselected...)) // Pick the files with the selection profile
+			if len(t.Files) == 0 {
 				return t, fmt.Errorf("no video files found")
 			}
-			filesId := make([]string, 0)
-			for _, f := range files {
-				filesId = append(filesId, f.Id)
-			}
-			p := gourl.Values{
-				"files": {strings.Join(filesId, ",")},
-			}
-			payload := strings.NewReader(p.Encode())
-			req, _ := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/torrents/selectFiles/%s", r.Host, t.Id), payload)
-			_, err = r.client.MakeRequest(req)
-			if err != nil {
+			if err = r.selectFiles(ctx, t); err != nil {
 				return t, err
 			}
 		} else if status == "downloaded" {
-			files := GetTorrentFiles(data, false) // Get selected files
-			t.Files = files
+			t.Files, t.SkippedFiles = GetTorrentFiles(data)
 			r.logger.Info().Msgf("Torrent: %s downloaded to RD", t.Name)
 			if !isSymlink {
-				err = r.GetDownloadLinks(t)
+				err = r.GetDownloadLinks(ctx, t)
 				if err != nil {
 					return t, err
 				}
@@ -261,10 +242,91 @@ func (r *RealDebrid) CheckStatus(t *torrent.Torrent, isSymlink bool) (*torrent.T
 	return t, nil
 }
 
-func (r *RealDebrid) DeleteTorrent(torrent *torrent.Torrent) {
+func (r *RealDebrid) selectFiles(ctx context.Context, t *torrent.Torrent) error {
+	filesId := make([]string, 0)
+	for _, f := range t.Files {
+		filesId = append(filesId, f.Id)
+	}
+	p := gourl.Values{
+		"files": {strings.Join(filesId, ",")},
+	}
+	payload := strings.NewReader(p.Encode())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/torrents/selectFiles/%s", r.Host, t.Id), payload)
+	_, err := r.keys.Get(t.KeyId).MakeRequest(req)
+	return err
+}
+
+// SelectTorrentFiles applies a new file selection. Real Debrid only lets files be selected once,
+// so a torrent past the selection is added again with the new files and the old one is removed.
+// The id and key of t only change, under t.Mu, once the new torrent has its files. On failure t is left as is
+func (r *RealDebrid) SelectTorrentFiles(ctx context.Context, t *torrent.Torrent) (*torrent.Torrent, error) {
+	t.Mu.Lock()
+	added := &torrent.Torrent{Name: t.Name, Magnet: t.Magnet, Files: slices.Clone(t.Files)}
+	status := t.Status
+	t.Mu.Unlock()
+	if len(added.Files) == 0 {
+		return t, fmt.Errorf("no files selected")
+	}
+	if status == "waiting_files_selection" {
+		return t, r.selectFiles(ctx, t)
+	}
+	if added.Magnet == nil {
+		return t, fmt.Errorf("torrent: %s has no magnet", t.Name)
+	}
+	if _, err := r.SubmitMagnet(ctx, added); err != nil {
+		return t, err
+	}
+	err := r.waitForSelection(ctx, added)
+	if err == nil {
+		err = r.selectFiles(ctx, added)
+	}
+	if err != nil {
+		r.DeleteTorrent(context.WithoutCancel(ctx), added)
+		return t, err
+	}
+	t.Mu.Lock()
+	old := &torrent.Torrent{Id: t.Id, KeyId: t.KeyId, Name: t.Name}
+	t.Id, t.KeyId = added.Id, added.KeyId
+	t.Mu.Unlock()
+	if old.Id != added.Id {
+		r.DeleteTorrent(context.WithoutCancel(ctx), old)
+	}
+	return t, nil
+}
+
+// waitForSelection waits for a newly added magnet to be converted
+func (r *RealDebrid) waitForSelection(ctx context.Context, t *torrent.Torrent) error {
+	url := fmt.Sprintf("%s/torrents/info/%s", r.Host, t.Id)
+	for range 30 {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		resp, err := r.keys.Get(t.KeyId).MakeRequest(req)
+		if err != nil {
+			return err
+		}
+		var data TorrentInfo
+		if err = json.Unmarshal(resp, &data); err != nil {
+			return err
+		}
+		switch data.Status {
+		case "waiting_files_selection":
+			return nil
+		case "magnet_conversion", "queued":
+		default:
+			return fmt.Errorf("torrent: %s has status %s", t.Name, data.Status)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+	return fmt.Errorf("torrent: %s is still converting", t.Name)
+}
+
+func (r *RealDebrid) DeleteTorrent(ctx context.Context, torrent *torrent.Torrent) {
 	url := fmt.Sprintf("%s/torrents/delete/%s", r.Host, torrent.Id)
-	req, _ := http.NewRequest(http.MethodDelete, url, nil)
-	_, err := r.client.MakeRequest(req)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
+	_, err := r.keys.Get(torrent.KeyId).MakeRequest(req)
 	if err == nil {
 		r.logger.Info().Msgf("Torrent: %s deleted", torrent.Name)
 	} else {
@@ -272,7 +334,7 @@ func (r *RealDebrid) DeleteTorrent(torrent *torrent.Torrent) {
 	}
 }
 
-func (r *RealDebrid) GetDownloadLinks(t *torrent.Torrent) error {
+func (r *RealDebrid) GetDownloadLinks(ctx context.Context, t *torrent.Torrent) error {
 	url := fmt.Sprintf("%s/unrestrict/link/", r.Host)
 	downloadLinks := make(map[string]torrent.DownloadLinks)
 	for _, f := range t.Files {
@@ -283,8 +345,8 @@ func (r *RealDebrid) GetDownloadLinks(t *torrent.Torrent) error {
 		payload := gourl.Values{
 			"link": {f.Link},
 		}
-		req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(payload.Encode()))
-		resp, err := r.client.MakeRequest(req)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(payload.Encode()))
+		resp, err := r.keys.Get(t.KeyId).MakeRequest(req)
 		if err != nil {
 			return err
 		}
@@ -303,13 +365,13 @@ func (r *RealDebrid) GetDownloadLinks(t *torrent.Torrent) error {
 	return nil
 }
 
-func (r *RealDebrid) GetDownloadLink(t *torrent.Torrent, file *torrent.File) *torrent.DownloadLinks {
+func (r *RealDebrid) GetDownloadLink(ctx context.Context, t *torrent.Torrent, file *torrent.File) *torrent.DownloadLinks {
 	url := fmt.Sprintf("%s/unrestrict/link/", r.Host)
 	payload := gourl.Values{
 		"link": {file.Link},
 	}
-	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(payload.Encode()))
-	resp, err := r.client.MakeRequest(req)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(payload.Encode()))
+	resp, err := r.keys.Get(t.KeyId).MakeRequest(req)
 	if err != nil {
 		return nil
 	}
@@ -328,16 +390,20 @@ func (r *RealDebrid) GetCheckCached() bool {
 	return r.CheckCached
 }
 
-func (r *RealDebrid) getTorrents(offset int, limit int) ([]*torrent.Torrent, error) {
+func (r *RealDebrid) getTorrents(ctx context.Context, key *engine.Key, offset int, limit int) ([]*torrent.Torrent, error) {
 	url := fmt.Sprintf("%s/torrents?limit=%d", r.Host, limit)
 	if offset > 0 {
 		url = fmt.Sprintf("%s&offset=%d", url, offset)
 	}
-	req, _ := http.NewRequest(http.MethodGet, url, nil)
-	resp, err := r.client.MakeRequest(req)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := key.MakeRequest(req)
 	if err != nil {
 		return nil, err
 	}
+	if len(bytes.TrimSpace(resp)) == 0 {
+		// 204 No Content past the last page
+		return nil, nil
+	}
 	var data []TorrentsResponse
 	if err = json.Unmarshal(resp, &data); err != nil {
 		return nil, err
@@ -354,50 +420,97 @@ func (r *RealDebrid) getTorrents(offset int, limit int) ([]*torrent.Torrent, err
 			Filename:         t.Filename,
 			OriginalFilename: t.Filename,
 			Links:            t.Links,
+			KeyId:            key.Id,
 		})
 	}
 	return torrents, nil
 }
 
-func (r *RealDebrid) GetTorrents() ([]*torrent.Torrent, error) {
+func (r *RealDebrid) GetTorrents(ctx context.Context) ([]*torrent.Torrent, error) {
 	torrents := make([]*torrent.Torrent, 0)
-	offset := 0
 	limit := 5000
-	for {
-		ts, err := r.getTorrents(offset, limit)
-		if err != nil {
-			break
-		}
-		if len(ts) == 0 {
-			break
+	for _, key := range r.keys.Keys() {
+		offset := 0
+		for {
+			ts, err := r.getTorrents(ctx, key, offset, limit)
+			if err != nil {
+				// A partial list would make the missing torrents look removed
+				return nil, fmt.Errorf("error listing torrents at offset %d: %w", offset, err)
+			}
+			torrents = append(torrents, ts...)
+			if len(ts) < limit {
+				break
+			}
+			offset += len(ts)
 		}
-		torrents = append(torrents, ts...)
-		offset = len(torrents)
 	}
 	return torrents, nil
-
 }
 
 func (r *RealDebrid) GetDownloadingStatus() []string {
 	return []string{"downloading", "magnet_conversion", "queued", "compressing", "uploading"}
 }
 
+// AccountInfo combines the accounts of all the API keys
+func (r *RealDebrid) AccountInfo(ctx context.Context) (*engine.Account, error) {
+	return r.keys.Account(ctx, r.accountInfo)
+}
+
+func (r *RealDebrid) KeyUsage() []engine.KeyUsage {
+	return r.keys.Usage()
+}
+
+func (r *RealDebrid) accountInfo(ctx context.Context, key *engine.Key) (*engine.Account, error) {
+	url := fmt.Sprintf("%s/user", r.Host)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := key.MakeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var user UserResponse
+	if err = json.Unmarshal(resp, &user); err != nil {
+		return nil, err
+	}
+
+	url = fmt.Sprintf("%s/torrents/activeCount", r.Host)
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err = key.MakeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var active ActiveCountResponse
+	if err = json.Unmarshal(resp, &active); err != nil {
+		return nil, err
+	}
+	return &engine.Account{
+		Username:    user.Username,
+		Premium:     user.Type == "premium",
+		Expiration:  engine.ExpiresAt(user.Expiration),
+		ActiveSlots: active.Nb,
+		MaxSlots:    active.Limit,
+	}, nil
+}
+
 func (r *RealDebrid) GetDownloadUncached() bool {
 	return r.DownloadUncached
 }
 
 func New(dc config.Debrid, cache *cache.Cache) *RealDebrid {
-	rl := request.ParseRateLimit(dc.RateLimit)
-	headers := map[string]string{
-		"Authorization": fmt.Sprintf("Bearer %s", dc.APIKey),
-	}
-	client := request.NewRLHTTPClient(rl, headers)
+	// Each key gets its own rate limiter, RealDebrid limits per token
+	keys := engine.NewKeyRing(dc.GetAPIKeys(), func(token string) *request.RLHTTPClient {
+		headers := map[string]string{
+			"Authorization": fmt.Sprintf("Bearer %s", token),
+		}
+		client := request.NewRLHTTPClient(request.ParseRateLimit(dc.RateLimit), headers)
+		client.Retry = request.ParseRetryPolicy(dc.Retry)
+		return client
+	})
 	return &RealDebrid{
 		Name:             "realdebrid",
 		Host:             dc.Host,
 		APIKey:           dc.APIKey,
 		DownloadUncached: dc.DownloadUncached,
-		client:           client,
+		keys:             keys,
 		cache:            cache,
 		MountPath:        dc.Folder,
 		logger:           logger.NewLogger(dc.Name, config.GetConfig().LogLevel, os.Stdout),
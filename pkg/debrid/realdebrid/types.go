@@ -120,3 +120,18 @@ type TorrentsResponse struct {
 	Links    []string  `json:"links"`
 	Ended    time.Time `json:"ended"`
 }
+
+type UserResponse struct {
+	Id         int       `json:"id"`
+	Username   string    `json:"username"`
+	Email      string    `json:"email"`
+	Points     int       `json:"points"`
+	Type       string    `json:"type"`
+	Premium    int       `json:"premium"` // Seconds left
+	Expiration time.Time `json:"expiration"`
+}
+
+type ActiveCountResponse struct {
+	Nb    int `json:"nb"`
+	Limit int `json:"limit"`
+}
@@ -2,6 +2,7 @@ package torbox
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/rs/zerolog"
@@ -9,7 +10,7 @@ import (
 	"github.com/sirrobot01/debrid-blackhole/internal/config"
 	"github.com/sirrobot01/debrid-blackhole/internal/logger"
 	"github.com/sirrobot01/debrid-blackhole/internal/request"
-	"github.com/sirrobot01/debrid-blackhole/internal/utils"
+	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/engine"
 	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/torrent"
 
 	"mime/multipart"
@@ -28,7 +29,7 @@ type Torbox struct {
 	Host             string `json:"host"`
 	APIKey           string
 	DownloadUncached bool
-	client           *request.RLHTTPClient
+	keys             *engine.KeyRing
 	cache            *cache.Cache
 	MountPath        string
 	logger           zerolog.Logger
@@ -43,16 +44,16 @@ func (tb *Torbox) GetLogger() zerolog.Logger {
 	return tb.logger
 }
 
-func (tb *Torbox) IsAvailable(infohashes []string) map[string]bool {
+func (tb *Torbox) IsAvailable(ctx context.Context, infohashes []string) (map[string]bool, error) {
 	// Check if the infohashes are available in the local cache
 	hashes, result := torrent.GetLocalCache(infohashes, tb.cache)
 
 	if len(hashes) == 0 {
-		// Either all the infohashes are locally cached or none are
-		tb.cache.AddMultiple(result)
-		return result
+		// All the infohashes are in the local cache
+		return result, nil
 	}
 
+	checked := make(map[string]bool, len(hashes))
 	// Divide hashes into groups of 100
 	for i := 0; i < len(hashes); i += 100 {
 		end := i + 100
@@ -75,49 +76,62 @@ func (tb *Torbox) IsAvailable(infohashes []string) map[string]bool {
 
 		hashStr := strings.Join(validHashes, ",")
 		url := fmt.Sprintf("%s/api/torrents/checkcached?hash=%s", tb.Host, hashStr)
-		req, _ := http.NewRequest(http.MethodGet, url, nil)
-		resp, err := tb.client.MakeRequest(req)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		resp, err := tb.keys.Current().MakeRequest(req)
 		if err != nil {
-			tb.logger.Info().Msgf("Error checking availability: %v", err)
-			return result
+			return result, fmt.Errorf("error checking availability: %w", err)
 		}
 		var res AvailableResponse
 		err = json.Unmarshal(resp, &res)
 		if err != nil {
-			tb.logger.Info().Msgf("Error marshalling availability: %v", err)
-			return result
+			return result, fmt.Errorf("error reading availability: %w", err)
 		}
 		if res.Data == nil {
-			return result
+			return result, nil
 		}
 
+		available := make(map[string]bool, len(*res.Data))
 		for h, cache := range *res.Data {
-			if cache.Size > 0 {
-				result[strings.ToUpper(h)] = true
-			}
+			available[strings.ToLower(h)] = cache.Size > 0
+		}
+		for _, h := range validHashes {
+			result[h] = available[strings.ToLower(h)]
+			checked[h] = result[h]
 		}
 	}
-	tb.cache.AddMultiple(result) // Add the results to the cache
-	return result
+	tb.cache.AddMultiple(checked) // Add the results, cached or not, to the cache
+	return result, nil
 }
 
-func (tb *Torbox) SubmitMagnet(torrent *torrent.Torrent) (*torrent.Torrent, error) {
+func (tb *Torbox) SubmitMagnet(ctx context.Context, torrent *torrent.Torrent) (*torrent.Torrent, error) {
 	url := fmt.Sprintf("%s/api/torrents/createtorrent", tb.Host)
 	payload := &bytes.Buffer{}
 	writer := multipart.NewWriter(payload)
-	_ = writer.WriteField("magnet", torrent.Magnet.Link)
-	err := writer.Close()
-	if err != nil {
-		return nil, err
+	if torrent.Magnet.IsTorrentFile() {
+		part, err := writer.CreateFormFile("file", torrent.Name+".torrent")
+		if err != nil {
+			return nil, err
+		}
+		if _, err = part.Write(torrent.Magnet.File); err != nil {
+			return nil, err
+		}
+	} else {
+		_ = writer.WriteField("magnet", torrent.Magnet.Link)
 	}
-	req, _ := http.NewRequest(http.MethodPost, url, payload)
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	resp, err := tb.client.MakeRequest(req)
+	err := writer.Close()
 	if err != nil {
 		return nil, err
 	}
 	var data AddMagnetResponse
-	err = json.Unmarshal(resp, &data)
+	key, err := tb.keys.Submit(func(key *engine.Key) error {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload.Bytes()))
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		resp, err := key.MakeRequest(req)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(resp, &data)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -127,6 +141,7 @@ func (tb *Torbox) SubmitMagnet(torrent *torrent.Torrent) (*torrent.Torrent, erro
 	dt := *data.Data
 	torrentId := strconv.Itoa(dt.Id)
 	torrent.Id = torrentId
+	torrent.KeyId = key.Id
 	torrent.MountPath = tb.MountPath
 	torrent.Debrid = tb.Name
 
@@ -149,10 +164,10 @@ func getTorboxStatus(status string, finished bool) string {
 	}
 }
 
-func (tb *Torbox) GetTorrent(t *torrent.Torrent) (*torrent.Torrent, error) {
+func (tb *Torbox) GetTorrent(ctx context.Context, t *torrent.Torrent) (*torrent.Torrent, error) {
 	url := fmt.Sprintf("%s/api/torrents/mylist/?id=%s", tb.Host, t.Id)
-	req, _ := http.NewRequest(http.MethodGet, url, nil)
-	resp, err := tb.client.MakeRequest(req)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := tb.keys.Get(t.KeyId).MakeRequest(req)
 	if err != nil {
 		return t, err
 	}
@@ -176,20 +191,8 @@ func (tb *Torbox) GetTorrent(t *torrent.Torrent) (*torrent.Torrent, error) {
 	t.Debrid = tb.Name
 	t.DownloadLinks = make(map[string]torrent.DownloadLinks)
 	files := make([]torrent.File, 0)
-	cfg := config.GetConfig()
 	for _, f := range data.Files {
 		fileName := filepath.Base(f.Name)
-		if utils.IsSampleFile(fileName) {
-			// Skip sample files
-			continue
-		}
-		if !cfg.IsAllowedFile(fileName) {
-			continue
-		}
-
-		if !cfg.IsSizeAllowed(f.Size) {
-			continue
-		}
 		file := torrent.File{
 			Id:   strconv.Itoa(f.Id),
 			Name: fileName,
@@ -206,14 +209,14 @@ func (tb *Torbox) GetTorrent(t *torrent.Torrent) (*torrent.Torrent, error) {
 	}
 
 	t.OriginalFilename = strings.Split(cleanPath, "/")[0]
-	t.Files = files
+	t.SelectFiles(files)
 	//t.Debrid = tb
 	return t, nil
 }
 
-func (tb *Torbox) CheckStatus(torrent *torrent.Torrent, isSymlink bool) (*torrent.Torrent, error) {
+func (tb *Torbox) CheckStatus(ctx context.Context, torrent *torrent.Torrent, isSymlink bool) (*torrent.Torrent, error) {
 	for {
-		t, err := tb.GetTorrent(torrent)
+		t, err := tb.GetTorrent(ctx, torrent)
 
 		torrent = t
 
@@ -224,7 +227,7 @@ func (tb *Torbox) CheckStatus(torrent *torrent.Torrent, isSymlink bool) (*torren
 		if status == "downloaded" {
 			tb.logger.Info().Msgf("Torrent: %s downloaded", torrent.Name)
 			if !isSymlink {
-				err = tb.GetDownloadLinks(torrent)
+				err = tb.GetDownloadLinks(ctx, torrent)
 				if err != nil {
 					return torrent, err
 				}
@@ -245,12 +248,12 @@ func (tb *Torbox) CheckStatus(torrent *torrent.Torrent, isSymlink bool) (*torren
 	return torrent, nil
 }
 
-func (tb *Torbox) DeleteTorrent(torrent *torrent.Torrent) {
+func (tb *Torbox) DeleteTorrent(ctx context.Context, torrent *torrent.Torrent) {
 	url := fmt.Sprintf("%s/api/torrents/controltorrent/%s", tb.Host, torrent.Id)
 	payload := map[string]string{"torrent_id": torrent.Id, "action": "Delete"}
 	jsonPayload, _ := json.Marshal(payload)
-	req, _ := http.NewRequest(http.MethodDelete, url, bytes.NewBuffer(jsonPayload))
-	_, err := tb.client.MakeRequest(req)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodDelete, url, bytes.NewBuffer(jsonPayload))
+	_, err := tb.keys.Get(torrent.KeyId).MakeRequest(req)
 	if err == nil {
 		tb.logger.Info().Msgf("Torrent: %s deleted", torrent.Name)
 	} else {
@@ -258,17 +261,18 @@ func (tb *Torbox) DeleteTorrent(torrent *torrent.Torrent) {
 	}
 }
 
-func (tb *Torbox) GetDownloadLinks(t *torrent.Torrent) error {
+func (tb *Torbox) GetDownloadLinks(ctx context.Context, t *torrent.Torrent) error {
 	downloadLinks := make(map[string]torrent.DownloadLinks)
+	key := tb.keys.Get(t.KeyId)
 	for _, file := range t.Files {
 		url := fmt.Sprintf("%s/api/torrents/requestdl/", tb.Host)
 		query := gourl.Values{}
 		query.Add("torrent_id", t.Id)
-		query.Add("token", tb.APIKey)
+		query.Add("token", key.Token())
 		query.Add("file_id", file.Id)
 		url += "?" + query.Encode()
-		req, _ := http.NewRequest(http.MethodGet, url, nil)
-		resp, err := tb.client.MakeRequest(req)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		resp, err := key.MakeRequest(req)
 		if err != nil {
 			return err
 		}
@@ -293,15 +297,16 @@ func (tb *Torbox) GetDownloadLinks(t *torrent.Torrent) error {
 	return nil
 }
 
-func (tb *Torbox) GetDownloadLink(t *torrent.Torrent, file *torrent.File) *torrent.DownloadLinks {
+func (tb *Torbox) GetDownloadLink(ctx context.Context, t *torrent.Torrent, file *torrent.File) *torrent.DownloadLinks {
 	url := fmt.Sprintf("%s/api/torrents/requestdl/", tb.Host)
+	key := tb.keys.Get(t.KeyId)
 	query := gourl.Values{}
 	query.Add("torrent_id", t.Id)
-	query.Add("token", tb.APIKey)
+	query.Add("token", key.Token())
 	query.Add("file_id", file.Id)
 	url += "?" + query.Encode()
-	req, _ := http.NewRequest(http.MethodGet, url, nil)
-	resp, err := tb.client.MakeRequest(req)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := key.MakeRequest(req)
 	if err != nil {
 		return nil
 	}
@@ -328,8 +333,102 @@ func (tb *Torbox) GetCheckCached() bool {
 	return tb.CheckCached
 }
 
-func (tb *Torbox) GetTorrents() ([]*torrent.Torrent, error) {
-	return nil, fmt.Errorf("not implemented")
+func (tb *Torbox) GetTorrents(ctx context.Context) ([]*torrent.Torrent, error) {
+	torrents := make([]*torrent.Torrent, 0)
+	for _, key := range tb.keys.Keys() {
+		ts, err := tb.getTorrents(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		torrents = append(torrents, ts...)
+	}
+	return torrents, nil
+}
+
+func (tb *Torbox) getTorrents(ctx context.Context, key *engine.Key) ([]*torrent.Torrent, error) {
+	url := fmt.Sprintf("%s/api/torrents/mylist", tb.Host)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := key.MakeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var res ListResponse
+	if err = json.Unmarshal(resp, &res); err != nil {
+		return nil, err
+	}
+	if res.Data == nil {
+		return nil, fmt.Errorf("error listing torrents: %s", res.Detail)
+	}
+	torrents := make([]*torrent.Torrent, 0, len(*res.Data))
+	for _, data := range *res.Data {
+		torrents = append(torrents, &torrent.Torrent{
+			Id:               strconv.Itoa(data.Id),
+			InfoHash:         data.Hash,
+			Name:             data.Name,
+			Folder:           data.Name,
+			Filename:         data.Name,
+			OriginalFilename: data.Name,
+			Bytes:            data.Size,
+			Progress:         data.Progress * 100,
+			Status:           getTorboxStatus(data.DownloadState, data.DownloadFinished),
+			Speed:            data.DownloadSpeed,
+			Seeders:          data.Seeds,
+			MountPath:        tb.MountPath,
+			Debrid:           tb.Name,
+			KeyId:            key.Id,
+		})
+	}
+	return torrents, nil
+}
+
+// AccountInfo combines the accounts of all the API keys
+func (tb *Torbox) AccountInfo(ctx context.Context) (*engine.Account, error) {
+	return tb.keys.Account(ctx, tb.accountInfo)
+}
+
+func (tb *Torbox) KeyUsage() []engine.KeyUsage {
+	return tb.keys.Usage()
+}
+
+func (tb *Torbox) accountInfo(ctx context.Context, key *engine.Key) (*engine.Account, error) {
+	url := fmt.Sprintf("%s/api/user/me", tb.Host)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err := key.MakeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var user UserResponse
+	if err = json.Unmarshal(resp, &user); err != nil {
+		return nil, err
+	}
+	if user.Data == nil {
+		return nil, fmt.Errorf("error getting account info: %s", user.Detail)
+	}
+	account := &engine.Account{
+		Username:   user.Data.Email,
+		Premium:    user.Data.Plan > 0,
+		Expiration: engine.ExpiresAt(user.Data.PremiumExpiresAt),
+		// The API doesn't report the slot limit of the plan, MaxSlots stays unknown
+	}
+
+	url = fmt.Sprintf("%s/api/torrents/mylist", tb.Host)
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	resp, err = key.MakeRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	var list ListResponse
+	if err = json.Unmarshal(resp, &list); err != nil {
+		return nil, err
+	}
+	if list.Data != nil {
+		for _, t := range *list.Data {
+			if t.Active && !t.DownloadFinished {
+				account.ActiveSlots++
+			}
+		}
+	}
+	return account, nil
 }
 
 func (tb *Torbox) GetDownloadUncached() bool {
@@ -337,17 +436,21 @@ func (tb *Torbox) GetDownloadUncached() bool {
 }
 
 func New(dc config.Debrid, cache *cache.Cache) *Torbox {
-	rl := request.ParseRateLimit(dc.RateLimit)
-	headers := map[string]string{
-		"Authorization": fmt.Sprintf("Bearer %s", dc.APIKey),
-	}
-	client := request.NewRLHTTPClient(rl, headers)
+	// Each key gets its own rate limiter, Torbox limits per token
+	keys := engine.NewKeyRing(dc.GetAPIKeys(), func(token string) *request.RLHTTPClient {
+		headers := map[string]string{
+			"Authorization": fmt.Sprintf("Bearer %s", token),
+		}
+		client := request.NewRLHTTPClient(request.ParseRateLimit(dc.RateLimit), headers)
+		client.Retry = request.ParseRetryPolicy(dc.Retry)
+		return client
+	})
 	return &Torbox{
 		Name:             "torbox",
 		Host:             dc.Host,
 		APIKey:           dc.APIKey,
 		DownloadUncached: dc.DownloadUncached,
-		client:           client,
+		keys:             keys,
 		cache:            cache,
 		MountPath:        dc.Folder,
 		logger:           logger.NewLogger(dc.Name, config.GetConfig().LogLevel, os.Stdout),
@@ -73,3 +73,12 @@ type torboxInfo struct {
 type InfoResponse APIResponse[torboxInfo]
 
 type DownloadLinksResponse APIResponse[string]
+
+type UserResponse APIResponse[struct {
+	Email            string    `json:"email"`
+	Plan             int       `json:"plan"`
+	IsSubscribed     bool      `json:"is_subscribed"`
+	PremiumExpiresAt time.Time `json:"premium_expires_at"`
+}]
+
+type ListResponse APIResponse[[]torboxInfo]
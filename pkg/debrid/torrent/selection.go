@@ -0,0 +1,364 @@
+package torrent
+
+import (
+	"github.com/sirrobot01/debrid-blackhole/internal/config"
+	"github.com/sirrobot01/debrid-blackhole/internal/utils"
+	"github.com/sirrobot01/debrid-blackhole/pkg/arr"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var extrasRegex = regexp.MustCompile(`(?i)(^|[\\/ ._-])(featurettes?|extras|bonus|behind[ ._-]the[ ._-]scenes|deleted[ ._-]scenes?|interviews?|making[ ._-]of|bloopers|gag[ ._-]reels?)([\\/ ._-]|$)`)
+
+// languageTags maps the language tags found in release names to a language
+var languageTags = map[string]string{
+	"english": "english", "eng": "english",
+	"french": "french", "truefrench": "french", "vff": "french", "vfq": "french", "vostfr": "french", "fre": "french", "fra": "french",
+	"german": "german", "ger": "german", "deu": "german",
+	"spanish": "spanish", "spa": "spanish", "esp": "spanish", "castellano": "spanish", "latino": "spanish",
+	"italian": "italian", "ita": "italian",
+	"portuguese": "portuguese", "por": "portuguese", "ptbr": "portuguese",
+	"russian": "russian", "rus": "russian",
+	"dutch": "dutch", "nld": "dutch",
+	"polish": "polish", "pol": "polish",
+	"hindi": "hindi", "hin": "hindi",
+	"tamil": "tamil", "tam": "tamil",
+	"telugu": "telugu", "tel": "telugu",
+	"japanese": "japanese", "jpn": "japanese",
+	"korean": "korean", "kor": "korean",
+	"chinese": "chinese", "chi": "chinese",
+	"multi": "multi", "dual": "multi",
+}
+
+var episodeRegexes = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\bs(\d{1,2})((?:[ ._-]?e\d{1,3})+)`),
+	regexp.MustCompile(`(?i)\b(\d{1,2})x(\d{2,3})\b`),
+}
+
+var episodeNumberRegex = regexp.MustCompile(`\d+`)
+
+// fileEpisodes returns the episodes in a file name, e.g S01E02E03 or 1x02
+func fileEpisodes(path string) []arr.Episode {
+	name := filepath.Base(path)
+	for _, re := range episodeRegexes {
+		m := re.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+		season, _ := strconv.Atoi(m[1])
+		episodes := make([]arr.Episode, 0)
+		for _, n := range episodeNumberRegex.FindAllString(m[2], -1) {
+			number, _ := strconv.Atoi(n)
+			episodes = append(episodes, arr.Episode{SeasonNumber: season, EpisodeNumber: number})
+		}
+		return episodes
+	}
+	return nil
+}
+
+var tokenSplitter = regexp.MustCompile(`[^a-zA-Z0-9]+`)
+
+// fileLanguages returns the languages tagged in a file path
+func fileLanguages(path string) []string {
+	langs := make([]string, 0)
+	for _, token := range tokenSplitter.Split(strings.ToLower(path), -1) {
+		if lang, ok := languageTags[token]; ok && !slices.Contains(langs, lang) {
+			langs = append(langs, lang)
+		}
+	}
+	return langs
+}
+
+// Selector picks the files of a torrent according to a selection profile
+type Selector struct {
+	profile   config.SelectionProfile
+	include   []*regexp.Regexp
+	exclude   []*regexp.Regexp
+	languages []string
+	minSize   int64
+	maxSize   int64
+}
+
+func NewSelector(profile config.SelectionProfile) *Selector {
+	s := &Selector{
+		profile: profile,
+		minSize: profile.GetMinFileSize(),
+		maxSize: profile.GetMaxFileSize(),
+	}
+	// Regexes are validated with the config
+	for _, expr := range profile.Include {
+		if re, err := regexp.Compile(expr); err == nil {
+			s.include = append(s.include, re)
+		}
+	}
+	for _, expr := range profile.Exclude {
+		if re, err := regexp.Compile(expr); err == nil {
+			s.exclude = append(s.exclude, re)
+		}
+	}
+	for _, lang := range profile.Languages {
+		lang = strings.ToLower(lang)
+		if l, ok := languageTags[lang]; ok {
+			lang = l
+		}
+		s.languages = append(s.languages, lang)
+	}
+	return s
+}
+
+// GetSelector returns the selector for an arr or category name
+func GetSelector(name string) *Selector {
+	return NewSelector(config.GetConfig().GetSelectionProfile(name))
+}
+
+// Allowed reports whether a single file passes the profile, ignoring the largest only mode
+func (s *Selector) Allowed(path string, size int64) bool {
+	name := filepath.Base(path)
+	if s.profile.GetExcludeSamples() && utils.IsSampleFile(name) {
+		return false
+	}
+	if s.profile.ExcludeExtras && extrasRegex.MatchString(path) {
+		return false
+	}
+	if !isAllowedExt(name, s.profile.AllowedExt) {
+		return false
+	}
+	// A size of 0 means the debrid hasn't reported it yet
+	if size > 0 && ((s.minSize > 0 && size < s.minSize) || (s.maxSize > 0 && size > s.maxSize)) {
+		return false
+	}
+	if len(s.include) > 0 && !slices.ContainsFunc(s.include, func(re *regexp.Regexp) bool { return re.MatchString(path) }) {
+		return false
+	}
+	if slices.ContainsFunc(s.exclude, func(re *regexp.Regexp) bool { return re.MatchString(path) }) {
+		return false
+	}
+	if len(s.languages) > 0 {
+		langs := fileLanguages(path)
+		if len(langs) > 0 && !slices.ContainsFunc(langs, func(l string) bool { return slices.Contains(s.languages, l) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// Select splits the files into the ones to download and the skipped ones
+func (s *Selector) Select(files []File) (selected []File, skipped []File) {
+	selected = make([]File, 0, len(files))
+	skipped = make([]File, 0)
+	for _, f := range files {
+		if s.Allowed(f.Path, f.Size) {
+			selected = append(selected, f)
+		} else {
+			skipped = append(skipped, f)
+		}
+	}
+	if s.profile.LargestOnly && len(selected) > 1 {
+		largest := 0
+		for i, f := range selected {
+			if f.Size > selected[largest].Size {
+				largest = i
+			}
+		}
+		for i, f := range selected {
+			if i != largest {
+				skipped = append(skipped, f)
+			}
+		}
+		selected = []File{selected[largest]}
+	}
+	return selected, skipped
+}
+
+func isAllowedExt(name string, allowed []string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == "" {
+		return false
+	}
+	return slices.Contains(allowed, ext[1:])
+}
+
+// SelectFiles applies the selection profile of the torrent's arr, setting Files and SkippedFiles
+func (t *Torrent) SelectFiles(files []File) {
+	name := ""
+	if t.Arr != nil {
+		name = t.Arr.Name
+	}
+	t.Files, t.SkippedFiles = GetSelector(name).Select(files)
+	t.selectWantedEpisodes()
+	t.applyFilePriorities()
+}
+
+// SetFilePriority sets the priority of files by path, a priority of 0 skips them.
+// It reports whether the selected files changed
+func (t *Torrent) SetFilePriority(paths []string, priority int) bool {
+	if t.FilePriorities == nil {
+		t.FilePriorities = make(map[string]int)
+	}
+	for _, path := range paths {
+		t.FilePriorities[path] = priority
+	}
+	return t.applyFilePriorities()
+}
+
+// applyFilePriorities moves the files the user (de)selected. It reports whether anything moved
+func (t *Torrent) applyFilePriorities() bool {
+	if len(t.FilePriorities) == 0 {
+		return false
+	}
+	keys := t.priorityKeys()
+	selected := make([]File, 0, len(t.Files))
+	skipped := make([]File, 0, len(t.SkippedFiles))
+	changed := false
+	for _, f := range t.Files {
+		if priority, ok := t.FilePriorities[keys[f.Path]]; ok && priority == 0 {
+			skipped = append(skipped, f)
+			changed = true
+			continue
+		}
+		selected = append(selected, f)
+	}
+	for _, f := range t.SkippedFiles {
+		if priority, ok := t.FilePriorities[keys[f.Path]]; ok && priority > 0 {
+			selected = append(selected, f)
+			changed = true
+			continue
+		}
+		skipped = append(skipped, f)
+	}
+	t.Files = selected
+	t.SkippedFiles = skipped
+	return changed
+}
+
+// GetFilePriority returns the qBittorrent priority of a selected file, by its path in IndexedFiles
+func (t *Torrent) GetFilePriority(path string) int {
+	if priority, ok := t.FilePriorities[path]; ok && priority > 0 {
+		return priority
+	}
+	return 1
+}
+
+// priorityKeys maps the debrid path of the files to their key in FilePriorities: their path in the .torrent
+// if it lists them, so priorities set before the debrid resolved the files still apply
+func (t *Torrent) priorityKeys() map[string]string {
+	keys := make(map[string]string)
+	for _, file := range t.IndexedFiles() {
+		if file.File != nil {
+			keys[file.File.Path] = file.Path
+		}
+	}
+	return keys
+}
+
+// IndexedFile is a file at its qBittorrent index. File is nil until the debrid lists it
+type IndexedFile struct {
+	Path string
+	Size int64
+	File *File
+}
+
+// IndexedFiles returns the files of the torrent in a stable order, the position being the qBittorrent file index.
+// Torrents added from a .torrent keep its file order, the debrid files being matched to it by path.
+// Magnet links, whose files are only known once resolved, list the debrid files ordered by path
+func (t *Torrent) IndexedFiles() []IndexedFile {
+	files := make([]File, 0, len(t.Files)+len(t.SkippedFiles))
+	files = append(files, t.Files...)
+	files = append(files, t.SkippedFiles...)
+	slices.SortFunc(files, func(a, b File) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	indexed := make([]IndexedFile, 0, len(files))
+	matched := make([]bool, len(files))
+	if t.Magnet != nil {
+		for _, mf := range t.Magnet.Files {
+			entry := IndexedFile{Path: mf.Path, Size: mf.Size}
+			for i := range files {
+				if !matched[i] && matchesTorrentPath(mf.Path, files[i].Path) {
+					matched[i] = true
+					entry.File = &files[i]
+					break
+				}
+			}
+			indexed = append(indexed, entry)
+		}
+	}
+	// Files the .torrent doesn't list come last
+	for i := range files {
+		if !matched[i] {
+			indexed = append(indexed, IndexedFile{Path: files[i].Path, Size: files[i].Size, File: &files[i]})
+		}
+	}
+	return indexed
+}
+
+// matchesTorrentPath reports whether a debrid file path is the path of a file in the .torrent.
+// Debrids report paths relative to the torrent folder, with or without it, or only the file name
+func matchesTorrentPath(torrentPath, debridPath string) bool {
+	torrentPath = strings.TrimPrefix(filepath.ToSlash(torrentPath), "/")
+	debridPath = strings.TrimPrefix(filepath.ToSlash(debridPath), "/")
+	if torrentPath == "" || debridPath == "" {
+		return false
+	}
+	return torrentPath == debridPath ||
+		strings.HasSuffix(torrentPath, "/"+debridPath) ||
+		strings.HasSuffix(debridPath, "/"+torrentPath)
+}
+
+// GetFilePath returns the path of a file, after any rename
+func (t *Torrent) GetFilePath(f File) string {
+	if path, ok := t.Renames[f.Path]; ok {
+		return path
+	}
+	return f.Path
+}
+
+// GetFileName returns the name a file is saved under, after any rename
+func (t *Torrent) GetFileName(f File) string {
+	if path, ok := t.Renames[f.Path]; ok {
+		return filepath.Base(path)
+	}
+	return f.Name
+}
+
+// selectWantedEpisodes moves the episodes the arr doesn't need to the skipped files.
+// Files without an episode number are kept, and nothing is skipped if no file matches
+func (t *Torrent) selectWantedEpisodes() {
+	if len(t.WantedEpisodes) == 0 {
+		return
+	}
+	selected := make([]File, 0, len(t.Files))
+	skipped := make([]File, 0)
+	for _, f := range t.Files {
+		episodes := fileEpisodes(f.Path)
+		if len(episodes) == 0 || arr.Wants(t.WantedEpisodes, episodes) {
+			selected = append(selected, f)
+		} else {
+			skipped = append(skipped, f)
+		}
+	}
+	if len(selected) == 0 {
+		return
+	}
+	t.Files = selected
+	t.SkippedFiles = append(t.SkippedFiles, skipped...)
+}
+
+// SelectedSize returns the size of the files that are downloaded.
+// Debrids that can't select files report the size of the whole torrent
+func (t *Torrent) SelectedSize() int64 {
+	if len(t.SkippedFiles) == 0 {
+		return t.Bytes
+	}
+	var size int64
+	for _, f := range t.Files {
+		size += f.Size
+	}
+	if size == 0 {
+		return t.Bytes
+	}
+	return size
+}
@@ -22,6 +22,7 @@ type Torrent struct {
 	Bytes            int64                    `json:"bytes"` // Size of only the files that are downloaded
 	Magnet           *utils.Magnet            `json:"magnet"`
 	Files            []File                   `json:"files"`
+	SkippedFiles     []File                   `json:"skipped_files"` // Files left out by the selection profile
 	Status           string                   `json:"status"`
 	Added            string                   `json:"added"`
 	Progress         float64                  `json:"progress"`
@@ -32,6 +33,15 @@ type Torrent struct {
 	MountPath        string                   `json:"mount_path"`
 
 	Debrid string `json:"debrid"`
+	KeyId  string `json:"key_id"` // API key that owns the torrent on the debrid
+
+	// WantedEpisodes are the episodes of a season pack the arr is missing, other episodes are skipped
+	WantedEpisodes []arr.Episode `json:"wanted_episodes,omitempty"`
+	// FilePriorities are the qBittorrent file priorities set by the user, by the file path in the .torrent, or the
+	// debrid path of files it doesn't list. They override the selection profile
+	FilePriorities map[string]int `json:"file_priorities,omitempty"`
+	// Renames maps a file path to the path set by the user, the file is saved under its new name
+	Renames map[string]string `json:"renames,omitempty"`
 
 	Arr              *arr.Arr   `json:"arr"`
 	Mu               sync.Mutex `json:"-"`
@@ -94,29 +104,12 @@ func (t *Torrent) GetFile(id string) *File {
 	return nil
 }
 
+// GetLocalCache returns the infohashes that still need to be checked on the debrid
+// and the known availability of the others
 func GetLocalCache(infohashes []string, cache *cache.Cache) ([]string, map[string]bool) {
-	result := make(map[string]bool)
-	hashes := make([]string, 0)
-
 	if len(infohashes) == 0 {
-		return hashes, result
-	}
-	if len(infohashes) == 1 {
-		if cache.Exists(infohashes[0]) {
-			return hashes, map[string]bool{infohashes[0]: true}
-		}
-		return infohashes, result
+		return make([]string, 0), make(map[string]bool)
 	}
-
-	cachedHashes := cache.GetMultiple(infohashes)
-	for _, h := range infohashes {
-		_, exists := cachedHashes[h]
-		if !exists {
-			hashes = append(hashes, h)
-		} else {
-			result[h] = true
-		}
-	}
-
-	return infohashes, result
+	result, hashes := cache.GetMultiple(infohashes)
+	return hashes, result
 }
@@ -132,6 +132,9 @@ func (p *Proxy) ProcessResponse(resp *http.Response) *http.Response {
 	if resp == nil || resp.Body == nil {
 		return resp
 	}
+	if !p.cachedOnly {
+		return resp
+	}
 	contentType := resp.Header.Get("Content-Type")
 	switch contentType {
 	case "application/json":
@@ -227,6 +230,10 @@ func (p *Proxy) ProcessXMLResponse(resp *http.Response) *http.Response {
 	}
 
 	svc := service.GetService()
+	ctx := context.Background()
+	if resp.Request != nil {
+		ctx = resp.Request.Context()
+	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -262,7 +269,7 @@ func (p *Proxy) ProcessXMLResponse(resp *http.Response) *http.Response {
 			hashes = append(hashes, hash)
 		}
 	}
-	availableHashesMap := svc.Debrid.Get().IsAvailable(hashes)
+	availableHashesMap := svc.Debrid.IsAvailable(ctx, hashes)
 	newItems := make([]Item, 0, len(rss.Channel.Items))
 
 	if len(hashes) > 0 {
@@ -0,0 +1,97 @@
+package qbit
+
+import (
+	"context"
+	"github.com/sirrobot01/debrid-blackhole/internal/config"
+	"golang.org/x/time/rate"
+	"time"
+)
+
+// bandwidthBurst is the most bytes a download reads at once, limiters must allow it
+const bandwidthBurst = 256 << 10
+
+// newLimiter returns a limiter of limit bytes/s, 0 is unlimited
+func newLimiter(limit int64) *rate.Limiter {
+	l := rate.NewLimiter(rate.Inf, bandwidthBurst)
+	setLimit(l, limit)
+	return l
+}
+
+func setLimit(l *rate.Limiter, limit int64) {
+	if limit <= 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	l.SetLimit(rate.Limit(limit))
+}
+
+// downloadLimit returns the download limit in effect at now: the alternative limit while it's on,
+// then the first active schedule, then the global limit. speedMu must be held
+func (q *QBit) downloadLimit(now time.Time) int64 {
+	if q.altSpeedLimits {
+		return q.altDlRateLimit
+	}
+	for _, s := range q.speedSchedules {
+		if s.Active(now) {
+			return s.GetDownloadLimit()
+		}
+	}
+	return q.dlRateLimit
+}
+
+// applySpeedLimits updates the global limiter after a change of the limits or the time of day
+func (q *QBit) applySpeedLimits() {
+	q.speedMu.Lock()
+	defer q.speedMu.Unlock()
+	limit := q.downloadLimit(time.Now())
+	if limit == q.appliedDlLimit {
+		return
+	}
+	q.appliedDlLimit = limit
+	setLimit(q.dlLimiter, limit)
+	if limit == 0 {
+		q.logger.Info().Msg("Local downloads are no longer limited")
+		return
+	}
+	q.logger.Info().Msgf("Local downloads limited to %d KB/s", limit/1024)
+}
+
+// runSpeedSchedules applies the speed schedules at the start of every minute until ctx is done
+func (q *QBit) runSpeedSchedules(ctx context.Context) {
+	if len(q.speedSchedules) == 0 {
+		return
+	}
+	for {
+		now := time.Now()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(now.Truncate(time.Minute).Add(time.Minute).Sub(now)):
+			q.applySpeedLimits()
+		}
+	}
+}
+
+// categoryLimiter returns the limiter shared by the downloads of a category, updated to its limit
+func (q *QBit) categoryLimiter(c config.Category) *rate.Limiter {
+	q.speedMu.Lock()
+	defer q.speedMu.Unlock()
+	l, ok := q.categoryLimiters[c.Name]
+	if !ok {
+		l = newLimiter(0)
+		q.categoryLimiters[c.Name] = l
+	}
+	setLimit(l, c.GetDownloadLimit())
+	return l
+}
+
+// throttle returns a function that waits until n more bytes of the category's downloads fit in the speed limits
+func (q *QBit) throttle(category string) func(ctx context.Context, n int) error {
+	categoryLimiter := q.categoryLimiter(q.GetCategory(category))
+	return func(ctx context.Context, n int) error {
+		if err := categoryLimiter.WaitN(ctx, n); err != nil {
+			return err
+		}
+		return q.dlLimiter.WaitN(ctx, n)
+	}
+}
@@ -0,0 +1,122 @@
+package qbit
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/sirrobot01/debrid-blackhole/internal/config"
+	"github.com/sirrobot01/debrid-blackhole/internal/store"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// loadCategories merges the categories of the config with the ones created through the API.
+// The config wins, a saved category with the name of a config category is ignored
+func (q *QBit) loadCategories(categories []config.Category) {
+	q.categories = make(map[string]config.Category)
+	q.configCategories = make(map[string]bool)
+	for _, c := range categories {
+		q.categories[c.Name] = c
+		q.configCategories[c.Name] = true
+	}
+	err := q.db.ForEach(store.CategoriesBucket, func(name string, data []byte) error {
+		if q.configCategories[name] {
+			q.logger.Warn().Msgf("Category %s is set in the config, ignoring the one saved through the API", name)
+			return nil
+		}
+		var c config.Category
+		if err := json.Unmarshal(data, &c); err != nil {
+			return err
+		}
+		q.categories[name] = c
+		return nil
+	})
+	if err != nil {
+		q.logger.Error().Err(err).Msg("Error loading categories")
+	}
+}
+
+// GetCategory returns a category by name, unknown categories get the defaults
+func (q *QBit) GetCategory(name string) config.Category {
+	q.categoryMu.RLock()
+	defer q.categoryMu.RUnlock()
+	if c, ok := q.categories[name]; ok {
+		return c
+	}
+	return config.Category{Name: name}
+}
+
+// GetSavePath returns the folder the torrents of a category are saved in
+func (q *QBit) GetSavePath(category string) string {
+	if c := q.GetCategory(category); c.SavePath != "" {
+		return c.SavePath
+	}
+	return filepath.Join(q.DownloadFolder, category)
+}
+
+// GetCategories returns the categories with their save path
+func (q *QBit) GetCategories() map[string]TorrentCategory {
+	q.categoryMu.RLock()
+	names := make([]string, 0, len(q.categories))
+	for name := range q.categories {
+		names = append(names, name)
+	}
+	q.categoryMu.RUnlock()
+	categories := make(map[string]TorrentCategory, len(names))
+	for _, name := range names {
+		categories[name] = TorrentCategory{
+			Name:     name,
+			SavePath: q.GetSavePath(name),
+		}
+	}
+	return categories
+}
+
+// SetCategory creates or edits a category. Editing a category that doesn't exist fails
+func (q *QBit) SetCategory(c config.Category, create bool) error {
+	c.Name = strings.TrimSpace(c.Name)
+	if c.Name == "" {
+		return fmt.Errorf("invalid category name")
+	}
+	if c.Action != "" && !slices.Contains(config.CategoryActions, c.Action) {
+		return fmt.Errorf("invalid action: %s", c.Action)
+	}
+	if _, err := config.ParseSpeedLimit(c.DownloadLimit); err != nil {
+		return err
+	}
+	q.categoryMu.Lock()
+	if q.configCategories[c.Name] {
+		q.categoryMu.Unlock()
+		return fmt.Errorf("category %s is set in the config, edit it there", c.Name)
+	}
+	_, exists := q.categories[c.Name]
+	if !create && !exists {
+		q.categoryMu.Unlock()
+		return fmt.Errorf("category not found: %s", c.Name)
+	}
+	if create && exists {
+		q.categoryMu.Unlock()
+		return fmt.Errorf("category already exists: %s", c.Name)
+	}
+	q.categories[c.Name] = c
+	q.categoryMu.Unlock()
+	// The downloads in progress follow the new limit
+	q.categoryLimiter(c)
+	return q.db.Put(store.CategoriesBucket, c.Name, c)
+}
+
+// RemoveCategories removes categories created through the API. Categories of the config can't be removed
+func (q *QBit) RemoveCategories(names []string) error {
+	q.categoryMu.Lock()
+	defer q.categoryMu.Unlock()
+	for i, name := range names {
+		names[i] = strings.TrimSpace(name)
+		if q.configCategories[names[i]] {
+			return fmt.Errorf("category %s is set in the config, remove it there", names[i])
+		}
+	}
+	for _, name := range names {
+		delete(q.categories, name)
+	}
+	return q.db.Delete(store.CategoriesBucket, names...)
+}
@@ -1,73 +1,97 @@
 package qbit
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
-	"github.com/cavaliergopher/grab/v3"
+	"github.com/sirrobot01/debrid-blackhole/internal/config"
 	"github.com/sirrobot01/debrid-blackhole/internal/utils"
+	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/engine"
 	debrid "github.com/sirrobot01/debrid-blackhole/pkg/debrid/torrent"
+	"github.com/sirrobot01/debrid-blackhole/pkg/service"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func Download(client *grab.Client, url, filename string, progressCallback func(int64, int64)) error {
-	req, err := grab.NewRequest(filename, url)
-	if err != nil {
-		return err
-	}
-	resp := client.Do(req)
-
-	t := time.NewTicker(time.Second)
-	defer t.Stop()
-
-	var lastReported int64
-Loop:
-	for {
-		select {
-		case <-t.C:
-			current := resp.BytesComplete()
-			speed := int64(resp.BytesPerSecond())
-			if current != lastReported {
-				if progressCallback != nil {
-					progressCallback(current-lastReported, speed)
-				}
-				lastReported = current
-			}
-		case <-resp.Done:
-			break Loop
-		}
-	}
-
-	// Report final bytes
-	if progressCallback != nil {
-		progressCallback(resp.BytesComplete()-lastReported, 0)
-	}
-
-	return resp.Err()
-}
-
-func (q *QBit) ProcessManualFile(torrent *Torrent) (string, error) {
+func (q *QBit) ProcessManualFile(ctx context.Context, torrent *Torrent) (string, error) {
 	debridTorrent := torrent.DebridTorrent
-	q.logger.Info().Msgf("Downloading %d files...", len(debridTorrent.DownloadLinks))
-	torrentPath := filepath.Join(q.DownloadFolder, debridTorrent.Arr.Name, utils.RemoveExtension(debridTorrent.OriginalFilename))
+	q.logger.Info().Msgf("Downloading %d files...", len(debridTorrent.Files))
+	torrentPath := filepath.Join(q.GetSavePath(torrent.Category), utils.RemoveExtension(debridTorrent.OriginalFilename))
 	torrentPath = utils.RemoveInvalidChars(torrentPath)
 	err := os.MkdirAll(torrentPath, os.ModePerm)
 	if err != nil {
 		// add previous error to the error and return
 		return "", fmt.Errorf("failed to create directory: %s: %v", torrentPath, err)
 	}
-	q.downloadFiles(torrent, torrentPath)
+	if err := q.downloadFiles(ctx, torrent, torrentPath); err != nil {
+		return "", err
+	}
 	return torrentPath, nil
 }
 
-func (q *QBit) downloadFiles(torrent *Torrent, parent string) {
+// downloadFiles downloads the selected files of the torrent into parent.
+// Large files are downloaded over several connections, and every file is retried with a fresh link.
+// It fails if any file is missing or doesn't have the size the debrid reported
+func (q *QBit) downloadFiles(ctx context.Context, torrent *Torrent, parent string) error {
 	debridTorrent := torrent.DebridTorrent
+	debridClient := service.GetDebrid().GetByName(debridTorrent.Debrid)
 	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, 5)
+	semaphore := make(chan struct{}, q.maxDownloads)
+	progressCallback, stopReport := q.reportProgress(ctx, torrent)
+	defer stopReport(false)
+
+	tr := &http.Transport{
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: time.Minute,
+	}
+	client := &http.Client{Transport: tr}
+	throttle := q.throttle(torrent.Category)
+
+	var (
+		failedMu sync.Mutex
+		failed   []string
+	)
+	for _, file := range debridTorrent.Files {
+		name := debridTorrent.GetFileName(file)
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(file debrid.File) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			if err := q.downloadFile(ctx, client, debridClient, debridTorrent, file, filepath.Join(parent, name), progressCallback, throttle); err != nil {
+				q.logger.Error().Msgf("Failed to download %s: %v", name, err)
+				failedMu.Lock()
+				failed = append(failed, name)
+				failedMu.Unlock()
+				return
+			}
+			q.logger.Info().Msgf("Downloaded %s", name)
+		}(file)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to download %d of %d files: %s", len(failed), len(debridTorrent.Files), strings.Join(failed, ", "))
+	}
+	stopReport(true)
+	q.logger.Info().Msgf("Downloaded all files for %s", debridTorrent.Name)
+	return nil
+}
+
+// reportProgress resets the progress of the torrent and returns the function its files report their bytes to.
+// The overall progress and speed are updated once a second until stop is called, the first call decides
+// whether the progress is completed
+func (q *QBit) reportProgress(ctx context.Context, torrent *Torrent) (progress func(int64), stop func(completed bool)) {
+	debridTorrent := torrent.DebridTorrent
 	totalSize := int64(0)
 	for _, file := range debridTorrent.Files {
 		totalSize += file.Size
@@ -76,72 +100,114 @@ func (q *QBit) downloadFiles(torrent *Torrent, parent string) {
 	debridTorrent.SizeDownloaded = 0 // Reset downloaded bytes
 	debridTorrent.Progress = 0       // Reset progress
 	debridTorrent.Mu.Unlock()
-	progressCallback := func(downloaded int64, speed int64) {
+	progress = func(downloaded int64) {
 		debridTorrent.Mu.Lock()
 		defer debridTorrent.Mu.Unlock()
-		torrent.Mu.Lock()
-		defer torrent.Mu.Unlock()
-
-		// Update total downloaded bytes
 		debridTorrent.SizeDownloaded += downloaded
-		debridTorrent.Speed = speed
+	}
 
-		// Calculate overall progress
-		if totalSize > 0 {
-			debridTorrent.Progress = float64(debridTorrent.SizeDownloaded) / float64(totalSize) * 100
+	reportCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		var last int64
+		for {
+			select {
+			case <-reportCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			debridTorrent.Mu.Lock()
+			torrent.Mu.Lock()
+			current := debridTorrent.SizeDownloaded
+			debridTorrent.Speed = max(current-last, 0)
+			last = current
+			if totalSize > 0 {
+				debridTorrent.Progress = float64(current) / float64(totalSize) * 100
+			}
+			q.UpdateTorrentMin(torrent, debridTorrent)
+			torrent.Mu.Unlock()
+			debridTorrent.Mu.Unlock()
 		}
-		q.UpdateTorrentMin(torrent, debridTorrent)
+	}()
+	var once sync.Once
+	stop = func(completed bool) {
+		once.Do(func() {
+			cancel()
+			<-done
+			if !completed {
+				return
+			}
+			debridTorrent.Mu.Lock()
+			debridTorrent.Progress = 100
+			debridTorrent.Speed = 0
+			debridTorrent.Mu.Unlock()
+		})
 	}
+	return progress, stop
+}
 
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		Proxy:           http.ProxyFromEnvironment,
+// downloadFile downloads a single file, retrying with a new download link after a failure.
+// Partial downloads are kept between attempts and restarts
+func (q *QBit) downloadFile(ctx context.Context, client *http.Client, debridClient engine.Service, debridTorrent *debrid.Torrent, file debrid.File, filename string, progress func(int64), throttle func(context.Context, int) error) error {
+	// The bytes of a failed attempt are reported again by the next one
+	var reported atomic.Int64
+	report := func(n int64) {
+		reported.Add(n)
+		progress(n)
 	}
-	client := &grab.Client{
-		UserAgent: "qBitTorrent",
-		HTTPClient: &http.Client{
-			Transport: tr,
-		},
-	}
-	for _, link := range debridTorrent.DownloadLinks {
+	var err error
+	for attempt := 1; attempt <= q.downloadRetries; attempt++ {
+		if attempt > 1 {
+			progress(-reported.Swap(0))
+			delay := min(time.Duration(1<<(attempt-1))*time.Second, 30*time.Second)
+			q.logger.Debug().Msgf("Retrying %s in %s (attempt %d/%d): %v", file.Name, delay, attempt, q.downloadRetries, err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+		link := debridTorrent.DownloadLinks[file.Id]
+		if attempt > 1 || link.DownloadLink == "" {
+			// Links expire, get a new one
+			if l := debridClient.GetDownloadLink(ctx, debridTorrent, &file); l != nil && l.DownloadLink != "" {
+				link = *l
+			}
+		}
 		if link.DownloadLink == "" {
-			q.logger.Info().Msgf("No download link found for %s", link.Filename)
+			err = fmt.Errorf("no download link")
 			continue
 		}
-		wg.Add(1)
-		semaphore <- struct{}{}
-		go func(link debrid.DownloadLinks) {
-			defer wg.Done()
-			defer func() { <-semaphore }()
-			filename := link.Filename
-
-			err := Download(
-				client,
-				link.DownloadLink,
-				filepath.Join(parent, filename),
-				progressCallback,
-			)
-
-			if err != nil {
-				q.logger.Error().Msgf("Failed to download %s: %v", filename, err)
-			} else {
-				q.logger.Info().Msgf("Downloaded %s", filename)
-			}
-		}(link)
+		download := &segmentedDownload{
+			client:      client,
+			url:         link.DownloadLink,
+			filename:    filename,
+			size:        file.Size,
+			connections: q.downloadConnections,
+			progress:    report,
+			throttle:    throttle,
+		}
+		if err = download.Run(ctx); err == nil || ctx.Err() != nil {
+			return err
+		}
 	}
-	wg.Wait()
-	q.logger.Info().Msgf("Downloaded all files for %s", debridTorrent.Name)
+	return err
 }
 
-func (q *QBit) ProcessSymlink(torrent *Torrent) (string, error) {
+// ProcessMount waits for the files of the torrent to show up in the rclone mount, then symlinks, hardlinks,
+// reflinks or copies them into the category folder depending on action
+func (q *QBit) ProcessMount(ctx context.Context, torrent *Torrent, action string) (string, error) {
 	debridTorrent := torrent.DebridTorrent
 	files := debridTorrent.Files
 	if len(files) == 0 {
 		return "", fmt.Errorf("no video files found")
 	}
-	q.logger.Info().Msgf("Checking symlinks for %d files...", len(files))
+	q.logger.Info().Msgf("Checking %s for %d files...", action, len(files))
 	rCloneBase := debridTorrent.MountPath
-	torrentPath, err := q.getTorrentPath(rCloneBase, debridTorrent) // /MyTVShow/
+	torrentPath, err := q.getTorrentPath(ctx, rCloneBase, debridTorrent) // /MyTVShow/
 	// This returns filename.ext for alldebrid instead of the parent folder filename/
 	torrentFolder := torrentPath
 	if err != nil {
@@ -154,7 +220,7 @@ func (q *QBit) ProcessSymlink(torrent *Torrent) (string, error) {
 		torrentFolder = utils.RemoveExtension(torrentFolder)
 		torrentRclonePath = rCloneBase // /mnt/rclone/magnets/  // Remove the filename since it's in the root folder
 	}
-	torrentSymlinkPath := filepath.Join(q.DownloadFolder, debridTorrent.Arr.Name, torrentFolder) // /mnt/symlinks/{category}/MyTVShow/
+	torrentSymlinkPath := filepath.Join(q.GetSavePath(torrent.Category), torrentFolder) // /mnt/symlinks/{category}/MyTVShow/
 	err = os.MkdirAll(torrentSymlinkPath, os.ModePerm)
 	if err != nil {
 		return "", fmt.Errorf("failed to create directory: %s: %v", torrentSymlinkPath, err)
@@ -167,28 +233,80 @@ func (q *QBit) ProcessSymlink(torrent *Torrent) (string, error) {
 	ticker := time.NewTicker(200 * time.Millisecond)
 	defer ticker.Stop()
 
-	for len(pending) > 0 {
-		<-ticker.C
+	// Files other than symlinks are placed in the background while the rest shows up
+	var (
+		wg        sync.WaitGroup
+		semaphore = make(chan struct{}, q.maxDownloads)
+		failedMu  sync.Mutex
+		failed    []string
+	)
+	progress, stopReport := func(int64) {}, func(bool) {}
+	if action != config.CategoryActionSymlink {
+		progress, stopReport = q.reportProgress(ctx, torrent)
+	}
+	defer stopReport(false)
+	throttle := q.throttle(torrent.Category)
+
+	for len(pending) > 0 && ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+			continue
+		case <-ticker.C:
+		}
 		for path, file := range pending {
 			fullFilePath := filepath.Join(torrentRclonePath, file.Path)
-			if _, err := os.Stat(fullFilePath); !os.IsNotExist(err) {
-				q.logger.Info().Msgf("File is ready: %s", file.Path)
+			if _, err := os.Stat(fullFilePath); os.IsNotExist(err) {
+				continue
+			}
+			q.logger.Info().Msgf("File is ready: %s", file.Path)
+			file.Name = debridTorrent.GetFileName(file)
+			delete(pending, path)
+			if action == config.CategoryActionSymlink {
 				q.createSymLink(torrentSymlinkPath, torrentRclonePath, file)
-				delete(pending, path)
+				continue
 			}
+			wg.Add(1)
+			go func(file debrid.File) {
+				defer wg.Done()
+				select {
+				case semaphore <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				defer func() { <-semaphore }()
+				dst := filepath.Join(torrentSymlinkPath, file.Name)
+				if err := q.placeFile(ctx, action, fullFilePath, dst, progress, throttle); err != nil {
+					q.logger.Error().Msgf("Failed to %s %s: %v", action, file.Name, err)
+					failedMu.Lock()
+					failed = append(failed, file.Name)
+					failedMu.Unlock()
+				}
+			}(file)
 		}
 	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	if len(failed) > 0 {
+		return "", fmt.Errorf("failed to %s %d of %d files: %s", action, len(failed), len(files), strings.Join(failed, ", "))
+	}
+	stopReport(true)
 	return torrentSymlinkPath, nil
 }
 
-func (q *QBit) getTorrentPath(rclonePath string, debridTorrent *debrid.Torrent) (string, error) {
+func (q *QBit) getTorrentPath(ctx context.Context, rclonePath string, debridTorrent *debrid.Torrent) (string, error) {
 	for {
 		torrentPath, err := debridTorrent.GetMountFolder(rclonePath)
 		if err == nil {
 			q.logger.Debug().Msgf("Found torrent path: %s", torrentPath)
 			return torrentPath, err
 		}
-		time.Sleep(100 * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
 	}
 }
 
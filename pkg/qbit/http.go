@@ -4,11 +4,14 @@ import (
 	"context"
 	"encoding/base64"
 	"github.com/go-chi/chi/v5"
+	"github.com/sirrobot01/debrid-blackhole/internal/config"
 	"github.com/sirrobot01/debrid-blackhole/internal/request"
 	"github.com/sirrobot01/debrid-blackhole/pkg/arr"
 	"github.com/sirrobot01/debrid-blackhole/pkg/service"
 	"net/http"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 )
 
@@ -62,7 +65,8 @@ func (q *QBit) authContext(next http.Handler) http.Handler {
 			downloadUncached := false
 			a = arr.New(category, "", "", false, false, &downloadUncached)
 		}
-		if err == nil {
+		// The arr credentials are only trusted from authenticated clients
+		if err == nil && q.isAuthenticated(r) {
 			host = strings.TrimSpace(host)
 			if host != "" {
 				a.Host = host
@@ -101,6 +105,12 @@ func HashesCtx(next http.Handler) http.Handler {
 
 func (q *QBit) handleLogin(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	if config.GetConfig().QBitTorrent.AuthEnabled() && !q.checkCredentials(r.FormValue("username"), r.FormValue("password")) {
+		q.logger.Info().Msgf("Failed login from %s", r.RemoteAddr)
+		_, _ = w.Write([]byte("Fails."))
+		return
+	}
+	q.setSessionCookie(w)
 	_arr := ctx.Value("arr").(*arr.Arr)
 	if _arr == nil {
 		// No arr
@@ -113,6 +123,14 @@ func (q *QBit) handleLogin(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte("Ok."))
 }
 
+func (q *QBit) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		q.sessions.delete(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+	w.WriteHeader(http.StatusOK)
+}
+
 func (q *QBit) handleVersion(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte("v4.3.2"))
 }
@@ -179,8 +197,9 @@ func (q *QBit) handleTorrentsAdd(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	isSymlink := strings.ToLower(r.FormValue("sequentialDownload")) != "true"
 	category := r.FormValue("category")
+	isSymlink := strings.ToLower(r.FormValue("sequentialDownload")) != "true" &&
+		q.GetCategory(category).Action != config.CategoryActionDownload
 	atleastOne := false
 	ctx = context.WithValue(ctx, "isSymlink", isSymlink)
 
@@ -231,7 +250,7 @@ func (q *QBit) handleTorrentsDelete(w http.ResponseWriter, r *http.Request) {
 	}
 	category := ctx.Value("category").(string)
 	for _, hash := range hashes {
-		q.Storage.Delete(hash, category)
+		q.DeleteTorrent(hash, category)
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -283,15 +302,61 @@ func (q *QBit) handleTorrentRecheck(w http.ResponseWriter, r *http.Request) {
 }
 
 func (q *QBit) handleCategories(w http.ResponseWriter, r *http.Request) {
-	var categories = map[string]TorrentCategory{}
-	for _, cat := range q.Categories {
-		path := filepath.Join(q.DownloadFolder, cat)
-		categories[cat] = TorrentCategory{
-			Name:     cat,
-			SavePath: path,
-		}
+	request.JSONResponse(w, q.GetCategories(), http.StatusOK)
+}
+
+func (q *QBit) handleTransferInfo(w http.ResponseWriter, r *http.Request) {
+	request.JSONResponse(w, q.GetTransferInfo(), http.StatusOK)
+}
+
+func (q *QBit) handleSpeedLimitsMode(w http.ResponseWriter, r *http.Request) {
+	alt, _, _ := q.GetSpeedLimits()
+	if alt {
+		_, _ = w.Write([]byte("1"))
+		return
+	}
+	_, _ = w.Write([]byte("0"))
+}
+
+func (q *QBit) handleToggleSpeedLimitsMode(w http.ResponseWriter, r *http.Request) {
+	q.ToggleSpeedLimitsMode()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (q *QBit) handleDownloadLimit(w http.ResponseWriter, r *http.Request) {
+	_, limit, _ := q.GetSpeedLimits()
+	_, _ = w.Write([]byte(strconv.FormatInt(limit, 10)))
+}
+
+func (q *QBit) handleSetDownloadLimit(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.ParseInt(r.FormValue("limit"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
+	}
+	q.SetDownloadLimit(limit)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (q *QBit) handleUploadLimit(w http.ResponseWriter, r *http.Request) {
+	_, _, limit := q.GetSpeedLimits()
+	_, _ = w.Write([]byte(strconv.FormatInt(limit, 10)))
+}
+
+func (q *QBit) handleSetUploadLimit(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.ParseInt(r.FormValue("limit"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid limit", http.StatusBadRequest)
+		return
 	}
-	request.JSONResponse(w, categories, http.StatusOK)
+	q.SetUploadLimit(limit)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (q *QBit) handleSyncMainData(w http.ResponseWriter, r *http.Request) {
+	rid, _ := strconv.ParseInt(r.URL.Query().Get("rid"), 10, 64)
+	data := q.Storage.Sync(rid, q.GetCategories(), q.Tags, q.GetServerState())
+	request.JSONResponse(w, data, http.StatusOK)
 }
 
 func (q *QBit) handleCreateCategory(w http.ResponseWriter, r *http.Request) {
@@ -306,10 +371,64 @@ func (q *QBit) handleCreateCategory(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "No name provided", http.StatusBadRequest)
 		return
 	}
+	q.setCategory(w, r, config.Category{Name: name}, true)
+}
 
-	q.Categories = append(q.Categories, name)
+func (q *QBit) handleEditCategory(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form data", http.StatusBadRequest)
+		return
+	}
+	q.setCategory(w, r, q.GetCategory(r.Form.Get("category")), false)
+}
 
-	request.JSONResponse(w, nil, http.StatusOK)
+// setCategory applies the form fields to the category. Besides the qBittorrent savePath,
+// the action, debrid and downloadUncached fields set the category's behaviour
+func (q *QBit) setCategory(w http.ResponseWriter, r *http.Request, category config.Category, create bool) {
+	if r.Form.Has("savePath") {
+		category.SavePath = strings.TrimSpace(r.Form.Get("savePath"))
+	}
+	if r.Form.Has("action") {
+		category.Action = r.Form.Get("action")
+	}
+	if r.Form.Has("debrid") {
+		category.Debrid = r.Form.Get("debrid")
+		if category.Debrid != "" && service.GetDebrid().GetByName(category.Debrid) == nil {
+			http.Error(w, "Unknown debrid", http.StatusBadRequest)
+			return
+		}
+	}
+	if r.Form.Has("downloadLimit") {
+		category.DownloadLimit = strings.TrimSpace(r.Form.Get("downloadLimit"))
+	}
+	if r.Form.Has("downloadUncached") {
+		category.DownloadUncached = nil
+		if value := r.Form.Get("downloadUncached"); value != "" {
+			downloadUncached, err := strconv.ParseBool(value)
+			if err != nil {
+				http.Error(w, "Invalid downloadUncached", http.StatusBadRequest)
+				return
+			}
+			category.DownloadUncached = &downloadUncached
+		}
+	}
+	if err := q.SetCategory(category, create); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (q *QBit) handleRemoveCategories(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Failed to parse form data", http.StatusBadRequest)
+		return
+	}
+	if err := q.RemoveCategories(strings.Split(r.Form.Get("categories"), "\n")); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
 }
 
 func (q *QBit) handleTorrentProperties(w http.ResponseWriter, r *http.Request) {
@@ -332,6 +451,62 @@ func (q *QBit) handleTorrentFiles(w http.ResponseWriter, r *http.Request) {
 	request.JSONResponse(w, files, http.StatusOK)
 }
 
+func (q *QBit) handleSetFilePrio(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	torrent := q.Storage.Get(r.FormValue("hash"), ctx.Value("category").(string))
+	if torrent == nil {
+		http.Error(w, "Torrent not found", http.StatusNotFound)
+		return
+	}
+	priority, err := strconv.Atoi(r.FormValue("priority"))
+	if err != nil || !slices.Contains([]int{0, 1, 6, 7}, priority) {
+		http.Error(w, "Invalid priority", http.StatusBadRequest)
+		return
+	}
+	ids := make([]int, 0)
+	for _, id := range strings.Split(r.FormValue("id"), "|") {
+		i, err := strconv.Atoi(strings.TrimSpace(id))
+		if err != nil {
+			http.Error(w, "Invalid file id", http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, i)
+	}
+	if err = q.SetFilePriority(ctx, torrent, ids, priority); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (q *QBit) handleRenameFile(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	torrent := q.Storage.Get(r.FormValue("hash"), ctx.Value("category").(string))
+	if torrent == nil {
+		http.Error(w, "Torrent not found", http.StatusNotFound)
+		return
+	}
+	if err := q.RenameFile(torrent, r.FormValue("oldPath"), r.FormValue("newPath")); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (q *QBit) handleRenameFolder(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	torrent := q.Storage.Get(r.FormValue("hash"), ctx.Value("category").(string))
+	if torrent == nil {
+		http.Error(w, "Torrent not found", http.StatusNotFound)
+		return
+	}
+	if err := q.RenameFolder(torrent, r.FormValue("oldPath"), r.FormValue("newPath")); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
 func (q *QBit) handleSetCategory(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	category := ctx.Value("category").(string)
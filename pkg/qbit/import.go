@@ -3,12 +3,10 @@ package qbit
 import (
 	"fmt"
 	"github.com/sirrobot01/debrid-blackhole/internal/utils"
-	"github.com/sirrobot01/debrid-blackhole/pkg/service"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/sirrobot01/debrid-blackhole/pkg/arr"
-	"github.com/sirrobot01/debrid-blackhole/pkg/debrid"
 )
 
 type ImportRequest struct {
@@ -68,25 +66,16 @@ func (i *ImportRequest) Complete() {
 func (i *ImportRequest) Process(q *QBit) (err error) {
 	// Use this for now.
 	// This sends the torrent to the arr
-	svc := service.GetService()
 	magnet, err := utils.GetMagnetFromUrl(i.URI)
 	if err != nil {
 		return fmt.Errorf("error parsing magnet link: %w", err)
 	}
 	torrent := CreateTorrentFromMagnet(magnet, i.Arr.Name, "manual")
-	debridTorrent, err := debrid.ProcessTorrent(svc.Debrid, magnet, i.Arr, i.IsSymlink, i.DownloadUncached)
-	if err != nil || debridTorrent == nil {
-		if debridTorrent != nil {
-			dbClient := service.GetDebrid().GetByName(debridTorrent.Debrid)
-			go dbClient.DeleteTorrent(debridTorrent)
-		}
-		if err == nil {
-			err = fmt.Errorf("failed to process torrent")
-		}
-		return err
+	category := q.GetCategory(i.Arr.Name)
+	downloadUncached := category.DownloadUncached
+	if i.DownloadUncached {
+		downloadUncached = &i.DownloadUncached
 	}
-	torrent = q.UpdateTorrentMin(torrent, debridTorrent)
-	q.Storage.AddOrUpdate(torrent)
-	go q.ProcessFiles(torrent, debridTorrent, i.Arr, i.IsSymlink)
+	q.enqueue(torrent, magnet, i.Arr, i.IsSymlink, downloadUncached, category.Debrid)
 	return nil
 }
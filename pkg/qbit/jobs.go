@@ -0,0 +1,371 @@
+package qbit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/sirrobot01/debrid-blackhole/internal/store"
+	"github.com/sirrobot01/debrid-blackhole/internal/utils"
+	"github.com/sirrobot01/debrid-blackhole/pkg/arr"
+	db "github.com/sirrobot01/debrid-blackhole/pkg/debrid"
+	"github.com/sirrobot01/debrid-blackhole/pkg/service"
+	"slices"
+	"sync"
+	"time"
+)
+
+type JobState string
+
+// jobRetention is how long finished jobs are kept
+const jobRetention = 7 * 24 * time.Hour
+
+const (
+	JobQueued        JobState = "queued"
+	JobSubmitting    JobState = "submitting"
+	JobWaitingDebrid JobState = "waiting-debrid"
+	JobLinking       JobState = "linking"
+	JobDone          JobState = "done"
+	JobFailed        JobState = "failed"
+)
+
+// Job is the processing of a torrent, from submitting it to the debrid to linking or downloading its files.
+// Jobs are persisted so the torrents still in progress are resumed on start
+type Job struct {
+	ID       string `json:"id"`
+	Hash     string `json:"hash"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	Magnet   string `json:"magnet"`
+	// TorrentFile is the .torrent the job was added from, it is uploaded as is
+	TorrentFile []byte `json:"torrent_file,omitempty"`
+	Arr         string `json:"arr"`
+	// The credentials sent by an arr that isn't in the config
+	ArrHost          string `json:"arr_host,omitempty"`
+	ArrToken         string `json:"arr_token,omitempty"`
+	IsSymlink        bool   `json:"is_symlink"`
+	DownloadUncached *bool  `json:"download_uncached,omitempty"`
+	Debrid           string `json:"debrid,omitempty"` // Preferred debrid of the category
+
+	State     JobState  `json:"state"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func newJob(t *Torrent, magnet *utils.Magnet, a *arr.Arr, isSymlink bool, downloadUncached *bool, debrid string) *Job {
+	job := &Job{
+		ID:               t.ID,
+		Hash:             t.Hash,
+		Name:             t.Name,
+		Category:         t.Category,
+		Magnet:           magnet.Link,
+		TorrentFile:      magnet.File,
+		IsSymlink:        isSymlink,
+		DownloadUncached: downloadUncached,
+		Debrid:           debrid,
+		State:            JobQueued,
+		CreatedAt:        time.Now(),
+		UpdatedAt:        time.Now(),
+	}
+	if a != nil {
+		job.Arr = a.Name
+		if service.GetService().Arr.Get(a.Name) == nil {
+			job.ArrHost = a.Host
+			job.ArrToken = a.Token
+		}
+	}
+	return job
+}
+
+// getArr returns the arr of the job, arrs that aren't in the config are rebuilt from the saved credentials
+func (j *Job) getArr() *arr.Arr {
+	if a := service.GetService().Arr.Get(j.Arr); a != nil {
+		return a
+	}
+	downloadUncached := false
+	return arr.New(j.Arr, j.ArrHost, j.ArrToken, false, false, &downloadUncached)
+}
+
+// getMagnet parses the magnet of the job again, from the .torrent if it was added from one
+func (j *Job) getMagnet() (*utils.Magnet, error) {
+	if len(j.TorrentFile) > 0 {
+		return utils.GetMagnetFromBytes(j.TorrentFile)
+	}
+	return utils.GetMagnetInfo(j.Magnet)
+}
+
+func (j *Job) isFinished() bool {
+	return j.State == JobDone || j.State == JobFailed
+}
+
+// JobQueue holds the torrent jobs. It bounds how many torrents are submitted or linked at the same time,
+// waiting for the debrid to download a torrent doesn't take a slot
+type JobQueue struct {
+	jobs   map[string]*Job // key: hash|category
+	mu     sync.RWMutex
+	db     store.Store
+	slots  chan struct{}
+	logger zerolog.Logger
+}
+
+func NewJobQueue(db store.Store, concurrency int, logger zerolog.Logger) *JobQueue {
+	jobs := make(map[string]*Job)
+	err := db.ForEach(store.JobsBucket, func(key string, data []byte) error {
+		job := &Job{}
+		if err := json.Unmarshal(data, job); err != nil {
+			return fmt.Errorf("error loading job %s: %w", key, err)
+		}
+		jobs[key] = job
+		return nil
+	})
+	if err != nil {
+		logger.Error().Err(err).Msg("Error loading the jobs")
+	}
+	return &JobQueue{
+		jobs:   jobs,
+		db:     db,
+		slots:  make(chan struct{}, concurrency),
+		logger: logger,
+	}
+}
+
+func (jq *JobQueue) Add(job *Job) {
+	key := keyPair(job.Hash, job.Category)
+	jq.mu.Lock()
+	jq.jobs[key] = job
+	jq.mu.Unlock()
+	jq.save(key, job)
+}
+
+// Get returns a copy of the job of a torrent, its state keeps changing under the lock
+func (jq *JobQueue) Get(hash, category string) *Job {
+	jq.mu.RLock()
+	defer jq.mu.RUnlock()
+	job, ok := jq.jobs[keyPair(hash, category)]
+	if !ok {
+		return nil
+	}
+	jobCopy := *job
+	return &jobCopy
+}
+
+// GetAll returns copies of the jobs, newest first
+func (jq *JobQueue) GetAll() []*Job {
+	jq.mu.RLock()
+	defer jq.mu.RUnlock()
+	jobs := make([]*Job, 0, len(jq.jobs))
+	for _, job := range jq.jobs {
+		jobCopy := *job
+		jobs = append(jobs, &jobCopy)
+	}
+	slices.SortFunc(jobs, func(a, b *Job) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return jobs
+}
+
+// Pending returns the jobs that haven't finished, oldest first
+func (jq *JobQueue) Pending() []*Job {
+	jobs := make([]*Job, 0)
+	for _, job := range jq.GetAll() {
+		if !job.isFinished() {
+			jobs = append(jobs, job)
+		}
+	}
+	slices.Reverse(jobs)
+	return jobs
+}
+
+// SetState moves the job of a torrent to a new state. Torrents without a job are ignored
+func (jq *JobQueue) SetState(hash, category string, state JobState, err error) {
+	key := keyPair(hash, category)
+	jq.mu.Lock()
+	job, ok := jq.jobs[key]
+	if !ok {
+		jq.mu.Unlock()
+		return
+	}
+	job.State = state
+	job.Error = ""
+	if err != nil {
+		job.Error = err.Error()
+	}
+	if state == JobDone {
+		// The torrent is on the debrid, the .torrent is no longer needed to submit it again
+		job.TorrentFile = nil
+	}
+	job.UpdatedAt = time.Now()
+	jq.mu.Unlock()
+	jq.save(key, job)
+}
+
+func (jq *JobQueue) Delete(hash, category string) {
+	key := keyPair(hash, category)
+	jq.mu.Lock()
+	delete(jq.jobs, key)
+	jq.mu.Unlock()
+	if err := jq.db.Delete(store.JobsBucket, key); err != nil {
+		jq.logger.Error().Err(err).Msgf("Error deleting job %s", key)
+	}
+}
+
+// DeleteMultiple removes the jobs of the hashes in any category
+func (jq *JobQueue) DeleteMultiple(hashes []string) {
+	jq.mu.Lock()
+	keys := make([]string, 0, len(hashes))
+	for key, job := range jq.jobs {
+		if slices.Contains(hashes, job.Hash) {
+			delete(jq.jobs, key)
+			keys = append(keys, key)
+		}
+	}
+	jq.mu.Unlock()
+	if err := jq.db.Delete(store.JobsBucket, keys...); err != nil {
+		jq.logger.Error().Err(err).Msgf("Error deleting %d jobs", len(keys))
+	}
+}
+
+// Prune removes the finished jobs not updated for maxAge. It returns how many were removed
+func (jq *JobQueue) Prune(maxAge time.Duration) int {
+	cutoff := time.Now().Add(-maxAge)
+	jq.mu.Lock()
+	keys := make([]string, 0)
+	for key, job := range jq.jobs {
+		if job.isFinished() && job.UpdatedAt.Before(cutoff) {
+			delete(jq.jobs, key)
+			keys = append(keys, key)
+		}
+	}
+	jq.mu.Unlock()
+	if len(keys) == 0 {
+		return 0
+	}
+	if err := jq.db.Delete(store.JobsBucket, keys...); err != nil {
+		jq.logger.Error().Err(err).Msgf("Error deleting %d jobs", len(keys))
+	}
+	return len(keys)
+}
+
+// acquire waits for a free slot. It returns false if the context is done first
+func (jq *JobQueue) acquire(ctx context.Context) bool {
+	select {
+	case jq.slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (jq *JobQueue) release() {
+	<-jq.slots
+}
+
+func (jq *JobQueue) save(key string, job *Job) {
+	jq.mu.RLock()
+	defer jq.mu.RUnlock()
+	if err := jq.db.Put(store.JobsBucket, key, job); err != nil {
+		jq.logger.Error().Err(err).Msgf("Error saving job %s", key)
+	}
+}
+
+// enqueue saves the torrent and its job, then processes it in the background
+func (q *QBit) enqueue(t *Torrent, magnet *utils.Magnet, a *arr.Arr, isSymlink bool, downloadUncached *bool, debrid string) {
+	t.State = "queuedDL"
+	t.SeqDl = !isSymlink
+	job := newJob(t, magnet, a, isSymlink, downloadUncached, debrid)
+	q.Storage.AddOrUpdate(t)
+	q.Jobs.Add(job)
+	go q.runJob(job, t, magnet, a)
+}
+
+// runJob submits the torrent to the debrid once a slot is free, then processes its files
+func (q *QBit) runJob(job *Job, t *Torrent, magnet *utils.Magnet, a *arr.Arr) {
+	ctx := q.torrentContext(t.Hash)
+	if !q.Jobs.acquire(ctx) {
+		// The job stays queued on shutdown
+		q.finishTorrent(ctx, t.Hash)
+		return
+	}
+	q.Jobs.SetState(t.Hash, t.Category, JobSubmitting, nil)
+	t.State = "metaDL"
+	q.Storage.Update(t)
+	debridTorrent, err := db.ProcessTorrent(ctx, service.GetDebrid(), magnet, a, job.IsSymlink, job.DownloadUncached, job.Debrid)
+	q.Jobs.release()
+	if err != nil || debridTorrent == nil {
+		if debridTorrent != nil {
+			dbClient := service.GetDebrid().GetByName(debridTorrent.Debrid)
+			// The request may be gone, clean up regardless
+			go dbClient.DeleteTorrent(context.WithoutCancel(ctx), debridTorrent)
+		}
+		q.finishTorrent(ctx, t.Hash)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("failed to process torrent")
+		}
+		q.logger.Error().Err(err).Msgf("Error submitting %s", t.Name)
+		q.MarkAsFailed(t, err)
+		if err := a.Refresh(); err != nil {
+			q.logger.Error().Msgf("Error refreshing arr: %v", err)
+		}
+		return
+	}
+	t.State = "downloading"
+	q.UpdateTorrentMin(t, debridTorrent)
+	q.Storage.AddOrUpdate(t)
+	q.Jobs.SetState(t.Hash, t.Category, JobWaitingDebrid, nil)
+	q.ProcessFiles(ctx, t, debridTorrent, a, job.IsSymlink)
+}
+
+// pruneJobs removes the finished jobs older than jobRetention, on start and then every day until ctx is done
+func (q *QBit) pruneJobs(ctx context.Context) {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+	for {
+		if n := q.Jobs.Prune(jobRetention); n > 0 {
+			q.logger.Info().Msgf("Removed %d finished jobs", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// resumeJobs picks up the jobs that were in progress when decypharr stopped.
+// Torrents left in progress without a job, e.g added by an older version, get one
+func (q *QBit) resumeJobs() {
+	for _, t := range q.Storage.GetAll("", "", nil) {
+		if t.State != "downloading" && t.State != "queuedDL" && t.State != "metaDL" && t.State != "checkingUP" {
+			continue
+		}
+		if q.Jobs.Get(t.Hash, t.Category) != nil {
+			continue
+		}
+		magnet, err := utils.GetMagnetInfo(t.MagnetUri)
+		if err != nil {
+			continue
+		}
+		job := newJob(t, magnet, nil, !t.SeqDl, nil, "")
+		job.Arr = t.Category
+		job.State = JobWaitingDebrid
+		q.Jobs.Add(job)
+	}
+
+	for _, job := range q.Jobs.Pending() {
+		t := q.Storage.Get(job.Hash, job.Category)
+		if t == nil {
+			q.Jobs.Delete(job.Hash, job.Category)
+			continue
+		}
+		if t.State == "pausedDL" {
+			// Resumed by the user
+			continue
+		}
+		q.logger.Info().Msgf("Resuming %s (%s)", job.Name, job.State)
+		go q.restartTorrent(t)
+	}
+}
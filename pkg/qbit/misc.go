@@ -24,5 +24,8 @@ func CreateTorrentFromMagnet(magnet *utils.Magnet, category, source string) *Tor
 		Ratio:      1,
 		RatioLimit: 1,
 	}
+	if len(magnet.Trackers) > 0 {
+		torrent.Tracker = magnet.Trackers[0]
+	}
 	return torrent
 }
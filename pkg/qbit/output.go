@@ -0,0 +1,137 @@
+package qbit
+
+import (
+	"context"
+	"fmt"
+	"github.com/sirrobot01/debrid-blackhole/internal/config"
+	"github.com/sirrobot01/debrid-blackhole/internal/utils"
+	debrid "github.com/sirrobot01/debrid-blackhole/pkg/debrid/torrent"
+	"github.com/sirrobot01/debrid-blackhole/pkg/stream"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// outputAction returns how the files of a torrent are saved. Torrents that aren't symlinked are downloaded,
+// the others follow the action of their category
+func (q *QBit) outputAction(category string, isSymlink bool) string {
+	if !isSymlink {
+		return config.CategoryActionDownload
+	}
+	action := q.GetCategory(category).Action
+	if action == "" || action == config.CategoryActionDownload {
+		return config.CategoryActionSymlink
+	}
+	return action
+}
+
+// outputName returns the name a file of the torrent is saved under
+func outputName(action string, debridTorrent *debrid.Torrent, file debrid.File) string {
+	name := debridTorrent.GetFileName(file)
+	if action == config.CategoryActionStrm {
+		return utils.RemoveExtension(name) + ".strm"
+	}
+	return name
+}
+
+// ProcessStrm writes a .strm file for every file of the torrent, pointing at its stream URL.
+// Nothing is read from the mount, the files are streamed from the debrid when played
+func (q *QBit) ProcessStrm(ctx context.Context, torrent *Torrent) (string, error) {
+	debridTorrent := torrent.DebridTorrent
+	if len(debridTorrent.Files) == 0 {
+		return "", fmt.Errorf("no video files found")
+	}
+	torrentPath := filepath.Join(q.GetSavePath(torrent.Category), utils.RemoveExtension(debridTorrent.OriginalFilename))
+	torrentPath = utils.RemoveInvalidChars(torrentPath)
+	if err := os.MkdirAll(torrentPath, os.ModePerm); err != nil {
+		return "", fmt.Errorf("failed to create directory: %s: %v", torrentPath, err)
+	}
+	for _, file := range debridTorrent.Files {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+		path := filepath.Join(torrentPath, outputName(config.CategoryActionStrm, debridTorrent, file))
+		streamURL, err := stream.URL(q.strmURL, debridTorrent.Debrid, debridTorrent.Id, debridTorrent.KeyId, file.Id)
+		if err != nil {
+			return "", err
+		}
+		if err := os.WriteFile(path, []byte(streamURL+"\n"), 0644); err != nil {
+			return "", fmt.Errorf("failed to write %s: %v", path, err)
+		}
+	}
+	q.logger.Info().Msgf("Created %d .strm files for %s", len(debridTorrent.Files), debridTorrent.Name)
+	return torrentPath, nil
+}
+
+// placeFile hardlinks, reflinks or copies a file of the mount, depending on action.
+// A link the filesystems don't support is replaced by a copy. An existing file is kept
+func (q *QBit) placeFile(ctx context.Context, action, src, dst string, progress func(int64), throttle func(context.Context, int) error) error {
+	if info, err := os.Stat(dst); err == nil {
+		progress(info.Size())
+		return nil
+	}
+	var err error
+	switch action {
+	case config.CategoryActionHardlink:
+		err = os.Link(src, dst)
+	case config.CategoryActionReflink:
+		err = reflink(src, dst)
+	default:
+		return copyFile(ctx, src, dst, progress, throttle)
+	}
+	if err == nil {
+		if info, err := os.Stat(dst); err == nil {
+			progress(info.Size())
+		}
+		return nil
+	}
+	q.logger.Debug().Msgf("Failed to %s %s, copying it instead: %v", action, dst, err)
+	return copyFile(ctx, src, dst, progress, throttle)
+}
+
+// copyFile copies src to dst.part then moves it in place, an interrupted copy is never taken for the file
+func copyFile(ctx context.Context, src, dst string, progress func(int64), throttle func(context.Context, int) error) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	part := dst + ".part"
+	out, err := os.Create(part)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = out.Close()
+			_ = os.Remove(part)
+		}
+	}()
+
+	buf := make([]byte, bandwidthBurst)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, rerr := in.Read(buf)
+		if n > 0 {
+			if _, err := out.Write(buf[:n]); err != nil {
+				return err
+			}
+			progress(int64(n))
+			if err := throttle(ctx, n); err != nil {
+				return err
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(part, dst)
+}
@@ -2,40 +2,170 @@ package qbit
 
 import (
 	"cmp"
+	"context"
+	"errors"
 	"github.com/rs/zerolog"
 	"github.com/sirrobot01/debrid-blackhole/internal/config"
 	"github.com/sirrobot01/debrid-blackhole/internal/logger"
+	"github.com/sirrobot01/debrid-blackhole/internal/store"
+	"golang.org/x/time/rate"
 	"os"
-	"path/filepath"
+	"strings"
+	"sync"
 )
 
 type QBit struct {
-	Username        string   `json:"username"`
-	Password        string   `json:"password"`
-	Port            string   `json:"port"`
-	DownloadFolder  string   `json:"download_folder"`
-	Categories      []string `json:"categories"`
+	Username        string `json:"username"`
+	Password        string `json:"password"`
+	Port            string `json:"port"`
+	DownloadFolder  string `json:"download_folder"`
 	Storage         *TorrentStorage
+	Jobs            *JobQueue
 	logger          zerolog.Logger
 	Tags            []string
 	RefreshInterval int
 	SkipPreCache    bool
+
+	strmURL             string
+	maxDownloads        int
+	downloadConnections int
+	downloadRetries     int
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	cancels  map[string]torrentRun // key: torrent hash
+	cancelMu sync.Mutex
+
+	// Global speed limits in bytes/s, 0 is unlimited
+	speedMu          sync.Mutex
+	altSpeedLimits   bool
+	dlRateLimit      int64
+	altDlRateLimit   int64
+	upRateLimit      int64
+	speedSchedules   []config.SpeedSchedule
+	appliedDlLimit   int64
+	dlLimiter        *rate.Limiter
+	categoryLimiters map[string]*rate.Limiter
+
+	sessions *sessions
+
+	db         store.Store
+	categories map[string]config.Category
+	// configCategories are the names of the categories set in the config, they can't be changed through the API
+	configCategories map[string]bool
+	categoryMu       sync.RWMutex
+}
+
+// torrentRun is the context of the background work of a torrent
+type torrentRun struct {
+	ctx    context.Context
+	cancel context.CancelCauseFunc
 }
 
+var (
+	// errTorrentDeleted is the cancel cause of a torrent removed by the user
+	errTorrentDeleted = errors.New("torrent deleted")
+	// errTorrentPaused is the cancel cause of a torrent paused by the user
+	errTorrentPaused = errors.New("torrent paused")
+)
+
 func New() *QBit {
 	_cfg := config.GetConfig()
 	cfg := _cfg.QBitTorrent
 	port := cmp.Or(cfg.Port, os.Getenv("QBIT_PORT"), "8282")
 	refreshInterval := cmp.Or(cfg.RefreshInterval, 10)
-	return &QBit{
+	ctx, cancel := context.WithCancel(context.Background())
+	db := store.GetStore()
+	_logger := logger.NewLogger("qbit", _cfg.LogLevel, os.Stdout)
+	q := &QBit{
 		Username:        cfg.Username,
 		Password:        cfg.Password,
 		Port:            port,
 		DownloadFolder:  cfg.DownloadFolder,
-		Categories:      cfg.Categories,
-		Storage:         NewTorrentStorage(filepath.Join(_cfg.Path, "torrents.json")),
-		logger:          logger.NewLogger("qbit", _cfg.LogLevel, os.Stdout),
+		Storage:         NewTorrentStorage(db, _logger),
+		Jobs:            NewJobQueue(db, cfg.GetMaxJobs(), _logger),
+		logger:          _logger,
 		RefreshInterval: refreshInterval,
 		SkipPreCache:    cfg.SkipPreCache,
+
+		strmURL:             strings.TrimSuffix(cmp.Or(cfg.StrmURL, "http://localhost:"+port), "/"),
+		maxDownloads:        cfg.GetMaxDownloads(),
+		downloadConnections: cfg.GetDownloadConnections(),
+		downloadRetries:     cfg.GetDownloadRetries(),
+		ctx:                 ctx,
+		cancel:              cancel,
+		cancels:             make(map[string]torrentRun),
+		dlRateLimit:         cfg.GetDownloadLimit(),
+		altDlRateLimit:      cfg.GetAltDownloadLimit(),
+		speedSchedules:      cfg.SpeedSchedules,
+		dlLimiter:           newLimiter(0),
+		categoryLimiters:    make(map[string]*rate.Limiter),
+		sessions:            newSessions(cfg.GetSessionTimeout()),
+		db:                  db,
+	}
+	q.loadCategories(cfg.Categories)
+	q.applySpeedLimits()
+	if !cfg.AuthEnabled() {
+		q.logger.Warn().Msg("qBittorrent username and password are not set, the API is open to anyone on the network")
+	}
+	return q
+}
+
+// Start resumes the jobs left in progress and runs the speed schedules. It cancels all in-flight torrent work once ctx is done
+func (q *QBit) Start(ctx context.Context) error {
+	q.resumeJobs()
+	go q.runSpeedSchedules(ctx)
+	go q.pruneJobs(ctx)
+	<-ctx.Done()
+	q.logger.Info().Msg("Stopping torrent processing")
+	q.cancel()
+	return nil
+}
+
+// torrentContext returns a context for the background work of a torrent.
+// It is cancelled when the torrent is deleted, paused or processed again, and on shutdown
+func (q *QBit) torrentContext(hash string) context.Context {
+	q.cancelMu.Lock()
+	defer q.cancelMu.Unlock()
+	if run, ok := q.cancels[hash]; ok {
+		run.cancel(nil)
+	}
+	ctx, cancel := context.WithCancelCause(q.ctx)
+	q.cancels[hash] = torrentRun{ctx: ctx, cancel: cancel}
+	return ctx
+}
+
+// finishTorrent releases the context of a torrent once its work is done.
+// A newer run of the same torrent is left alone
+func (q *QBit) finishTorrent(ctx context.Context, hash string) {
+	q.cancelMu.Lock()
+	defer q.cancelMu.Unlock()
+	if run, ok := q.cancels[hash]; ok && run.ctx == ctx {
+		run.cancel(nil)
+		delete(q.cancels, hash)
+	}
+}
+
+// cancelTorrent stops the in-flight work of a torrent with the cause, e.g errTorrentDeleted
+func (q *QBit) cancelTorrent(hash string, cause error) {
+	q.cancelMu.Lock()
+	defer q.cancelMu.Unlock()
+	if run, ok := q.cancels[hash]; ok {
+		run.cancel(cause)
+		delete(q.cancels, hash)
+	}
+}
+
+func (q *QBit) DeleteTorrent(hash, category string) {
+	q.cancelTorrent(hash, errTorrentDeleted)
+	q.Storage.Delete(hash, category)
+	q.Jobs.Delete(hash, category)
+}
+
+func (q *QBit) DeleteTorrents(hashes []string) {
+	for _, hash := range hashes {
+		q.cancelTorrent(hash, errTorrentDeleted)
 	}
+	q.Storage.DeleteMultiple(hashes)
+	q.Jobs.DeleteMultiple(hashes)
 }
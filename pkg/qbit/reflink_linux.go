@@ -0,0 +1,28 @@
+//go:build linux
+
+package qbit
+
+import (
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// reflink clones src to dst, they share their blocks until either is modified.
+// Only filesystems like btrfs and xfs support it, and only within the same filesystem
+func reflink(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err != nil {
+		_ = out.Close()
+		_ = os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package qbit
+
+import "errors"
+
+// reflink is only supported on Linux, the file is copied instead
+func reflink(src, dst string) error {
+	return errors.ErrUnsupported
+}
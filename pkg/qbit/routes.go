@@ -11,6 +11,11 @@ func (q *QBit) Routes() http.Handler {
 	r.Group(func(r chi.Router) {
 		r.Use(q.authContext)
 		r.Post("/auth/login", q.handleLogin)
+		r.Post("/auth/logout", q.handleLogout)
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(q.requireAuth)
+		r.Use(q.authContext)
 		r.Route("/torrents", func(r chi.Router) {
 			r.Use(HashesCtx)
 			r.Get("/info", q.handleTorrentsInfo)
@@ -18,6 +23,8 @@ func (q *QBit) Routes() http.Handler {
 			r.Post("/delete", q.handleTorrentsDelete)
 			r.Get("/categories", q.handleCategories)
 			r.Post("/createCategory", q.handleCreateCategory)
+			r.Post("/editCategory", q.handleEditCategory)
+			r.Post("/removeCategories", q.handleRemoveCategories)
 			r.Post("/setCategory", q.handleSetCategory)
 			r.Post("/addTags", q.handleAddTorrentTags)
 			r.Post("/removeTags", q.handleRemoveTorrentTags)
@@ -28,6 +35,24 @@ func (q *QBit) Routes() http.Handler {
 			r.Get("/recheck", q.handleTorrentRecheck)
 			r.Get("/properties", q.handleTorrentProperties)
 			r.Get("/files", q.handleTorrentFiles)
+			r.Post("/filePrio", q.handleSetFilePrio)
+			r.Post("/setFilePrio", q.handleSetFilePrio) // v1 name, kept for older clients
+			r.Post("/renameFile", q.handleRenameFile)
+			r.Post("/renameFolder", q.handleRenameFolder)
+		})
+
+		r.Route("/transfer", func(r chi.Router) {
+			r.Get("/info", q.handleTransferInfo)
+			r.Get("/speedLimitsMode", q.handleSpeedLimitsMode)
+			r.Post("/toggleSpeedLimitsMode", q.handleToggleSpeedLimitsMode)
+			r.Get("/downloadLimit", q.handleDownloadLimit)
+			r.Post("/setDownloadLimit", q.handleSetDownloadLimit)
+			r.Get("/uploadLimit", q.handleUploadLimit)
+			r.Post("/setUploadLimit", q.handleSetUploadLimit)
+		})
+
+		r.Route("/sync", func(r chi.Router) {
+			r.Get("/maindata", q.handleSyncMainData)
 		})
 
 		r.Route("/app", func(r chi.Router) {
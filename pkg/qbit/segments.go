@@ -0,0 +1,347 @@
+package qbit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Files smaller than two segments are downloaded over a single connection
+	minSegmentSize = 32 << 20
+	// How often the progress of the segments is saved
+	stateSaveInterval = 2 * time.Second
+	// A segment whose connection sends nothing for this long is dropped, to be retried
+	readIdleTimeout = time.Minute
+)
+
+var contentRangeRegex = regexp.MustCompile(`^bytes \d+-\d+/(\d+)$`)
+
+// errRangeIgnored means the server sent the whole file for a range request
+var errRangeIgnored = errors.New("server ignored the range request")
+
+// errReadIdle is the cancel cause of a segment whose connection stalled
+var errReadIdle = fmt.Errorf("no data received for %s", readIdleTimeout)
+
+// segment is a byte range of a file downloaded over its own connection
+type segment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"` // Inclusive
+	Done  int64 `json:"done"`
+}
+
+func (s *segment) remaining() int64 {
+	return s.End - s.Start + 1 - s.Done
+}
+
+// downloadState is saved next to the partial file so a download continues after a restart
+type downloadState struct {
+	Size     int64      `json:"size"`
+	Ranges   bool       `json:"ranges"` // Whether the server supports range requests
+	Segments []*segment `json:"segments"`
+}
+
+// segmentedDownload downloads a file in segments to filename.part, then moves it in place.
+// The state of the segments is kept in filename.part.json
+type segmentedDownload struct {
+	client      *http.Client
+	url         string
+	filename    string
+	size        int64 // Expected size, 0 if the debrid didn't report it
+	connections int
+	progress    func(int64)
+	throttle    func(ctx context.Context, n int) error // Waits for the speed limits, nil is unlimited
+
+	state   *downloadState
+	stateMu sync.Mutex
+}
+
+func (d *segmentedDownload) partFile() string {
+	return d.filename + ".part"
+}
+
+func (d *segmentedDownload) stateFile() string {
+	return d.filename + ".part.json"
+}
+
+// Run downloads the missing parts of the file. A file already saved with the expected size is left as is
+func (d *segmentedDownload) Run(ctx context.Context) error {
+	if info, err := os.Stat(d.filename); err == nil && d.size > 0 && info.Size() == d.size {
+		d.progress(d.size)
+		return nil
+	}
+	if err := d.loadState(ctx); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(d.partFile(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(d.state.Size); err != nil {
+		return err
+	}
+
+	var done int64
+	for _, s := range d.state.Segments {
+		done += s.Done
+	}
+	d.progress(done)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	saved := make(chan struct{})
+	go func() {
+		defer close(saved)
+		d.saveStateEvery(ctx)
+	}()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	for _, s := range d.state.Segments {
+		if s.remaining() <= 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(s *segment) {
+			defer wg.Done()
+			if err := d.fetch(ctx, f, s); err != nil {
+				errOnce.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(s)
+	}
+	wg.Wait()
+	cancel()
+	<-saved
+	if err := d.saveState(); err != nil {
+		return err
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return d.finish()
+}
+
+// finish checks the size of the partial file and moves it in place
+func (d *segmentedDownload) finish() error {
+	info, err := os.Stat(d.partFile())
+	if err != nil {
+		return err
+	}
+	if info.Size() != d.state.Size {
+		return fmt.Errorf("size mismatch: got %d bytes, expected %d", info.Size(), d.state.Size)
+	}
+	if err := os.Rename(d.partFile(), d.filename); err != nil {
+		return err
+	}
+	_ = os.Remove(d.stateFile())
+	return nil
+}
+
+// loadState reads the saved segments. A new state is planned if there is none or it doesn't match the file
+func (d *segmentedDownload) loadState(ctx context.Context) error {
+	if data, err := os.ReadFile(d.stateFile()); err == nil {
+		state := &downloadState{}
+		if json.Unmarshal(data, state) == nil && (d.size == 0 || state.Size == d.size) && state.Ranges {
+			if _, err := os.Stat(d.partFile()); err == nil {
+				d.state = state
+				return nil
+			}
+		}
+	}
+	size, ranges, err := d.probe(ctx)
+	if err != nil {
+		return err
+	}
+	if d.size > 0 && size != d.size {
+		return fmt.Errorf("size mismatch: the server has %d bytes, expected %d", size, d.size)
+	}
+	d.state = &downloadState{
+		Size:     size,
+		Ranges:   ranges,
+		Segments: planSegments(size, ranges, d.connections),
+	}
+	_ = os.Remove(d.partFile())
+	return d.saveState()
+}
+
+// probe asks for the first byte to learn the size of the file and whether ranges are supported
+func (d *segmentedDownload) probe(ctx context.Context) (int64, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		m := contentRangeRegex.FindStringSubmatch(resp.Header.Get("Content-Range"))
+		if m == nil {
+			return 0, false, fmt.Errorf("invalid Content-Range: %q", resp.Header.Get("Content-Range"))
+		}
+		size, _ := strconv.ParseInt(m[1], 10, 64)
+		return size, true, nil
+	case http.StatusOK:
+		if resp.ContentLength < 0 {
+			return 0, false, fmt.Errorf("unknown file size")
+		}
+		return resp.ContentLength, false, nil
+	default:
+		return 0, false, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+}
+
+// planSegments splits a file in up to n segments of at least minSegmentSize
+func planSegments(size int64, ranges bool, n int) []*segment {
+	if !ranges || n < 1 {
+		n = 1
+	}
+	n = int(min(int64(n), max(size/minSegmentSize, 1)))
+	segments := make([]*segment, 0, n)
+	length := size / int64(n)
+	for i := 0; i < n; i++ {
+		s := &segment{Start: int64(i) * length, End: int64(i+1)*length - 1}
+		if i == n-1 {
+			s.End = size - 1
+		}
+		segments = append(segments, s)
+	}
+	return segments
+}
+
+// idleReader resets the idle timer of a segment every time data is read
+type idleReader struct {
+	r     io.Reader
+	timer *time.Timer
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.timer.Reset(readIdleTimeout)
+	}
+	return n, err
+}
+
+// fetch downloads the rest of a segment into the file.
+// The request is cancelled once the server sends nothing for readIdleTimeout, a stalled body would block forever
+func (d *segmentedDownload) fetch(ctx context.Context, f *os.File, s *segment) (err error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	idle := time.AfterFunc(readIdleTimeout, func() { cancel(errReadIdle) })
+	defer idle.Stop()
+	defer func() {
+		if err != nil && errors.Is(context.Cause(ctx), errReadIdle) {
+			err = errReadIdle
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return err
+	}
+	d.stateMu.Lock()
+	offset := s.Start + s.Done
+	d.stateMu.Unlock()
+	if d.state.Ranges {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, s.End))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case d.state.Ranges && resp.StatusCode == http.StatusOK:
+		return errRangeIgnored
+	case resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent:
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	body := &idleReader{r: resp.Body, timer: idle}
+	buf := make([]byte, bandwidthBurst)
+	for offset <= s.End {
+		idle.Reset(readIdleTimeout)
+		n, err := io.ReadFull(body, buf[:min(int64(len(buf)), s.End-offset+1)])
+		if n > 0 {
+			if _, werr := f.WriteAt(buf[:n], offset); werr != nil {
+				return werr
+			}
+			offset += int64(n)
+			d.stateMu.Lock()
+			s.Done += int64(n)
+			d.stateMu.Unlock()
+			d.progress(int64(n))
+			if d.throttle != nil {
+				// Waiting for the speed limit isn't a stall
+				idle.Stop()
+				if terr := d.throttle(ctx, n); terr != nil {
+					return terr
+				}
+			}
+		}
+		if err != nil {
+			if offset > s.End {
+				break
+			}
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return fmt.Errorf("connection closed after %d bytes: %w", offset, io.ErrUnexpectedEOF)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *segmentedDownload) saveStateEvery(ctx context.Context) {
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			_ = d.saveState()
+		}
+	}
+}
+
+func (d *segmentedDownload) saveState() error {
+	if !d.state.Ranges {
+		// The download starts over anyway
+		return nil
+	}
+	d.stateMu.Lock()
+	data, err := json.Marshal(d.state)
+	d.stateMu.Unlock()
+	if err != nil {
+		return err
+	}
+	// Write then rename, an interrupted write leaves the previous state
+	tmp := d.stateFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.stateFile())
+}
@@ -0,0 +1,124 @@
+package qbit
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"github.com/sirrobot01/debrid-blackhole/internal/config"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sessionCookie = "SID"
+
+// sessions holds the SID cookies of logged in clients. A session expires once unused for the timeout
+type sessions struct {
+	mu      sync.Mutex
+	expiry  map[string]time.Time
+	timeout time.Duration
+}
+
+func newSessions(timeout time.Duration) *sessions {
+	return &sessions{
+		expiry:  make(map[string]time.Time),
+		timeout: timeout,
+	}
+}
+
+func (s *sessions) create() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	sid := hex.EncodeToString(b)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for id, expiry := range s.expiry {
+		if now.After(expiry) {
+			delete(s.expiry, id)
+		}
+	}
+	s.expiry[sid] = now.Add(s.timeout)
+	return sid
+}
+
+// valid reports whether the session exists and extends it
+func (s *sessions) valid(sid string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expiry, ok := s.expiry[sid]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiry) {
+		delete(s.expiry, sid)
+		return false
+	}
+	s.expiry[sid] = time.Now().Add(s.timeout)
+	return true
+}
+
+func (s *sessions) delete(sid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.expiry, sid)
+}
+
+func equalSecret(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// checkCredentials reports whether the username and password are valid for the API.
+// Arrs may log in with their host and token if they're in the config
+func (q *QBit) checkCredentials(username, password string) bool {
+	cfg := config.GetConfig()
+	qc := cfg.QBitTorrent
+	if equalSecret(username, qc.Username) && equalSecret(password, qc.Password) {
+		return true
+	}
+	if !qc.GetArrCredentials() || username == "" || password == "" {
+		return false
+	}
+	host := strings.TrimSuffix(strings.TrimSpace(username), "/")
+	for _, a := range cfg.Arrs {
+		if strings.TrimSuffix(a.Host, "/") == host && equalSecret(strings.TrimSpace(password), a.Token) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAuthenticated checks the SID cookie, then basic auth credentials
+func (q *QBit) isAuthenticated(r *http.Request) bool {
+	if !config.GetConfig().QBitTorrent.AuthEnabled() {
+		return true
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil && q.sessions.valid(cookie.Value) {
+		return true
+	}
+	username, password, err := decodeAuthHeader(r.Header.Get("Authorization"))
+	return err == nil && username != "" && q.checkCredentials(username, password)
+}
+
+// requireAuth rejects requests without a valid session, like qBittorrent does
+func (q *QBit) requireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !q.isAuthenticated(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (q *QBit) setSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    q.sessions.create(),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
@@ -3,6 +3,8 @@ package qbit
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/sirrobot01/debrid-blackhole/internal/store"
 	"os"
 	"sort"
 	"sync"
@@ -20,56 +22,58 @@ type Torrents = map[string]*Torrent
 type TorrentStorage struct {
 	torrents Torrents
 	mu       sync.RWMutex
-	filename string // Added to store the filename for persistence
+	db       store.Store
+	logger   zerolog.Logger
+
+	// sync/maindata revisions
+	rid       int64
+	snapshots map[int64]*syncSnapshot
+	syncMu    sync.Mutex
 }
 
-func loadTorrentsFromJSON(filename string) (Torrents, error) {
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, err
-	}
+func loadTorrents(db store.Store) (Torrents, error) {
 	torrents := make(Torrents)
-	if err := json.Unmarshal(data, &torrents); err != nil {
-		return nil, err
-	}
-	return torrents, nil
+	err := db.ForEach(store.TorrentsBucket, func(key string, data []byte) error {
+		torrent := &Torrent{}
+		if err := json.Unmarshal(data, torrent); err != nil {
+			return fmt.Errorf("error loading torrent %s: %w", key, err)
+		}
+		torrents[key] = torrent
+		return nil
+	})
+	return torrents, err
 }
 
-func NewTorrentStorage(filename string) *TorrentStorage {
-	// Open the JSON file and read the data
-	torrents, err := loadTorrentsFromJSON(filename)
+func NewTorrentStorage(db store.Store, logger zerolog.Logger) *TorrentStorage {
+	torrents, err := loadTorrents(db)
 	if err != nil {
-		torrents = make(Torrents)
+		logger.Error().Err(err).Msg("Error loading the torrents")
 	}
-	// Create a new TorrentStorage
 	return &TorrentStorage{
-		torrents: torrents,
-		filename: filename,
+		torrents:  torrents,
+		db:        db,
+		logger:    logger,
+		snapshots: make(map[int64]*syncSnapshot),
 	}
 }
 
 func (ts *TorrentStorage) Add(torrent *Torrent) {
-	ts.mu.Lock()
-	defer ts.mu.Unlock()
-	ts.torrents[keyPair(torrent.Hash, torrent.Category)] = torrent
-	go func() {
-		err := ts.saveToFile()
-		if err != nil {
-			fmt.Println(err)
-		}
-	}()
+	ts.AddOrUpdate(torrent)
 }
 
 func (ts *TorrentStorage) AddOrUpdate(torrent *Torrent) {
+	key := keyPair(torrent.Hash, torrent.Category)
 	ts.mu.Lock()
-	defer ts.mu.Unlock()
-	ts.torrents[keyPair(torrent.Hash, torrent.Category)] = torrent
-	go func() {
-		err := ts.saveToFile()
-		if err != nil {
-			fmt.Println(err)
-		}
-	}()
+	ts.torrents[key] = torrent
+	ts.mu.Unlock()
+	ts.save(key, torrent)
+}
+
+// save writes a single torrent
+func (ts *TorrentStorage) save(key string, torrent *Torrent) {
+	if err := ts.db.Put(store.TorrentsBucket, key, torrent); err != nil {
+		ts.logger.Error().Err(err).Msgf("Error saving torrent %s", key)
+	}
 }
 
 func (ts *TorrentStorage) Get(hash, category string) *Torrent {
@@ -155,20 +159,11 @@ func (ts *TorrentStorage) GetAllSorted(category string, filter string, hashes []
 }
 
 func (ts *TorrentStorage) Update(torrent *Torrent) {
-	ts.mu.Lock()
-	defer ts.mu.Unlock()
-	ts.torrents[keyPair(torrent.Hash, torrent.Category)] = torrent
-	go func() {
-		err := ts.saveToFile()
-		if err != nil {
-			fmt.Println(err)
-		}
-	}()
+	ts.AddOrUpdate(torrent)
 }
 
 func (ts *TorrentStorage) Delete(hash, category string) {
 	ts.mu.Lock()
-	defer ts.mu.Unlock()
 	key := keyPair(hash, category)
 	torrent, exists := ts.torrents[key]
 	if !exists && category == "" {
@@ -182,53 +177,46 @@ func (ts *TorrentStorage) Delete(hash, category string) {
 		}
 	}
 	delete(ts.torrents, key)
+	ts.mu.Unlock()
 	if torrent == nil {
 		return
 	}
+	if err := ts.db.Delete(store.TorrentsBucket, key); err != nil {
+		ts.logger.Error().Err(err).Msgf("Error deleting torrent %s", key)
+	}
 	// Delete the torrent folder
 	if torrent.ContentPath != "" {
-		err := os.RemoveAll(torrent.ContentPath)
-		if err != nil {
-			return
-		}
+		_ = os.RemoveAll(torrent.ContentPath)
 	}
-	go func() {
-		err := ts.saveToFile()
-		if err != nil {
-			fmt.Println(err)
-		}
-	}()
 }
 
 func (ts *TorrentStorage) DeleteMultiple(hashes []string) {
 	ts.mu.Lock()
-	defer ts.mu.Unlock()
+	keys := make([]string, 0, len(hashes))
 	for _, hash := range hashes {
 		for key, torrent := range ts.torrents {
 			if torrent.Hash == hash {
 				delete(ts.torrents, key)
+				keys = append(keys, key)
 			}
 		}
 	}
-	go func() {
-		err := ts.saveToFile()
-		if err != nil {
-			fmt.Println(err)
-		}
-	}()
+	ts.mu.Unlock()
+	if err := ts.db.Delete(store.TorrentsBucket, keys...); err != nil {
+		ts.logger.Error().Err(err).Msgf("Error deleting %d torrents", len(keys))
+	}
 }
 
+// Save writes all the torrents in one transaction
 func (ts *TorrentStorage) Save() error {
-	return ts.saveToFile()
-}
-
-// saveToFile is a helper function to write the current state to the JSON file
-func (ts *TorrentStorage) saveToFile() error {
 	ts.mu.RLock()
-	data, err := json.MarshalIndent(ts.torrents, "", "  ")
-	ts.mu.RUnlock()
-	if err != nil {
-		return err
-	}
-	return os.WriteFile(ts.filename, data, 0644)
+	defer ts.mu.RUnlock()
+	return ts.db.Update(func(tx store.Tx) error {
+		for key, torrent := range ts.torrents {
+			if err := tx.Put(store.TorrentsBucket, key, torrent); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
@@ -0,0 +1,138 @@
+package qbit
+
+import (
+	"encoding/json"
+	"maps"
+	"reflect"
+	"slices"
+)
+
+// How many revisions are kept for sync/maindata. Clients with an older rid get a full update
+const maxSyncSnapshots = 32
+
+// syncSnapshot is the state sent to a sync/maindata client at a revision
+type syncSnapshot struct {
+	torrents    map[string]map[string]any
+	categories  map[string]TorrentCategory
+	tags        []string
+	serverState map[string]any
+}
+
+// toMap returns the fields of v as sent by the API
+func toMap(v any) map[string]any {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	m := make(map[string]any)
+	_ = json.Unmarshal(data, &m)
+	return m
+}
+
+// diffMap returns the fields of current that changed since previous
+func diffMap(previous, current map[string]any) map[string]any {
+	diff := make(map[string]any)
+	for key, value := range current {
+		if old, ok := previous[key]; !ok || !reflect.DeepEqual(old, value) {
+			diff[key] = value
+		}
+	}
+	return diff
+}
+
+// Sync returns the changes since rid and records the current state as a new revision.
+// A rid of 0 or one that's no longer known gets a full update
+func (ts *TorrentStorage) Sync(rid int64, categories map[string]TorrentCategory, tags []string, state ServerState) *MainData {
+	current := &syncSnapshot{
+		torrents:    make(map[string]map[string]any),
+		categories:  categories,
+		tags:        slices.Clone(tags),
+		serverState: toMap(state),
+	}
+	for _, t := range ts.GetAll("", "", nil) {
+		current.torrents[t.Hash] = toMap(t)
+	}
+
+	ts.syncMu.Lock()
+	defer ts.syncMu.Unlock()
+	previous, ok := ts.snapshots[rid]
+	ts.rid++
+	ts.snapshots[ts.rid] = current
+	if len(ts.snapshots) > maxSyncSnapshots {
+		delete(ts.snapshots, slices.Min(slices.Collect(maps.Keys(ts.snapshots))))
+	}
+
+	data := &MainData{Rid: ts.rid}
+	if rid == 0 || !ok {
+		data.FullUpdate = true
+		data.Torrents = current.torrents
+		data.Categories = current.categories
+		data.Tags = current.tags
+		data.ServerState = current.serverState
+		return data
+	}
+
+	data.Torrents = make(map[string]map[string]any)
+	for hash, t := range current.torrents {
+		old, exists := previous.torrents[hash]
+		if !exists {
+			data.Torrents[hash] = t
+			continue
+		}
+		if diff := diffMap(old, t); len(diff) > 0 {
+			data.Torrents[hash] = diff
+		}
+	}
+	for hash := range previous.torrents {
+		if _, exists := current.torrents[hash]; !exists {
+			data.TorrentsRemoved = append(data.TorrentsRemoved, hash)
+		}
+	}
+
+	data.Categories = make(map[string]TorrentCategory)
+	for name, c := range current.categories {
+		if old, exists := previous.categories[name]; !exists || old != c {
+			data.Categories[name] = c
+		}
+	}
+	for name := range previous.categories {
+		if _, exists := current.categories[name]; !exists {
+			data.CategoriesRemoved = append(data.CategoriesRemoved, name)
+		}
+	}
+
+	for _, tag := range current.tags {
+		if !slices.Contains(previous.tags, tag) {
+			data.Tags = append(data.Tags, tag)
+		}
+	}
+	for _, tag := range previous.tags {
+		if !slices.Contains(current.tags, tag) {
+			data.TagsRemoved = append(data.TagsRemoved, tag)
+		}
+	}
+
+	if diff := diffMap(previous.serverState, current.serverState); len(diff) > 0 {
+		data.ServerState = diff
+	}
+	return data
+}
+
+// GetServerState sums up the transfer of all torrents, debrid and local downloads alike
+func (q *QBit) GetServerState() ServerState {
+	state := ServerState{
+		ConnectionStatus: "connected",
+		DHTNodes:         0,
+		RefreshInterval:  1500,
+	}
+	for _, t := range q.Storage.GetAll("", "", nil) {
+		state.DlInfoSpeed += t.Dlspeed
+		state.UpInfoSpeed += t.Upspeed
+		state.DlInfoData += t.DownloadedSession
+		state.UpInfoData += t.UploadedSession
+		state.AllTimeDl += t.Downloaded
+		state.AllTimeUl += t.Uploaded
+	}
+	state.UseAltSpeedLimits, state.DlRateLimit, state.UpRateLimit = q.GetSpeedLimits()
+	return state
+}
@@ -3,11 +3,13 @@ package qbit
 import (
 	"cmp"
 	"context"
+	"errors"
 	"fmt"
+	"github.com/sirrobot01/debrid-blackhole/internal/config"
 	"github.com/sirrobot01/debrid-blackhole/internal/request"
 	"github.com/sirrobot01/debrid-blackhole/internal/utils"
 	"github.com/sirrobot01/debrid-blackhole/pkg/arr"
-	db "github.com/sirrobot01/debrid-blackhole/pkg/debrid"
+	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/engine"
 	debrid "github.com/sirrobot01/debrid-blackhole/pkg/debrid/torrent"
 	"github.com/sirrobot01/debrid-blackhole/pkg/service"
 	"io"
@@ -49,39 +51,49 @@ func (q *QBit) AddTorrent(ctx context.Context, fileHeader *multipart.FileHeader,
 }
 
 func (q *QBit) Process(ctx context.Context, magnet *utils.Magnet, category string) error {
-	svc := service.GetService()
 	torrent := CreateTorrentFromMagnet(magnet, category, "auto")
 	a, ok := ctx.Value("arr").(*arr.Arr)
 	if !ok {
 		return fmt.Errorf("arr not found in context")
 	}
 	isSymlink := ctx.Value("isSymlink").(bool)
-	debridTorrent, err := db.ProcessTorrent(svc.Debrid, magnet, a, isSymlink, false)
-	if err != nil || debridTorrent == nil {
-		if debridTorrent != nil {
-			dbClient := service.GetDebrid().GetByName(debridTorrent.Debrid)
-			go dbClient.DeleteTorrent(debridTorrent)
-		}
-		if err == nil {
-			err = fmt.Errorf("failed to process torrent")
-		}
-		return err
-	}
-	torrent = q.UpdateTorrentMin(torrent, debridTorrent)
-	q.Storage.AddOrUpdate(torrent)
-	go q.ProcessFiles(torrent, debridTorrent, a, isSymlink) // We can send async for file processing not to delay the response
+	cat := q.GetCategory(category)
+	// The job queue submits the torrent, not to delay the response
+	q.enqueue(torrent, magnet, a, isSymlink, cat.DownloadUncached, cat.Debrid)
 	return nil
 }
 
-func (q *QBit) ProcessFiles(torrent *Torrent, debridTorrent *debrid.Torrent, arr *arr.Arr, isSymlink bool) {
+// handleCancelled cleans up after the torrent context is done.
+// Deleted torrents are removed from the debrid too, paused torrents and torrents stopped on shutdown are left as is
+func (q *QBit) handleCancelled(ctx context.Context, debridClient engine.Service, debridTorrent *debrid.Torrent) {
+	switch cause := context.Cause(ctx); {
+	case errors.Is(cause, errTorrentDeleted):
+		q.logger.Info().Msgf("Torrent %s deleted, stopping processing", debridTorrent.Name)
+		go debridClient.DeleteTorrent(context.WithoutCancel(ctx), debridTorrent)
+		return
+	case errors.Is(cause, errTorrentPaused):
+		q.logger.Info().Msgf("Torrent %s paused", debridTorrent.Name)
+		return
+	}
+	q.logger.Info().Msgf("Stopped processing %s", debridTorrent.Name)
+}
+
+func (q *QBit) ProcessFiles(ctx context.Context, torrent *Torrent, debridTorrent *debrid.Torrent, arr *arr.Arr, isSymlink bool) {
 	debridClient := service.GetDebrid().GetByName(debridTorrent.Debrid)
+	defer service.GetDebrid().Release(debridClient.GetName())
+	defer q.finishTorrent(ctx, torrent.Hash)
+	var sub *engine.Subscription
 	for debridTorrent.Status != "downloaded" {
 		q.logger.Debug().Msgf("%s <- (%s) Download Progress: %.2f%%", debridTorrent.Debrid, debridTorrent.Name, debridTorrent.Progress)
-		dbT, err := debridClient.CheckStatus(debridTorrent, isSymlink)
+		dbT, err := debridClient.CheckStatus(ctx, debridTorrent, isSymlink)
+		if ctx.Err() != nil {
+			q.handleCancelled(ctx, debridClient, debridTorrent)
+			return
+		}
 		if err != nil {
 			q.logger.Error().Msgf("Error checking status: %v", err)
-			go debridClient.DeleteTorrent(debridTorrent)
-			q.MarkAsFailed(torrent)
+			go debridClient.DeleteTorrent(context.WithoutCancel(ctx), debridTorrent)
+			q.MarkAsFailed(torrent, err)
 			if err := arr.Refresh(); err != nil {
 				q.logger.Error().Msgf("Error refreshing arr: %v", err)
 			}
@@ -95,26 +107,48 @@ func (q *QBit) ProcessFiles(torrent *Torrent, debridTorrent *debrid.Torrent, arr
 		if !slices.Contains(debridClient.GetDownloadingStatus(), debridTorrent.Status) {
 			break
 		}
-		time.Sleep(time.Duration(q.RefreshInterval) * time.Second)
+		// Wait for the debrid tracker to report a status change instead of polling the torrent
+		if sub == nil {
+			sub = service.GetDebrid().Tracker(debridClient.GetName()).Subscribe(debridTorrent.Id)
+			defer sub.Close()
+		}
+		if !q.waitForStatus(ctx, sub, torrent, debridTorrent, debridClient.GetDownloadingStatus()) {
+			q.handleCancelled(ctx, debridClient, debridTorrent)
+			return
+		}
 	}
 	var (
 		torrentSymlinkPath string
 		err                error
 	)
+	if !q.Jobs.acquire(ctx) {
+		q.handleCancelled(ctx, debridClient, debridTorrent)
+		return
+	}
+	defer q.Jobs.release()
+	q.Jobs.SetState(torrent.Hash, torrent.Category, JobLinking, nil)
 	debridTorrent.Arr = arr
-	if isSymlink {
-		torrentSymlinkPath, err = q.ProcessSymlink(torrent) // /mnt/symlinks/{category}/MyTVShow/
-	} else {
-		torrentSymlinkPath, err = q.ProcessManualFile(torrent)
+	switch action := q.outputAction(torrent.Category, isSymlink); action {
+	case config.CategoryActionDownload:
+		torrentSymlinkPath, err = q.ProcessManualFile(ctx, torrent)
+	case config.CategoryActionStrm:
+		torrentSymlinkPath, err = q.ProcessStrm(ctx, torrent)
+	default:
+		torrentSymlinkPath, err = q.ProcessMount(ctx, torrent, action) // /mnt/symlinks/{category}/MyTVShow/
+	}
+	if ctx.Err() != nil {
+		q.handleCancelled(ctx, debridClient, debridTorrent)
+		return
 	}
 	if err != nil {
-		q.MarkAsFailed(torrent)
-		go debridClient.DeleteTorrent(debridTorrent)
+		q.MarkAsFailed(torrent, err)
+		go debridClient.DeleteTorrent(context.WithoutCancel(ctx), debridTorrent)
 		q.logger.Info().Msgf("Error: %v", err)
 		return
 	}
 	torrent.TorrentPath = torrentSymlinkPath
-	q.UpdateTorrent(torrent, debridTorrent)
+	q.UpdateTorrent(ctx, torrent, debridTorrent)
+	q.Jobs.SetState(torrent.Hash, torrent.Category, JobDone, nil)
 	go func() {
 		if err := request.SendDiscordMessage("download_complete", "success", torrent.discordContext()); err != nil {
 			q.logger.Error().Msgf("Error sending discord message: %v", err)
@@ -125,9 +159,37 @@ func (q *QBit) ProcessFiles(torrent *Torrent, debridTorrent *debrid.Torrent, arr
 	}
 }
 
-func (q *QBit) MarkAsFailed(t *Torrent) *Torrent {
+// waitForStatus applies the tracker updates to the torrent until it leaves the downloading statuses.
+// It returns false if the context is done first
+func (q *QBit) waitForStatus(ctx context.Context, sub *engine.Subscription, torrent *Torrent, debridTorrent *debrid.Torrent, downloading []string) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case u := <-sub.C:
+			if u.Removed {
+				// CheckStatus reports the error
+				return true
+			}
+			debridTorrent.Mu.Lock()
+			debridTorrent.Progress = u.Progress
+			debridTorrent.Speed = u.Speed
+			debridTorrent.Seeders = u.Seeders
+			debridTorrent.Mu.Unlock()
+			q.UpdateTorrentMin(torrent, debridTorrent)
+			q.logger.Debug().Msgf("%s <- (%s) Download Progress: %.2f%%", debridTorrent.Debrid, debridTorrent.Name, u.Progress)
+			if !slices.Contains(downloading, u.Status) {
+				return true
+			}
+		}
+	}
+}
+
+// MarkAsFailed puts the torrent in the error state and fails its job with err
+func (q *QBit) MarkAsFailed(t *Torrent, err error) *Torrent {
 	t.State = "error"
 	q.Storage.AddOrUpdate(t)
+	q.Jobs.SetState(t.Hash, t.Category, JobFailed, err)
 	go func() {
 		if err := request.SendDiscordMessage("download_failed", "error", t.discordContext()); err != nil {
 			q.logger.Error().Msgf("Error sending discord message: %v", err)
@@ -145,7 +207,7 @@ func (q *QBit) UpdateTorrentMin(t *Torrent, debridTorrent *debrid.Torrent) *Torr
 	if err != nil {
 		addedOn = time.Now()
 	}
-	totalSize := debridTorrent.Bytes
+	totalSize := debridTorrent.SelectedSize()
 	progress := cmp.Or(debridTorrent.Progress, 100)
 	progress = progress / 100.0
 	sizeCompleted := int64(float64(totalSize) * progress)
@@ -163,6 +225,7 @@ func (q *QBit) UpdateTorrentMin(t *Torrent, debridTorrent *debrid.Torrent) *Torr
 	t.AddedOn = addedOn.Unix()
 	t.DebridTorrent = debridTorrent
 	t.Debrid = debridTorrent.Debrid
+	t.DebridKey = debridTorrent.KeyId
 	t.Size = totalSize
 	t.Completed = sizeCompleted
 	t.Downloaded = sizeCompleted
@@ -174,18 +237,18 @@ func (q *QBit) UpdateTorrentMin(t *Torrent, debridTorrent *debrid.Torrent) *Torr
 	t.Eta = eta
 	t.Dlspeed = speed
 	t.Upspeed = speed
-	t.SavePath = filepath.Join(q.DownloadFolder, t.Category) + string(os.PathSeparator)
+	t.SavePath = q.GetSavePath(t.Category) + string(os.PathSeparator)
 	t.ContentPath = filepath.Join(t.SavePath, t.Name) + string(os.PathSeparator)
 	return t
 }
 
-func (q *QBit) UpdateTorrent(t *Torrent, debridTorrent *debrid.Torrent) *Torrent {
+func (q *QBit) UpdateTorrent(ctx context.Context, t *Torrent, debridTorrent *debrid.Torrent) *Torrent {
 	if debridTorrent == nil {
 		return t
 	}
 	_db := service.GetDebrid().GetByName(debridTorrent.Debrid)
 	if debridTorrent.Status != "downloaded" {
-		debridTorrent, _ = _db.GetTorrent(debridTorrent)
+		debridTorrent, _ = _db.GetTorrent(ctx, debridTorrent)
 	}
 	t = q.UpdateTorrentMin(t, debridTorrent)
 	t.ContentPath = t.TorrentPath + string(os.PathSeparator)
@@ -207,27 +270,183 @@ func (q *QBit) UpdateTorrent(t *Torrent, debridTorrent *debrid.Torrent) *Torrent
 				q.Storage.Update(t)
 				return t
 			}
-			updatedT := q.UpdateTorrent(t, debridTorrent)
+			updatedT := q.UpdateTorrent(ctx, t, debridTorrent)
 			t = updatedT
 
+		case <-ctx.Done():
+			return t
 		case <-time.After(10 * time.Minute): // Add a timeout
 			return t
 		}
 	}
 }
 
+// ResumeTorrent processes a paused torrent again. Saved files are kept, so it continues where it stopped
 func (q *QBit) ResumeTorrent(t *Torrent) bool {
+	if t.State != "pausedDL" {
+		return false
+	}
+	t.State = "downloading"
+	q.Storage.Update(t)
+	go q.restartTorrent(t)
 	return true
 }
 
+// PauseTorrent stops polling the debrid and downloading the files of a torrent until it is resumed.
+// Completed torrents are already paused
 func (q *QBit) PauseTorrent(t *Torrent) bool {
+	if t.State == "pausedUP" || t.State == "pausedDL" || t.State == "error" {
+		return false
+	}
+	q.cancelTorrent(t.Hash, errTorrentPaused)
+	t.State = "pausedDL"
+	q.Storage.Update(t)
 	return true
 }
 
+// RefreshTorrent rechecks the saved files of a torrent against the debrid file list.
+// Broken symlinks and missing or truncated files are processed again, a paused torrent repairs them once resumed.
+// Torrents still being processed are left alone, their files aren't all saved yet
 func (q *QBit) RefreshTorrent(t *Torrent) bool {
+	if t.State == "error" || t.Debrid == "" {
+		// Nothing was saved yet
+		return false
+	}
+	isSymlink := !t.SeqDl
+	switch t.State {
+	case "pausedDL":
+		if t.DebridTorrent != nil {
+			q.removeBrokenFiles(t, t.DebridTorrent, q.outputAction(t.Category, isSymlink))
+		}
+		return true
+	case "pausedUP":
+	default:
+		q.logger.Debug().Msgf("Not rechecking %s, it is still being processed", t.Name)
+		return false
+	}
+	state := t.State
+	t.State = "checkingUP"
+	q.Storage.Update(t)
+	ctx, cancel := context.WithTimeout(q.ctx, time.Minute)
+	defer cancel()
+	debridTorrent, err := q.loadDebridTorrent(ctx, t, isSymlink)
+	if err != nil {
+		// The debrid may only be unreachable for now, the saved files are kept as they are
+		q.logger.Error().Err(err).Msgf("Error rechecking %s", t.Name)
+		t.State = state
+		q.Storage.Update(t)
+		return false
+	}
+	if q.removeBrokenFiles(t, debridTorrent, q.outputAction(t.Category, isSymlink)) == 0 {
+		q.logger.Info().Msgf("Recheck of %s found no missing files", t.Name)
+		t.State = state
+		q.Storage.Update(t)
+		return true
+	}
+	q.logger.Info().Msgf("Repairing %s", t.Name)
+	go q.restartTorrent(t)
 	return true
 }
 
+// restartTorrent processes a torrent again after a pause, a recheck or a restart.
+// Existing symlinks are skipped and partial downloads are resumed
+func (q *QBit) restartTorrent(t *Torrent) {
+	if job := q.Jobs.Get(t.Hash, t.Category); job != nil && t.Debrid == "" {
+		// The torrent may not have reached the debrid, submit it again
+		magnet, err := job.getMagnet()
+		if err != nil {
+			q.MarkAsFailed(t, fmt.Errorf("error parsing magnet link: %w", err))
+			return
+		}
+		q.Jobs.SetState(t.Hash, t.Category, JobQueued, nil)
+		q.runJob(job, t, magnet, job.getArr())
+		return
+	}
+	ctx := q.torrentContext(t.Hash)
+	isSymlink := !t.SeqDl
+	debridTorrent, err := q.loadDebridTorrent(ctx, t, isSymlink)
+	if err != nil {
+		q.finishTorrent(ctx, t.Hash)
+		if ctx.Err() != nil {
+			return
+		}
+		q.logger.Error().Err(err).Msgf("Error resuming %s", t.Name)
+		q.MarkAsFailed(t, err)
+		return
+	}
+	t.TorrentPath = "" // Set again once the files are processed
+	q.UpdateTorrentMin(t, debridTorrent)
+	service.GetDebrid().Acquire(debridTorrent.Debrid)
+	q.ProcessFiles(ctx, t, debridTorrent, debridTorrent.Arr, isSymlink)
+}
+
+// loadDebridTorrent refreshes the debrid torrent of t, which also renews expired download links.
+// Torrents added before a restart are rebuilt from the stored debrid id
+func (q *QBit) loadDebridTorrent(ctx context.Context, t *Torrent, isSymlink bool) (*debrid.Torrent, error) {
+	debridClient := service.GetDebrid().GetByName(t.Debrid)
+	if debridClient == nil {
+		return nil, fmt.Errorf("unknown debrid: %s", t.Debrid)
+	}
+	debridTorrent := t.DebridTorrent
+	if debridTorrent == nil {
+		magnet, err := utils.GetMagnetInfo(t.MagnetUri)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing magnet link: %w", err)
+		}
+		debridTorrent = &debrid.Torrent{
+			Id:       t.ID,
+			InfoHash: t.Hash,
+			Name:     t.Name,
+			Magnet:   magnet,
+			Debrid:   t.Debrid,
+			KeyId:    t.DebridKey,
+		}
+	}
+	if debridTorrent.Arr == nil {
+		if job := q.Jobs.Get(t.Hash, t.Category); job != nil {
+			debridTorrent.Arr = job.getArr()
+		} else if a := service.GetService().Arr.Get(t.Category); a != nil {
+			debridTorrent.Arr = a
+		} else {
+			downloadUncached := false
+			debridTorrent.Arr = arr.New(t.Category, "", "", false, false, &downloadUncached)
+		}
+	}
+	return debridClient.CheckStatus(ctx, debridTorrent, isSymlink)
+}
+
+// removeBrokenFiles checks the saved files of a torrent against the debrid file list.
+// Dangling symlinks and oversized files are removed, truncated downloads are downloaded again.
+// It returns the number of files that need repair
+func (q *QBit) removeBrokenFiles(t *Torrent, debridTorrent *debrid.Torrent, action string) int {
+	dir := cmp.Or(t.TorrentPath, filepath.Clean(t.ContentPath))
+	isSymlink := action == config.CategoryActionSymlink
+	broken := 0
+	for _, file := range debridTorrent.Files {
+		path := filepath.Join(dir, outputName(action, debridTorrent, file))
+		info, err := os.Stat(path) // Follows the symlink to the mount
+		switch {
+		case err != nil:
+			q.logger.Info().Msgf("Missing file: %s", path)
+			if isSymlink {
+				// A dangling symlink has to go before it can be created again
+				_ = os.Remove(path)
+			}
+		case isSymlink || action == config.CategoryActionStrm || file.Size == 0 || info.Size() == file.Size:
+			continue
+		case info.Size() > file.Size:
+			q.logger.Info().Msgf("Size mismatch: %s", path)
+			if err := os.Remove(path); err != nil {
+				q.logger.Error().Err(err).Msgf("Error removing %s", path)
+			}
+		default:
+			q.logger.Info().Msgf("Incomplete file: %s", path)
+		}
+		broken++
+	}
+	return broken
+}
+
 func (q *QBit) GetTorrentProperties(t *Torrent) *TorrentProperties {
 	return &TorrentProperties{
 		AdditionDate:           t.AddedOn,
@@ -255,18 +474,204 @@ func (q *QBit) GetTorrentProperties(t *Torrent) *TorrentProperties {
 
 func (q *QBit) GetTorrentFiles(t *Torrent) []*TorrentFile {
 	files := make([]*TorrentFile, 0)
-	if t.DebridTorrent == nil {
+	debridTorrent := t.DebridTorrent
+	if debridTorrent == nil {
 		return files
 	}
-	for _, file := range t.DebridTorrent.Files {
-		files = append(files, &TorrentFile{
-			Name: file.Path,
-			Size: file.Size,
-		})
+	resolved := len(debridTorrent.Files) > 0 || len(debridTorrent.SkippedFiles) > 0
+	selector := debrid.GetSelector(t.Category)
+	for i, file := range debridTorrent.IndexedFiles() {
+		tf := &TorrentFile{
+			Index: i,
+			Name:  file.Path,
+			Size:  file.Size,
+		}
+		switch {
+		case file.File != nil:
+			tf.Name = debridTorrent.GetFilePath(*file.File)
+			if slices.ContainsFunc(debridTorrent.Files, func(f debrid.File) bool { return f.Path == file.File.Path }) {
+				tf.Progress = t.Progress
+				tf.Priority = debridTorrent.GetFilePriority(file.Path)
+				tf.IsSeed = t.Progress >= 1
+			}
+		case !resolved:
+			// The debrid hasn't resolved the files yet, use the selection they will get
+			if priority, ok := debridTorrent.FilePriorities[file.Path]; ok {
+				tf.Priority = priority
+			} else if selector.Allowed(file.Path, file.Size) {
+				tf.Priority = 1
+			}
+		}
+		files = append(files, tf)
 	}
 	return files
 }
 
+// SetFilePriority sets the priority of files by their index, a priority of 0 skips them.
+// Debrids that support it select the new files, on the others the change only applies to the files saved locally
+func (q *QBit) SetFilePriority(ctx context.Context, t *Torrent, ids []int, priority int) error {
+	debridTorrent := t.DebridTorrent
+	if debridTorrent == nil {
+		return fmt.Errorf("torrent files are not known yet")
+	}
+	debridTorrent.Mu.Lock()
+	files := debridTorrent.IndexedFiles()
+	paths := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id < 0 || id >= len(files) {
+			debridTorrent.Mu.Unlock()
+			return fmt.Errorf("invalid file id: %d", id)
+		}
+		// Files of the .torrent are set by their path in it, the others by their debrid path
+		paths = append(paths, files[id].Path)
+	}
+	changed := debridTorrent.SetFilePriority(paths, priority)
+	debridTorrent.Mu.Unlock()
+	q.UpdateTorrentMin(t, debridTorrent)
+	q.Storage.Update(t)
+	if !changed {
+		return nil
+	}
+	selector, ok := service.GetDebrid().GetByName(debridTorrent.Debrid).(engine.FileSelector)
+	if !ok || debridTorrent.Id == "" {
+		// Torrents not on the debrid yet are submitted with the new selection
+		return nil
+	}
+	go q.reselectFiles(t, selector)
+	return nil
+}
+
+// reselectFiles applies the file selection of a torrent on the debrid as a processing run of its own,
+// stopping the run in progress. The torrent is then processed again, with its new debrid id if it changed
+func (q *QBit) reselectFiles(t *Torrent, selector engine.FileSelector) {
+	runCtx := q.torrentContext(t.Hash)
+	ctx, cancel := context.WithTimeout(runCtx, 2*time.Minute)
+	defer cancel()
+	debridTorrent := t.DebridTorrent
+	oldId := debridTorrent.Id
+	_, err := selector.SelectTorrentFiles(ctx, debridTorrent)
+	q.finishTorrent(runCtx, t.Hash)
+	if runCtx.Err() != nil {
+		// Deleted, paused or processed again in the meantime
+		return
+	}
+	if err != nil {
+		q.logger.Error().Err(err).Msgf("Error selecting files of %s", debridTorrent.Name)
+	} else if debridTorrent.Id != oldId {
+		q.logger.Info().Msgf("Selected the files of %s, new debrid id %s", debridTorrent.Name, debridTorrent.Id)
+		t.ID = debridTorrent.Id
+		t.DebridKey = debridTorrent.KeyId
+		q.unlinkFiles(t, debridTorrent, q.outputAction(t.Category, !t.SeqDl))
+	}
+	q.Storage.Update(t)
+	if t.State == "error" || t.State == "pausedDL" {
+		// Processed again once resumed
+		return
+	}
+	q.restartTorrent(t)
+}
+
+// unlinkFiles removes the saved files that point at the previous debrid torrent after the torrent was added again,
+// so they are created again for the new one. Symlinks, and the .strm files of skipped files go
+func (q *QBit) unlinkFiles(t *Torrent, debridTorrent *debrid.Torrent, action string) {
+	dir := cmp.Or(t.TorrentPath, filepath.Clean(t.ContentPath))
+	if dir == "" || dir == "." {
+		return
+	}
+	var files []debrid.File
+	switch action {
+	case config.CategoryActionSymlink:
+		files = append(slices.Clone(debridTorrent.Files), debridTorrent.SkippedFiles...)
+	case config.CategoryActionStrm:
+		files = debridTorrent.SkippedFiles
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, outputName(action, debridTorrent, file))
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			q.logger.Debug().Msgf("Failed to remove %s: %v", path, err)
+		}
+	}
+}
+
+// RenameFile renames a file of the torrent. The file is moved if it was already saved
+func (q *QBit) RenameFile(t *Torrent, oldPath, newPath string) error {
+	debridTorrent := t.DebridTorrent
+	if debridTorrent == nil {
+		return fmt.Errorf("torrent files are not known yet")
+	}
+	if oldPath == "" || newPath == "" {
+		return fmt.Errorf("invalid path")
+	}
+	for _, file := range resolvedFiles(debridTorrent) {
+		if debridTorrent.GetFilePath(file) == oldPath {
+			return q.renameFiles(t, map[string]string{file.Path: newPath})
+		}
+	}
+	return fmt.Errorf("file not found: %s", oldPath)
+}
+
+// RenameFolder moves all the files of a folder of the torrent
+func (q *QBit) RenameFolder(t *Torrent, oldPath, newPath string) error {
+	debridTorrent := t.DebridTorrent
+	if debridTorrent == nil {
+		return fmt.Errorf("torrent files are not known yet")
+	}
+	if oldPath == "" || newPath == "" {
+		return fmt.Errorf("invalid path")
+	}
+	oldPath = strings.TrimSuffix(oldPath, "/") + "/"
+	newPath = strings.TrimSuffix(newPath, "/") + "/"
+	renames := make(map[string]string)
+	for _, file := range resolvedFiles(debridTorrent) {
+		if path := debridTorrent.GetFilePath(file); strings.HasPrefix(path, oldPath) {
+			renames[file.Path] = newPath + strings.TrimPrefix(path, oldPath)
+		}
+	}
+	if len(renames) == 0 {
+		return fmt.Errorf("folder not found: %s", oldPath)
+	}
+	return q.renameFiles(t, renames)
+}
+
+// resolvedFiles returns the files of the torrent the debrid listed, in the order of their index
+func resolvedFiles(debridTorrent *debrid.Torrent) []debrid.File {
+	files := make([]debrid.File, 0, len(debridTorrent.Files)+len(debridTorrent.SkippedFiles))
+	for _, file := range debridTorrent.IndexedFiles() {
+		if file.File != nil {
+			files = append(files, *file.File)
+		}
+	}
+	return files
+}
+
+func (q *QBit) renameFiles(t *Torrent, renames map[string]string) error {
+	debridTorrent := t.DebridTorrent
+	debridTorrent.Mu.Lock()
+	defer debridTorrent.Mu.Unlock()
+	if debridTorrent.Renames == nil {
+		debridTorrent.Renames = make(map[string]string)
+	}
+	for _, file := range resolvedFiles(debridTorrent) {
+		newPath, ok := renames[file.Path]
+		if !ok {
+			continue
+		}
+		oldName := debridTorrent.GetFileName(file)
+		debridTorrent.Renames[file.Path] = newPath
+		newName := debridTorrent.GetFileName(file)
+		if t.ContentPath == "" || oldName == newName {
+			continue
+		}
+		// Files are saved flat in the torrent folder, nothing is moved if they aren't saved yet
+		err := os.Rename(filepath.Join(t.ContentPath, oldName), filepath.Join(t.ContentPath, newName))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rename %s: %v", oldName, err)
+		}
+	}
+	q.Storage.Update(t)
+	return nil
+}
+
 func (q *QBit) SetTorrentTags(t *Torrent, tags []string) bool {
 	torrentTags := strings.Split(t.Tags, ",")
 	for _, tag := range tags {
@@ -0,0 +1,50 @@
+package qbit
+
+import "time"
+
+// GetTransferInfo returns the global transfer of all torrents
+func (q *QBit) GetTransferInfo() TransferInfo {
+	state := q.GetServerState()
+	return TransferInfo{
+		ConnectionStatus: state.ConnectionStatus,
+		DHTNodes:         state.DHTNodes,
+		DlInfoData:       state.DlInfoData,
+		DlInfoSpeed:      state.DlInfoSpeed,
+		DlRateLimit:      state.DlRateLimit,
+		UpInfoData:       state.UpInfoData,
+		UpInfoSpeed:      state.UpInfoSpeed,
+		UpRateLimit:      state.UpRateLimit,
+	}
+}
+
+// GetSpeedLimits returns whether the alternative limits are on, and the download and upload limits in bytes/s.
+// The download limit is the one in effect, it follows the alternative limits and the schedules
+func (q *QBit) GetSpeedLimits() (bool, int64, int64) {
+	q.speedMu.Lock()
+	defer q.speedMu.Unlock()
+	return q.altSpeedLimits, q.downloadLimit(time.Now()), q.upRateLimit
+}
+
+// ToggleSpeedLimitsMode switches the local downloads to the alternative limit and back
+func (q *QBit) ToggleSpeedLimitsMode() {
+	q.speedMu.Lock()
+	q.altSpeedLimits = !q.altSpeedLimits
+	q.speedMu.Unlock()
+	q.applySpeedLimits()
+}
+
+// SetDownloadLimit sets the global download limit in bytes/s, 0 or less removes it.
+// The alternative limits and the active schedules still take precedence
+func (q *QBit) SetDownloadLimit(limit int64) {
+	q.speedMu.Lock()
+	q.dlRateLimit = max(limit, 0)
+	q.speedMu.Unlock()
+	q.applySpeedLimits()
+}
+
+// SetUploadLimit sets the global upload limit in bytes/s. Nothing is uploaded, it's only reported back
+func (q *QBit) SetUploadLimit(limit int64) {
+	q.speedMu.Lock()
+	defer q.speedMu.Unlock()
+	q.upRateLimit = max(limit, 0)
+}
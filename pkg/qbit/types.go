@@ -172,10 +172,52 @@ type TorrentCategory struct {
 	SavePath string `json:"savePath"`
 }
 
+// MainData is the response of sync/maindata. Only what changed since the requested rid is sent,
+// unless FullUpdate is set
+type MainData struct {
+	Rid               int64                      `json:"rid"`
+	FullUpdate        bool                       `json:"full_update,omitempty"`
+	Torrents          map[string]map[string]any  `json:"torrents,omitempty"`
+	TorrentsRemoved   []string                   `json:"torrents_removed,omitempty"`
+	Categories        map[string]TorrentCategory `json:"categories,omitempty"`
+	CategoriesRemoved []string                   `json:"categories_removed,omitempty"`
+	Tags              []string                   `json:"tags,omitempty"`
+	TagsRemoved       []string                   `json:"tags_removed,omitempty"`
+	ServerState       map[string]any             `json:"server_state,omitempty"`
+}
+
+type TransferInfo struct {
+	ConnectionStatus string `json:"connection_status"`
+	DHTNodes         int    `json:"dht_nodes"`
+	DlInfoData       int64  `json:"dl_info_data"`
+	DlInfoSpeed      int64  `json:"dl_info_speed"`
+	DlRateLimit      int64  `json:"dl_rate_limit"`
+	UpInfoData       int64  `json:"up_info_data"`
+	UpInfoSpeed      int64  `json:"up_info_speed"`
+	UpRateLimit      int64  `json:"up_rate_limit"`
+}
+
+type ServerState struct {
+	ConnectionStatus  string `json:"connection_status"`
+	DHTNodes          int    `json:"dht_nodes"`
+	DlInfoData        int64  `json:"dl_info_data"`
+	DlInfoSpeed       int64  `json:"dl_info_speed"`
+	DlRateLimit       int64  `json:"dl_rate_limit"`
+	UpInfoData        int64  `json:"up_info_data"`
+	UpInfoSpeed       int64  `json:"up_info_speed"`
+	UpRateLimit       int64  `json:"up_rate_limit"`
+	AllTimeDl         int64  `json:"alltime_dl"`
+	AllTimeUl         int64  `json:"alltime_ul"`
+	Queueing          bool   `json:"queueing"`
+	UseAltSpeedLimits bool   `json:"use_alt_speed_limits"`
+	RefreshInterval   int    `json:"refresh_interval"`
+}
+
 type Torrent struct {
 	ID            string           `json:"id"`
 	DebridTorrent *torrent.Torrent `json:"-"`
 	Debrid        string           `json:"debrid"`
+	DebridKey     string           `json:"debrid_key,omitempty"` // Id of the API key that owns the torrent
 	TorrentPath   string           `json:"-"`
 
 	AddedOn           int64   `json:"added_on,omitempty"`
@@ -279,11 +321,11 @@ type TorrentProperties struct {
 }
 
 type TorrentFile struct {
-	Index        int     `json:"index,omitempty"`
+	Index        int     `json:"index"`
 	Name         string  `json:"name,omitempty"`
 	Size         int64   `json:"size,omitempty"`
-	Progress     int     `json:"progress,omitempty"`
-	Priority     int     `json:"priority,omitempty"`
+	Progress     float64 `json:"progress"`
+	Priority     int     `json:"priority"` // 0 means the file was skipped by the selection profile
 	IsSeed       bool    `json:"is_seed,omitempty"`
 	PieceRange   []int   `json:"piece_range,omitempty"`
 	Availability float64 `json:"availability,omitempty"`
@@ -9,6 +9,7 @@ import (
 	"github.com/sirrobot01/debrid-blackhole/internal/config"
 	"github.com/sirrobot01/debrid-blackhole/internal/logger"
 	"github.com/sirrobot01/debrid-blackhole/internal/request"
+	"github.com/sirrobot01/debrid-blackhole/internal/store"
 	"github.com/sirrobot01/debrid-blackhole/pkg/arr"
 	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/engine"
 	"golang.org/x/sync/errgroup"
@@ -36,7 +37,7 @@ type Repair struct {
 	IsZurg      bool
 	autoProcess bool
 	logger      zerolog.Logger
-	filename    string
+	db          store.Store
 }
 
 func New(arrs *arr.Storage) *Repair {
@@ -52,13 +53,12 @@ func New(arrs *arr.Storage) *Repair {
 		runOnStart:  cfg.Repair.RunOnStart,
 		ZurgURL:     cfg.Repair.ZurgURL,
 		autoProcess: cfg.Repair.AutoProcess,
-		filename:    filepath.Join(cfg.Path, "repair.json"),
+		db:          store.GetStore(),
 	}
 	if r.ZurgURL != "" {
 		r.IsZurg = true
 	}
-	// Load jobs from file
-	r.loadFromFile()
+	r.loadJobs()
 
 	return r
 }
@@ -184,9 +184,9 @@ func (r *Repair) AddJob(arrsNames []string, mediaIDs []string, autoProcess, recu
 	job.Recurrent = recurrent
 	r.reset(job)
 	r.Jobs[key] = job
-	go r.saveToFile()
+	r.saveJob(key, job)
 	err := r.repair(job)
-	go r.saveToFile()
+	r.saveJob(key, job)
 	return err
 }
 
@@ -638,32 +638,29 @@ func (r *Repair) ProcessJob(id string) error {
 	return nil
 }
 
-func (r *Repair) saveToFile() {
-	// Save jobs to file
-	data, err := json.Marshal(r.Jobs)
-	if err != nil {
-		r.logger.Debug().Err(err).Msg("Failed to marshal jobs")
+func (r *Repair) saveJob(key string, job *Job) {
+	if err := r.db.Put(store.RepairBucket, key, job); err != nil {
+		r.logger.Error().Err(err).Msg("Failed to save job")
 	}
-	err = os.WriteFile(r.filename, data, 0644)
 }
 
-func (r *Repair) loadFromFile() {
-	data, err := os.ReadFile(r.filename)
-	if err != nil && os.IsNotExist(err) {
-		r.Jobs = make(map[string]*Job)
-		return
-	}
-	jobs := make(map[string]*Job)
-	err = json.Unmarshal(data, &jobs)
+func (r *Repair) loadJobs() {
+	r.Jobs = make(map[string]*Job)
+	err := r.db.ForEach(store.RepairBucket, func(key string, data []byte) error {
+		job := &Job{}
+		if err := json.Unmarshal(data, job); err != nil {
+			return err
+		}
+		r.Jobs[key] = job
+		return nil
+	})
 	if err != nil {
-		r.logger.Trace().Err(err).Msg("Failed to unmarshal jobs; resetting")
-		r.Jobs = make(map[string]*Job)
-		return
+		r.logger.Error().Err(err).Msg("Failed to load jobs")
 	}
-	r.Jobs = jobs
 }
 
 func (r *Repair) DeleteJobs(ids []string) {
+	keys := make([]string, 0, len(ids))
 	for _, id := range ids {
 		if id == "" {
 			continue
@@ -671,8 +668,11 @@ func (r *Repair) DeleteJobs(ids []string) {
 		for k, job := range r.Jobs {
 			if job.ID == id {
 				delete(r.Jobs, k)
+				keys = append(keys, k)
 			}
 		}
 	}
-	go r.saveToFile()
+	if err := r.db.Delete(store.RepairBucket, keys...); err != nil {
+		r.logger.Error().Err(err).Msg("Failed to delete jobs")
+	}
 }
@@ -3,6 +3,7 @@ package service
 import (
 	"github.com/sirrobot01/debrid-blackhole/pkg/arr"
 	"github.com/sirrobot01/debrid-blackhole/pkg/debrid"
+	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/cache"
 	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/engine"
 	"github.com/sirrobot01/debrid-blackhole/pkg/repair"
 	"sync"
@@ -12,6 +13,8 @@ type Service struct {
 	Repair *repair.Repair
 	Arr    *arr.Storage
 	Debrid *engine.Engine
+	// DebridCache keeps the torrents and download links of the streamed files
+	DebridCache *cache.Manager
 }
 
 var (
@@ -24,9 +27,10 @@ func New() *Service {
 		arrs := arr.NewStorage()
 		deb := debrid.New()
 		instance = &Service{
-			Repair: repair.New(arrs),
-			Arr:    arrs,
-			Debrid: deb,
+			Repair:      repair.New(arrs),
+			Arr:         arrs,
+			Debrid:      deb,
+			DebridCache: cache.NewManager(deb),
 		}
 	})
 	return instance
@@ -44,9 +48,10 @@ func Update() *Service {
 	arrs := arr.NewStorage()
 	deb := debrid.New()
 	instance = &Service{
-		Repair: repair.New(arrs),
-		Arr:    arrs,
-		Debrid: deb,
+		Repair:      repair.New(arrs),
+		Arr:         arrs,
+		Debrid:      deb,
+		DebridCache: cache.NewManager(deb),
 	}
 	return instance
 }
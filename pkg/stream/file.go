@@ -0,0 +1,141 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/cache"
+	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/torrent"
+	"io"
+	"net/http"
+)
+
+// readAttempts is how many connections a read tries, every retry gets a new download link
+const readAttempts = 3
+
+// remoteFile reads a debrid file over HTTP as an io.ReadSeeker.
+// A read that fails continues where it stopped with a new download link, so links never expire for the player
+type remoteFile struct {
+	ctx     context.Context
+	cache   *cache.Cache
+	torrent *cache.CachedTorrent
+	file    *torrent.File
+	client  *http.Client
+	logger  zerolog.Logger
+
+	offset int64
+	body   io.ReadCloser
+}
+
+func (f *remoteFile) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = f.offset + offset
+	case io.SeekEnd:
+		abs = f.file.Size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+	if abs != f.offset {
+		// The next read asks for the new position
+		f.closeBody()
+	}
+	f.offset = abs
+	return abs, nil
+}
+
+func (f *remoteFile) Read(p []byte) (int, error) {
+	if f.offset >= f.file.Size {
+		return 0, io.EOF
+	}
+	var err error
+	for attempt := 0; attempt < readAttempts; attempt++ {
+		if f.body == nil {
+			if err = f.open(attempt > 0); err != nil {
+				if f.ctx.Err() != nil {
+					return 0, f.ctx.Err()
+				}
+				f.logger.Debug().Err(err).Msgf("Error opening %s at %d", f.file.Name, f.offset)
+				continue
+			}
+		}
+		var n int
+		n, err = f.body.Read(p)
+		f.offset += int64(n)
+		if err != nil {
+			f.closeBody()
+		}
+		if n > 0 {
+			// An error is picked up by the next read
+			return n, nil
+		}
+		if f.offset >= f.file.Size {
+			return 0, io.EOF
+		}
+		if f.ctx.Err() != nil {
+			return 0, f.ctx.Err()
+		}
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return 0, err
+}
+
+func (f *remoteFile) Close() error {
+	f.closeBody()
+	return nil
+}
+
+func (f *remoteFile) closeBody() {
+	if f.body != nil {
+		_ = f.body.Close()
+		f.body = nil
+	}
+}
+
+// open requests the file from the offset. refresh replaces the download link, e.g after it expired
+func (f *remoteFile) open(refresh bool) error {
+	var (
+		link string
+		err  error
+	)
+	if refresh {
+		link, err = f.cache.RefreshFileDownloadLink(f.ctx, f.torrent, f.file)
+	} else {
+		link, err = f.cache.GetFileDownloadLink(f.ctx, f.torrent, f.file)
+	}
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(f.ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", f.offset))
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range, skip to the offset
+		if _, err := io.CopyN(io.Discard, resp.Body, f.offset); err != nil {
+			resp.Body.Close()
+			return err
+		}
+	default:
+		resp.Body.Close()
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	f.body = resp.Body
+	return nil
+}
@@ -0,0 +1,132 @@
+package stream
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/rs/zerolog"
+	"github.com/sirrobot01/debrid-blackhole/internal/config"
+	"github.com/sirrobot01/debrid-blackhole/internal/logger"
+	"github.com/sirrobot01/debrid-blackhole/pkg/service"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Stream serves the files of the debrid torrents over HTTP, for .strm files and external players
+type Stream struct {
+	logger zerolog.Logger
+	client *http.Client
+}
+
+func New() *Stream {
+	cfg := config.GetConfig()
+	return &Stream{
+		logger: logger.NewLogger("stream", cfg.LogLevel, os.Stdout),
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				ResponseHeaderTimeout: time.Minute,
+			},
+		},
+	}
+}
+
+func (s *Stream) Routes() http.Handler {
+	r := chi.NewRouter()
+	r.Get("/{debrid}/{torrentId}/{fileId}", s.handleStream)
+	r.Head("/{debrid}/{torrentId}/{fileId}", s.handleStream)
+	return r
+}
+
+// URL returns the URL a file of a debrid torrent is streamed at, base being the address decypharr is reached at.
+// It carries the API key owning the torrent and a token signing the file, the endpoint having no login
+func URL(base, debrid, torrentId, keyId, fileId string) (string, error) {
+	token, err := sign(debrid, torrentId, keyId, fileId)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{}
+	if keyId != "" {
+		query.Set("key", keyId)
+	}
+	query.Set("token", token)
+	return fmt.Sprintf("%s/stream/%s/%s/%s?%s", base, url.PathEscape(debrid), url.PathEscape(torrentId), url.PathEscape(fileId), query.Encode()), nil
+}
+
+// sign returns the token of a file, a HMAC of its ids with the stream key
+func sign(debrid, torrentId, keyId, fileId string) (string, error) {
+	key, err := config.GetConfig().GetStreamKey()
+	if err != nil {
+		return "", fmt.Errorf("failed to get the stream key: %v", err)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join([]string{debrid, torrentId, keyId, fileId}, "\x00")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// handleStream serves a file of a debrid torrent with Range support.
+// Its download link comes from the debrid cache and is replaced whenever it stops working
+func (s *Stream) handleStream(w http.ResponseWriter, r *http.Request) {
+	debridName := chi.URLParam(r, "debrid")
+	torrentId := chi.URLParam(r, "torrentId")
+	fileId := chi.URLParam(r, "fileId")
+	keyId := r.URL.Query().Get("key")
+	token, err := sign(debridName, torrentId, keyId, fileId)
+	if err != nil {
+		s.logger.Error().Err(err).Msg("Error signing the stream request")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !hmac.Equal([]byte(token), []byte(r.URL.Query().Get("token"))) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	c := service.GetService().DebridCache.GetCache(debridName)
+	if c == nil {
+		http.Error(w, "Unknown debrid", http.StatusNotFound)
+		return
+	}
+	cachedTorrent := c.GetTorrent(torrentId)
+	if cachedTorrent == nil {
+		cachedTorrent = c.RefreshTorrent(r.Context(), torrentId, keyId)
+	}
+	if cachedTorrent == nil {
+		http.Error(w, "Torrent not found", http.StatusNotFound)
+		return
+	}
+	file := cachedTorrent.GetFile(fileId)
+	if file == nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	// Fail before the headers are sent if the file can't be reached at all
+	if _, err := c.GetFileDownloadLink(r.Context(), cachedTorrent, file); err != nil {
+		s.logger.Error().Err(err).Msgf("Error getting the download link of %s", file.Name)
+		http.Error(w, "Failed to get the download link", http.StatusBadGateway)
+		return
+	}
+
+	// Set the type from the extension, ServeContent would read the file to sniff it
+	contentType := mime.TypeByExtension(filepath.Ext(file.Name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	f := &remoteFile{
+		ctx:     r.Context(),
+		cache:   c,
+		torrent: cachedTorrent,
+		file:    file,
+		client:  s.client,
+		logger:  s.logger,
+	}
+	defer f.Close()
+	http.ServeContent(w, r, file.Name, time.Time{}, f)
+}
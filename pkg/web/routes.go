@@ -27,9 +27,11 @@ func (ui *Handler) Routes() http.Handler {
 			r.Post("/repair/jobs/{id}/process", ui.handleProcessRepairJob)
 			r.Delete("/repair/jobs", ui.handleDeleteRepairJob)
 			r.Get("/torrents", ui.handleGetTorrents)
+			r.Get("/jobs", ui.handleGetJobs)
 			r.Delete("/torrents/{category}/{hash}", ui.handleDeleteTorrent)
 			r.Delete("/torrents/", ui.handleDeleteTorrents)
 			r.Get("/config", ui.handleGetConfig)
+			r.Get("/debrids", ui.handleGetDebrids)
 			r.Get("/version", ui.handleGetVersion)
 		})
 	})
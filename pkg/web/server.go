@@ -9,6 +9,7 @@ import (
 	"github.com/sirrobot01/debrid-blackhole/internal/logger"
 	"github.com/sirrobot01/debrid-blackhole/internal/request"
 	"github.com/sirrobot01/debrid-blackhole/internal/utils"
+	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/engine"
 	"github.com/sirrobot01/debrid-blackhole/pkg/qbit"
 	"github.com/sirrobot01/debrid-blackhole/pkg/service"
 	"golang.org/x/crypto/bcrypt"
@@ -16,6 +17,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/rs/zerolog"
@@ -406,10 +408,55 @@ func (ui *Handler) handleGetVersion(w http.ResponseWriter, r *http.Request) {
 	request.JSONResponse(w, v, http.StatusOK)
 }
 
+func (ui *Handler) handleGetDebrids(w http.ResponseWriter, r *http.Request) {
+	d := service.GetDebrid()
+	stats := d.Health()
+	debrids := make([]engine.Health, 0, len(d.Debrids))
+	for _, db := range d.GetDebrids() {
+		debrids = append(debrids, stats[db.GetName()])
+	}
+	data := map[string]interface{}{
+		"policy":   d.GetPolicy().Name(),
+		"policies": engine.Policies(),
+		"debrids":  debrids,
+		"cache":    d.AvailabilityStats(),
+		"accounts": d.Accounts(),
+		"tracked":  d.Tracked(),
+		"keys":     d.KeyUsage(),
+	}
+	request.JSONResponse(w, data, http.StatusOK)
+}
+
 func (ui *Handler) handleGetTorrents(w http.ResponseWriter, r *http.Request) {
 	request.JSONResponse(w, ui.qbit.Storage.GetAll("", "", nil), http.StatusOK)
 }
 
+func (ui *Handler) handleGetJobs(w http.ResponseWriter, r *http.Request) {
+	// Leave out the .torrent files and arr tokens
+	type jobInfo struct {
+		Hash      string        `json:"hash"`
+		Name      string        `json:"name"`
+		Category  string        `json:"category"`
+		State     qbit.JobState `json:"state"`
+		Error     string        `json:"error,omitempty"`
+		CreatedAt time.Time     `json:"created_at"`
+		UpdatedAt time.Time     `json:"updated_at"`
+	}
+	jobs := make([]jobInfo, 0)
+	for _, job := range ui.qbit.Jobs.GetAll() {
+		jobs = append(jobs, jobInfo{
+			Hash:      job.Hash,
+			Name:      job.Name,
+			Category:  job.Category,
+			State:     job.State,
+			Error:     job.Error,
+			CreatedAt: job.CreatedAt,
+			UpdatedAt: job.UpdatedAt,
+		})
+	}
+	request.JSONResponse(w, jobs, http.StatusOK)
+}
+
 func (ui *Handler) handleDeleteTorrent(w http.ResponseWriter, r *http.Request) {
 	hash := chi.URLParam(r, "hash")
 	category := r.URL.Query().Get("category")
@@ -417,7 +464,7 @@ func (ui *Handler) handleDeleteTorrent(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "No hash provided", http.StatusBadRequest)
 		return
 	}
-	ui.qbit.Storage.Delete(hash, category)
+	ui.qbit.DeleteTorrent(hash, category)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -428,7 +475,7 @@ func (ui *Handler) handleDeleteTorrents(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	hashes := strings.Split(hashesStr, ",")
-	ui.qbit.Storage.DeleteMultiple(hashes)
+	ui.qbit.DeleteTorrents(hashes)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -447,7 +494,14 @@ func (ui *Handler) handleGetConfig(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 	cfg.Arrs = arrCfgs
-	request.JSONResponse(w, cfg, http.StatusOK)
+	data := struct {
+		*config.Config
+		Providers []string `json:"providers"`
+	}{
+		Config:    cfg,
+		Providers: engine.Providers(),
+	}
+	request.JSONResponse(w, data, http.StatusOK)
 }
 
 func (ui *Handler) handleGetRepairJobs(w http.ResponseWriter, r *http.Request) {
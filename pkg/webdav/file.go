@@ -1,6 +1,7 @@
 package webdav
 
 import (
+	"context"
 	"fmt"
 	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/cache"
 	"github.com/sirrobot01/debrid-blackhole/pkg/debrid/torrent"
@@ -11,6 +12,7 @@ import (
 )
 
 type File struct {
+	ctx           context.Context
 	cache         *cache.Cache
 	cachedTorrent *cache.CachedTorrent
 	file          *torrent.File
@@ -28,7 +30,7 @@ func (f *File) Close() error {
 
 func (f *File) GetDownloadLink() string {
 	file := f.file
-	link, err := f.cache.GetFileDownloadLink(f.cachedTorrent, file)
+	link, err := f.cache.GetFileDownloadLink(f.ctx, f.cachedTorrent, file)
 	if err != nil {
 		return ""
 	}
@@ -44,7 +46,7 @@ func (f *File) Read(p []byte) (n int, err error) {
 	// If we haven't started streaming the file yet, open the HTTP connection.
 	if f.reader == nil {
 		// Create an HTTP GET request to the file's URL.
-		req, err := http.NewRequest("GET", f.GetDownloadLink(), nil)
+		req, err := http.NewRequestWithContext(f.ctx, "GET", f.GetDownloadLink(), nil)
 		if err != nil {
 			return 0, fmt.Errorf("failed to create HTTP request: %w", err)
 		}
@@ -150,6 +150,7 @@ func (h *Handler) OpenFile(ctx context.Context, name string, flag int, perm os.F
 			cachedTorrent: cachedTorrent,
 			file:          file,
 			isDir:         false,
+			ctx:           ctx,
 		}, nil
 	}
 
@@ -1,10 +1,13 @@
 package worker
 
 import (
+	"cmp"
 	"context"
+	"fmt"
 	"github.com/rs/zerolog"
 	"github.com/sirrobot01/debrid-blackhole/internal/config"
 	"github.com/sirrobot01/debrid-blackhole/internal/logger"
+	"github.com/sirrobot01/debrid-blackhole/internal/request"
 	"github.com/sirrobot01/debrid-blackhole/pkg/service"
 	"os"
 	"sync"
@@ -30,11 +33,15 @@ func Start(ctx context.Context) error {
 	// Start Arr Refresh Worker
 
 	var wg sync.WaitGroup
-	wg.Add(1)
+	wg.Add(2)
 	go func() {
 		defer wg.Done()
 		cleanUpQueuesWorker(ctx, cfg)
 	}()
+	go func() {
+		defer wg.Done()
+		accountWorker(ctx, cfg)
+	}()
 	wg.Wait()
 	return nil
 }
@@ -106,3 +113,60 @@ func cleanUpQueues() {
 		}
 	}
 }
+
+func accountWorker(ctx context.Context, cfg *config.Config) {
+	// Start Debrid Account Worker
+	_logger := getLogger()
+	_logger.Debug().Msg("Debrid Account Worker started")
+	accountCtx := context.WithValue(ctx, "worker", "account")
+	accountTicker := time.NewTicker(30 * time.Minute)
+	defer accountTicker.Stop()
+
+	alertDays := cmp.Or(cfg.PremiumAlert, 7)
+	alerted := make(map[string]time.Time) // Last alert per debrid
+
+	refreshAccounts(ctx, alertDays, alerted)
+	for {
+		select {
+		case <-accountCtx.Done():
+			_logger.Debug().Msg("Debrid Account Worker stopped")
+			return
+		case <-accountTicker.C:
+			refreshAccounts(ctx, alertDays, alerted)
+		}
+	}
+}
+
+func refreshAccounts(ctx context.Context, alertDays int, alerted map[string]time.Time) {
+	_logger := getLogger()
+	d := service.GetDebrid()
+	for name, err := range d.RefreshAccounts(ctx) {
+		_logger.Debug().Err(err).Msgf("Error getting %s account info", name)
+	}
+	for name, account := range d.Accounts() {
+		if !account.IsUsable() {
+			_logger.Warn().Msgf("%s account can't take new torrents(expired, full or out of quota)", name)
+		}
+		// Alert at most once a day
+		if time.Since(alerted[name]) < 24*time.Hour {
+			continue
+		}
+		var event, status, msg string
+		switch {
+		case account.IsExpired():
+			event, status = "premium_expired", "error"
+			msg = fmt.Sprintf("%s premium has expired", name)
+		case account.Expiration == nil:
+			continue
+		case account.ExpiresIn() < time.Duration(alertDays)*24*time.Hour:
+			event, status = "premium_expiring", "warning"
+			msg = fmt.Sprintf("%s premium expires in %d day(s) on %s", name, int(account.ExpiresIn().Hours()/24), account.Expiration.Format("2006-01-02"))
+		default:
+			continue
+		}
+		alerted[name] = time.Now()
+		if err := request.SendDiscordMessage(event, status, msg); err != nil {
+			_logger.Error().Msgf("Error sending discord message: %v", err)
+		}
+	}
+}